@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"time"
 
@@ -85,6 +86,11 @@ func (a *App) startup(app *application.App, window *application.WebviewWindow, t
 		a.app.Event.Emit("sync:progress", progress)
 	})
 
+	// Transfer queue updates (throttled)
+	engine.SetQueueCallback(func(queue []models.QueuedTransfer) {
+		a.app.Event.Emit("sync:queue", queue)
+	})
+
 	// Sync lifecycle events
 	engine.SetSyncStartCallback(func() {
 		a.app.Event.Emit("sync:start", nil)
@@ -162,11 +168,94 @@ func (a *App) UpdateAutoSync(enabled bool) error {
 	return err
 }
 
+// UpdateTransferLimits updates how many files are transferred at once per
+// peer and how many chunks are sent ahead of the receiver's
+// acknowledgements; 0 restores a default
+func (a *App) UpdateTransferLimits(filesInFlight, chunkWindow int) error {
+	if filesInFlight < 0 || filesInFlight > 64 {
+		return fmt.Errorf("files in flight must be 0 for the default, or 1-64")
+	}
+	if chunkWindow < 0 || chunkWindow > 256 {
+		return fmt.Errorf("chunk window must be 0 for the default, or 1-256 chunks")
+	}
+	err := a.configStore.Update(func(c *config.Config) {
+		c.FilesInFlight = filesInFlight
+		c.ChunkWindow = chunkWindow
+	})
+	if err == nil && a.syncEngine != nil {
+		a.syncEngine.SetTransferLimits(a.configStore.Get().TransferLimits())
+	}
+	return err
+}
+
+// UpdateBandwidthLimits updates the upload and download limits of all
+// transfers together, in KiB/s; 0 means unlimited
+func (a *App) UpdateBandwidthLimits(uploadKBps, downloadKBps int) error {
+	if uploadKBps < 0 || downloadKBps < 0 {
+		return fmt.Errorf("bandwidth limits can't be negative")
+	}
+	return a.updateBandwidth(func(c *config.Config) {
+		// Replace the limit rather than change it, copies of the config share it
+		c.Bandwidth = nil
+		if uploadKBps != 0 || downloadKBps != 0 {
+			c.Bandwidth = &config.BandwidthLimit{UploadKBps: uploadKBps, DownloadKBps: downloadKBps}
+		}
+	})
+}
+
+// UpdatePeerBandwidthLimits updates the upload and download limits of the
+// transfers with a peer, in KiB/s; 0 means unlimited
+func (a *App) UpdatePeerBandwidthLimits(peerID string, uploadKBps, downloadKBps int) error {
+	if uploadKBps < 0 || downloadKBps < 0 {
+		return fmt.Errorf("bandwidth limits can't be negative")
+	}
+	return a.updateBandwidth(func(c *config.Config) {
+		// Replace the map rather than change it, copies of the config share it
+		limits := make(map[string]config.BandwidthLimit, len(c.PeerBandwidth)+1)
+		for id, limit := range c.PeerBandwidth {
+			limits[id] = limit
+		}
+		if uploadKBps == 0 && downloadKBps == 0 {
+			delete(limits, peerID)
+		} else {
+			limits[peerID] = config.BandwidthLimit{UploadKBps: uploadKBps, DownloadKBps: downloadKBps}
+		}
+		c.PeerBandwidth = limits
+	})
+}
+
+// UpdateBandwidthSchedules replaces the time of day windows with other
+// bandwidth limits
+func (a *App) UpdateBandwidthSchedules(schedules []config.BandwidthSchedule) error {
+	for i := range schedules {
+		if err := schedules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return a.updateBandwidth(func(c *config.Config) {
+		c.BandwidthSchedules = append([]config.BandwidthSchedule(nil), schedules...)
+	})
+}
+
+// updateBandwidth updates the bandwidth settings and applies them to the
+// transfers under way
+func (a *App) updateBandwidth(fn func(*config.Config)) error {
+	err := a.configStore.Update(fn)
+	if err == nil && a.syncEngine != nil {
+		a.syncEngine.ApplyBandwidthLimits()
+	}
+	return err
+}
+
 // UpdateGlobalExclusions updates the global exclusion patterns
 func (a *App) UpdateGlobalExclusions(patterns []string) error {
-	return a.configStore.Update(func(c *config.Config) {
+	err := a.configStore.Update(func(c *config.Config) {
 		c.GlobalExclusions = patterns
 	})
+	if err == nil && a.syncEngine != nil {
+		a.syncEngine.RefreshWatchers()
+	}
+	return err
 }
 
 // ============================================
@@ -262,6 +351,7 @@ func (a *App) AddFolderPair(peerID, localPath, remotePath string) (*models.Folde
 		RemotePath: remotePath,
 		Enabled:    true,
 		Exclusions: []string{},
+		Mode:       models.SyncModeTwoWay,
 	}
 
 	if err := a.configStore.Update(func(c *config.Config) {
@@ -272,6 +362,7 @@ func (a *App) AddFolderPair(peerID, localPath, remotePath string) (*models.Folde
 
 	// Send folder pair configuration to the peer
 	if a.syncEngine != nil {
+		a.syncEngine.RefreshWatchers()
 		go func() {
 			if err := a.syncEngine.SendFolderPairSync(peerID, pair, "add"); err != nil {
 				log.Printf("Failed to sync folder pair to peer: %v", err)
@@ -286,19 +377,195 @@ func (a *App) AddFolderPair(peerID, localPath, remotePath string) (*models.Folde
 
 // UpdateFolderPair updates a folder pair
 func (a *App) UpdateFolderPair(id string, enabled bool, exclusions []string) error {
-	return a.configStore.Update(func(c *config.Config) {
+	err := a.configStore.Update(func(c *config.Config) {
 		if fp := c.GetFolderPair(id); fp != nil {
 			fp.Enabled = enabled
 			fp.Exclusions = exclusions
 		}
 	})
+	if err == nil && a.syncEngine != nil {
+		a.syncEngine.RefreshWatchers()
+	}
+	return err
+}
+
+// SetFolderPairGitIgnore turns honoring the folder's .gitignore files on or
+// off for a folder pair
+func (a *App) SetFolderPairGitIgnore(id string, enabled bool) error {
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.GitIgnore = enabled
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+
+	if a.syncEngine != nil {
+		a.syncEngine.RefreshWatchers()
+	}
+	return nil
+}
+
+// SetFolderPairChunkDedup turns content-defined chunking on or off for a
+// folder pair. With it, pulled files are built from chunks already present
+// in local files and only the missing parts are transferred.
+func (a *App) SetFolderPairChunkDedup(id string, enabled bool) error {
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.ChunkDedup = enabled
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+	return nil
+}
+
+// SetFolderPairSymlinks sets what happens to the symlinks of a folder pair:
+// "skip" leaves them out, "preserve" recreates them as links on the peer and
+// "follow" syncs what they point to. Links are only kept as links when both
+// sides of the pair preserve them.
+func (a *App) SetFolderPairSymlinks(id string, policy string) error {
+	symlinks := models.SymlinkPolicy(policy)
+	if !symlinks.Valid() {
+		return fmt.Errorf("unknown symlink policy: %s", policy)
+	}
+
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.Symlinks = symlinks
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+	return nil
+}
+
+// SetFolderPairXattrs turns syncing extended attributes on or off for a
+// folder pair. allow and deny are glob patterns of attribute names, such as
+// "user.*"; an empty allow list syncs every attribute that isn't denied.
+// Attributes are only synced when both sides of the pair sync them.
+func (a *App) SetFolderPairXattrs(id string, enabled bool, allow, deny []string) error {
+	for _, patterns := range [][]string{allow, deny} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid attribute pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.Xattrs = models.XattrSettings{Enabled: enabled, Allow: allow, Deny: deny}
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+	return nil
+}
+
+// SetFolderPairPinnedPaths sets the files and folders of a folder pair
+// that are transferred before the rest
+func (a *App) SetFolderPairPinnedPaths(id string, paths []string) error {
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.PinnedPaths = paths
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+	return nil
+}
+
+// SetFolderPairMode changes the sync mode of a folder pair and gives the
+// peer's side the complementary mode
+func (a *App) SetFolderPairMode(id string, mode string) error {
+	syncMode := models.SyncMode(mode)
+	if !syncMode.Valid() {
+		return fmt.Errorf("unknown sync mode: %s", mode)
+	}
+
+	// The pair is copied under the store's lock for the peer
+	var updated models.FolderPair
+	found := false
+	err := a.configStore.Update(func(c *config.Config) {
+		if fp := c.GetFolderPair(id); fp != nil {
+			fp.Mode = syncMode
+			updated = *fp
+			found = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("folder pair not found: %s", id)
+	}
+
+	if a.syncEngine != nil {
+		go func() {
+			if err := a.syncEngine.SendFolderPairSync(updated.PeerID, &updated, "update"); err != nil {
+				log.Printf("Failed to sync folder pair mode to peer: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// GetLocalChanges lists the local edits of a folder pair since its last sync
+func (a *App) GetLocalChanges(id string) ([]*sync.LocalChange, error) {
+	if a.syncEngine == nil {
+		return nil, fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.GetLocalChanges(id)
+}
+
+// RevertLocalChanges discards the local edits of a receive-only folder pair
+func (a *App) RevertLocalChanges(id string) error {
+	if a.syncEngine == nil {
+		return fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.RevertLocalChanges(id)
 }
 
 // RemoveFolderPair removes a folder pair
 func (a *App) RemoveFolderPair(id string) error {
-	return a.configStore.Update(func(c *config.Config) {
+	err := a.configStore.Update(func(c *config.Config) {
 		c.RemoveFolderPair(id)
 	})
+	if err == nil && a.syncEngine != nil {
+		a.syncEngine.RefreshWatchers()
+	}
+	return err
 }
 
 // ============================================
@@ -321,6 +588,23 @@ func (a *App) SyncFolderPair(folderPairID string) error {
 	return a.syncEngine.SyncFolderPair(folderPairID)
 }
 
+// VerifyFolderPair re-reads and re-hashes every file of a folder pair,
+// ignoring cached hashes, and syncs it
+func (a *App) VerifyFolderPair(folderPairID string) error {
+	if a.syncEngine == nil {
+		return fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.VerifyFolderPair(folderPairID)
+}
+
+// CancelScan aborts the directory scans in progress
+func (a *App) CancelScan() {
+	if a.syncEngine == nil {
+		return
+	}
+	a.syncEngine.CancelScan()
+}
+
 // GetSyncStatus returns the current sync status
 func (a *App) GetSyncStatus() map[string]interface{} {
 	if a.syncEngine == nil {
@@ -360,6 +644,52 @@ func (a *App) GetRecentEvents() []*sync.SyncEvent {
 	return a.syncEngine.GetRecentEvents()
 }
 
+// GetTransferQueue returns the transfers under way followed by the queued
+// ones, in the order they will start
+func (a *App) GetTransferQueue() []models.QueuedTransfer {
+	if a.syncEngine == nil {
+		return []models.QueuedTransfer{}
+	}
+	return a.syncEngine.GetTransferQueue()
+}
+
+// ReprioritizeTransfer changes the priority of a queued transfer: 1 for
+// high, 0 for normal and -1 for low
+func (a *App) ReprioritizeTransfer(id string, priority int) error {
+	if priority < int(models.PriorityLow) || priority > int(models.PriorityHigh) {
+		return fmt.Errorf("invalid priority: %d", priority)
+	}
+	if a.syncEngine == nil {
+		return fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.ReprioritizeTransfer(id, models.TransferPriority(priority))
+}
+
+// SkipTransfer moves a queued transfer behind the rest of the queue
+func (a *App) SkipTransfer(id string) error {
+	if a.syncEngine == nil {
+		return fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.SkipTransfer(id)
+}
+
+// CancelTransfer drops a queued transfer or stops one under way; the next
+// sync transfers the file again
+func (a *App) CancelTransfer(id string) error {
+	if a.syncEngine == nil {
+		return fmt.Errorf("sync engine not initialized")
+	}
+	return a.syncEngine.CancelTransfer(id)
+}
+
+// GetConflicts returns the conflict copies kept in all folder pairs
+func (a *App) GetConflicts() []*sync.ConflictInfo {
+	if a.syncEngine == nil {
+		return []*sync.ConflictInfo{}
+	}
+	return a.syncEngine.GetConflicts()
+}
+
 // ============================================
 // Utility Methods
 // ============================================
@@ -3,11 +3,15 @@ module SyncDev
 go 1.25
 
 require (
-	github.com/gobwas/glob v0.2.3
+	github.com/fsnotify/fsevents v0.2.0
+	github.com/fsnotify/fsnotify v1.10.1
 	github.com/google/uuid v1.6.0
 	github.com/hashicorp/mdns v1.0.5
+	github.com/klauspost/compress v1.18.0
 	github.com/wailsapp/wails/v3 v3.0.0-alpha.62
 	github.com/zalando/go-keyring v0.2.6
+	golang.org/x/sys v0.33.0
+	golang.org/x/text v0.23.0
 )
 
 require (
@@ -47,7 +51,5 @@ require (
 	github.com/xanzy/ssh-agent v0.3.3 // indirect
 	golang.org/x/crypto v0.36.0 // indirect
 	golang.org/x/net v0.37.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
 	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
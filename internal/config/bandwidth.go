@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// BandwidthLimit caps transfer rates in KiB/s; 0 means unlimited
+type BandwidthLimit struct {
+	UploadKBps   int `json:"uploadKBps,omitempty"`
+	DownloadKBps int `json:"downloadKBps,omitempty"`
+}
+
+// BandwidthSchedule replaces the limits during a daily time window, for
+// example to lift them after office hours
+type BandwidthSchedule struct {
+	Start  string         `json:"start"`            // "HH:MM", local time
+	End    string         `json:"end"`              // "HH:MM"; before Start for windows past midnight
+	Days   []time.Weekday `json:"days,omitempty"`   // Days the window starts on; every day if empty
+	PeerID string         `json:"peerId,omitempty"` // Peer whose limits are replaced; the global limits if empty
+	Limit  BandwidthLimit `json:"limit"`            // Limits during the window
+}
+
+// parseClock parses an "HH:MM" time of day into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks the window's times of day
+func (s *BandwidthSchedule) Validate() error {
+	if _, err := parseClock(s.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(s.End); err != nil {
+		return err
+	}
+	if s.Limit.UploadKBps < 0 || s.Limit.DownloadKBps < 0 {
+		return fmt.Errorf("bandwidth limits can't be negative")
+	}
+	return nil
+}
+
+// Active reports whether now falls within the window
+func (s *BandwidthSchedule) Active(now time.Time) bool {
+	start, err := parseClock(s.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(s.End)
+	if err != nil {
+		return false
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	startDay := now.Weekday()
+	switch {
+	case start == end:
+		// The whole day
+	case start < end:
+		if minute < start || minute >= end {
+			return false
+		}
+	case minute >= start:
+		// Past midnight windows started today until midnight
+	case minute < end:
+		// ...and the day before after midnight
+		startDay = (startDay + 6) % 7
+	default:
+		return false
+	}
+
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, day := range s.Days {
+		if day == startDay {
+			return true
+		}
+	}
+	return false
+}
+
+// BandwidthLimits returns the global limits and the limits of a peer in
+// effect at now. The first active schedule for each replaces its limits.
+func (c *Config) BandwidthLimits(peerID string, now time.Time) (global, peer BandwidthLimit) {
+	if c.Bandwidth != nil {
+		global = *c.Bandwidth
+	}
+	peer = c.PeerBandwidth[peerID]
+
+	globalScheduled, peerScheduled := false, false
+	for i := range c.BandwidthSchedules {
+		schedule := &c.BandwidthSchedules[i]
+		if !schedule.Active(now) {
+			continue
+		}
+		switch {
+		case schedule.PeerID == "" && !globalScheduled:
+			global = schedule.Limit
+			globalScheduled = true
+		case schedule.PeerID != "" && schedule.PeerID == peerID && !peerScheduled:
+			peer = schedule.Limit
+			peerScheduled = true
+		}
+	}
+	return global, peer
+}
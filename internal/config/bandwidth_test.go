@@ -0,0 +1,71 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBandwidthScheduleActive(t *testing.T) {
+	// Thursday
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2026-10-15 "+clock, time.Local)
+		return t
+	}
+
+	evening := BandwidthSchedule{Start: "19:00", End: "07:00"}
+	tests := []struct {
+		name     string
+		schedule BandwidthSchedule
+		now      time.Time
+		expected bool
+	}{
+		{"before window", evening, at("18:59"), false},
+		{"evening", evening, at("19:00"), true},
+		{"after midnight", evening, at("06:59"), true},
+		{"morning", evening, at("07:00"), false},
+		{"office hours", BandwidthSchedule{Start: "09:00", End: "17:00"}, at("12:00"), true},
+		{"whole day", BandwidthSchedule{Start: "00:00", End: "00:00"}, at("12:00"), true},
+		{"weekday", BandwidthSchedule{Start: "09:00", End: "17:00", Days: []time.Weekday{time.Thursday}}, at("12:00"), true},
+		{"other day", BandwidthSchedule{Start: "09:00", End: "17:00", Days: []time.Weekday{time.Friday}}, at("12:00"), false},
+		// Wednesday's window runs into Thursday morning
+		{"started the day before", BandwidthSchedule{Start: "19:00", End: "07:00", Days: []time.Weekday{time.Wednesday}}, at("03:00"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if active := tt.schedule.Active(tt.now); active != tt.expected {
+				t.Errorf("Expected active %v, got %v", tt.expected, active)
+			}
+		})
+	}
+}
+
+func TestBandwidthLimits(t *testing.T) {
+	cfg := &Config{
+		Bandwidth:     &BandwidthLimit{UploadKBps: 500, DownloadKBps: 1000},
+		PeerBandwidth: map[string]BandwidthLimit{"laptop": {UploadKBps: 100}},
+		BandwidthSchedules: []BandwidthSchedule{
+			{Start: "19:00", End: "07:00"},
+			{Start: "19:00", End: "07:00", PeerID: "laptop", Limit: BandwidthLimit{UploadKBps: 2000}},
+		},
+	}
+
+	day := time.Date(2026, 10, 15, 12, 0, 0, 0, time.Local)
+	global, peer := cfg.BandwidthLimits("laptop", day)
+	if global.UploadKBps != 500 || global.DownloadKBps != 1000 || peer.UploadKBps != 100 {
+		t.Errorf("Expected the configured limits during the day, got %+v and %+v", global, peer)
+	}
+
+	night := time.Date(2026, 10, 15, 22, 0, 0, 0, time.Local)
+	global, peer = cfg.BandwidthLimits("laptop", night)
+	if global != (BandwidthLimit{}) || peer.UploadKBps != 2000 {
+		t.Errorf("Expected the scheduled limits at night, got %+v and %+v", global, peer)
+	}
+	if _, peer = cfg.BandwidthLimits("desktop", night); peer != (BandwidthLimit{}) {
+		t.Errorf("Expected no limits for another peer, got %+v", peer)
+	}
+
+	if err := (&BandwidthSchedule{Start: "7pm", End: "07:00"}).Validate(); err == nil {
+		t.Error("Expected an invalid time of day to fail validation")
+	}
+}
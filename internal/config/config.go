@@ -10,6 +10,10 @@ const (
 	DefaultSyncInterval = 5 * time.Minute
 	ServiceName         = "_syncdev._tcp"
 	AppVersion          = "1.0.0"
+
+	// Default transfer limits per peer
+	DefaultFilesInFlight = 8
+	DefaultChunkWindow   = 16
 )
 
 // Config represents the application configuration
@@ -24,6 +28,11 @@ type Config struct {
 	AutoSync          bool                `json:"autoSync"`
 	StartOnLogin      bool                `json:"startOnLogin"`
 	ShowNotifications bool                `json:"showNotifications"`
+	FilesInFlight     int                 `json:"filesInFlight,omitempty"` // Files transferred at once per peer; 0 uses the default
+	ChunkWindow       int                 `json:"chunkWindow,omitempty"`   // Chunks sent ahead of the receiver's acknowledgements; 0 uses the default
+	Bandwidth         *BandwidthLimit     `json:"bandwidth,omitempty"`     // Limits of all transfers together, nil if unlimited
+	PeerBandwidth     map[string]BandwidthLimit `json:"peerBandwidth,omitempty"` // Limits of the transfers with a peer, by peer ID
+	BandwidthSchedules []BandwidthSchedule `json:"bandwidthSchedules,omitempty"` // Time windows with other limits
 }
 
 // DefaultConfig returns the default configuration
@@ -49,6 +58,19 @@ func DefaultConfig() *Config {
 	}
 }
 
+// TransferLimits returns the files in flight and the chunk window per
+// peer, using the defaults for unset values
+func (c *Config) TransferLimits() (filesInFlight, chunkWindow int) {
+	filesInFlight, chunkWindow = c.FilesInFlight, c.ChunkWindow
+	if filesInFlight <= 0 {
+		filesInFlight = DefaultFilesInFlight
+	}
+	if chunkWindow <= 0 {
+		chunkWindow = DefaultChunkWindow
+	}
+	return filesInFlight, chunkWindow
+}
+
 // GetPeer returns a peer by ID
 func (c *Config) GetPeer(id string) *models.Peer {
 	for _, p := range c.Peers {
@@ -6,21 +6,43 @@ import (
 
 // FileInfo represents metadata about a file in the sync index
 type FileInfo struct {
-	Path       string    `json:"path"`
-	Size       int64     `json:"size"`
-	ModTime    time.Time `json:"modTime"`
-	Hash       string    `json:"hash"`
-	IsDir      bool      `json:"isDir"`
-	Permission uint32    `json:"permission"`
+	Path       string            `json:"path"`
+	Size       int64             `json:"size"`
+	ModTime    time.Time         `json:"modTime"`
+	Hash       string            `json:"hash"`
+	IsDir      bool              `json:"isDir"`
+	Permission uint32            `json:"permission"`
+	Version    VersionVector     `json:"version,omitempty"`
+	Chunks     []FileChunk       `json:"chunks,omitempty"`     // Content-defined chunks, when the pair dedups chunks
+	LinkTarget string            `json:"linkTarget,omitempty"` // Target of a symlink, relative to the link with forward slashes
+	Xattrs     map[string][]byte `json:"xattrs,omitempty"`     // Extended attributes, when the pair syncs them
+	XattrHash  string            `json:"xattrHash,omitempty"`  // Hash of Xattrs, set whenever the pair syncs them
 }
 
-// FileAction represents the type of action to take during sync
+// IsSymlink reports whether the entry is a symlink kept as a link
+func (f *FileInfo) IsSymlink() bool {
+	return f.LinkTarget != ""
+}
+
+// FileChunk is a content-defined chunk of a file. Chunks follow each other,
+// so a chunk's offset is the sum of the sizes before it.
+type FileChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// FileAction represents the type of action to take during sync.
+// A delete action removes the local copy when only LocalFile is set and
+// the remote copy when only RemoteFile is set. A move action renames
+// FromPath like push and pull flow: with only LocalFile set the peer
+// renames its copy, with only RemoteFile set the local copy is renamed.
 type FileAction string
 
 const (
 	FileActionPush   FileAction = "push"
 	FileActionPull   FileAction = "pull"
 	FileActionDelete FileAction = "delete"
+	FileActionMove   FileAction = "move"
 	FileActionSkip   FileAction = "skip"
 )
 
@@ -29,6 +51,8 @@ type SyncAction struct {
 	Action     FileAction `json:"action"`
 	LocalFile  *FileInfo  `json:"localFile,omitempty"`
 	RemoteFile *FileInfo  `json:"remoteFile,omitempty"`
+	FromPath   string     `json:"fromPath,omitempty"` // Previous path of a moved file
+	Conflict   bool       `json:"conflict,omitempty"` // Both sides changed; the losing side keeps a conflict copy
 	Reason     string     `json:"reason"`
 }
 
@@ -41,11 +65,12 @@ type FileIndex struct {
 
 // TransferProgress represents the progress of a file transfer
 type TransferProgress struct {
-	FileName       string  `json:"fileName"`
-	TotalBytes     int64   `json:"totalBytes"`
-	TransferBytes  int64   `json:"transferBytes"`
-	Percentage     float64 `json:"percentage"`
-	BytesPerSecond int64   `json:"bytesPerSecond"`
+	FileName         string  `json:"fileName"`
+	TotalBytes       int64   `json:"totalBytes"`
+	TransferBytes    int64   `json:"transferBytes"`
+	Percentage       float64 `json:"percentage"`
+	BytesPerSecond   int64   `json:"bytesPerSecond"`
+	CompressionRatio float64 `json:"compressionRatio,omitempty"` // File data per byte on the wire
 }
 
 // FolderPair represents a pair of folders to sync between local and remote
@@ -56,5 +81,80 @@ type FolderPair struct {
 	RemotePath   string   `json:"remotePath"`
 	Enabled      bool     `json:"enabled"`
 	Exclusions   []string `json:"exclusions"`
+	Mode         SyncMode `json:"mode,omitempty"`
+	GitIgnore    bool     `json:"gitIgnore,omitempty"` // Also honor the folder's .gitignore files
+	ChunkDedup   bool     `json:"chunkDedup,omitempty"` // Build pulled files from chunks already present locally
+	PinnedPaths  []string `json:"pinnedPaths,omitempty"` // Files and folders transferred before the rest
+	Symlinks     SymlinkPolicy `json:"symlinks,omitempty"` // Whether symlinks are skipped, kept as links or followed
+	Xattrs       XattrSettings `json:"xattrs"`             // Which extended attributes are synced, if any
 	LastSyncTime time.Time `json:"lastSyncTime,omitempty"`
 }
+
+// XattrSettings selects the extended attributes a folder pair syncs. Names
+// are matched against glob patterns such as "user.*".
+type XattrSettings struct {
+	Enabled bool     `json:"enabled"`
+	Allow   []string `json:"allow,omitempty"` // Names that are synced; all if empty
+	Deny    []string `json:"deny,omitempty"`  // Names that are never synced, even if allowed
+}
+
+// SymlinkPolicy controls what happens to the symlinks of a folder pair.
+// Links whose targets lie outside the folder are never synced.
+type SymlinkPolicy string
+
+const (
+	SymlinkSkip     SymlinkPolicy = "skip"     // Links are left out; the default
+	SymlinkPreserve SymlinkPolicy = "preserve" // Links are recreated as links on the peer
+	SymlinkFollow   SymlinkPolicy = "follow"   // Links sync as the files and folders they point to
+)
+
+// Valid reports whether p is a known symlink policy; empty means skip
+func (p SymlinkPolicy) Valid() bool {
+	switch p {
+	case "", SymlinkSkip, SymlinkPreserve, SymlinkFollow:
+		return true
+	}
+	return false
+}
+
+// SyncMode controls which way changes flow for a folder pair, seen from
+// the local side. The peer's copy of the pair uses the complementary mode.
+type SyncMode string
+
+const (
+	SyncModeTwoWay      SyncMode = "two-way"
+	SyncModeSendOnly    SyncMode = "send-only"    // Local changes are sent, incoming changes are refused
+	SyncModeReceiveOnly SyncMode = "receive-only" // Incoming changes are applied, local changes are never sent
+	SyncModeMirror      SyncMode = "mirror"       // The peer's copy is made to match the local folder exactly
+)
+
+// Valid reports whether m is a known sync mode; empty means two-way
+func (m SyncMode) Valid() bool {
+	switch m {
+	case "", SyncModeTwoWay, SyncModeSendOnly, SyncModeReceiveOnly, SyncModeMirror:
+		return true
+	}
+	return false
+}
+
+// CanSend reports whether local changes may be sent to the peer
+func (m SyncMode) CanSend() bool {
+	return m != SyncModeReceiveOnly
+}
+
+// CanReceive reports whether changes from the peer may be applied locally
+func (m SyncMode) CanReceive() bool {
+	return m != SyncModeSendOnly && m != SyncModeMirror
+}
+
+// Complement returns the mode the peer's side of the pair should use
+func (m SyncMode) Complement() SyncMode {
+	switch m {
+	case SyncModeSendOnly, SyncModeMirror:
+		return SyncModeReceiveOnly
+	case SyncModeReceiveOnly:
+		return SyncModeSendOnly
+	default:
+		return SyncModeTwoWay
+	}
+}
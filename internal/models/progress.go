@@ -5,6 +5,7 @@ type AggregateProgress struct {
 	Status           string         `json:"status"`           // "idle", "syncing", "complete"
 	TotalFiles       int            `json:"totalFiles"`
 	CompletedFiles   int            `json:"completedFiles"`
+	FailedFiles      int            `json:"failedFiles"`
 	TotalBytes       int64          `json:"totalBytes"`
 	TransferredBytes int64          `json:"transferredBytes"`
 	Percentage       float64        `json:"percentage"`
@@ -15,9 +16,18 @@ type AggregateProgress struct {
 
 // FileProgress represents progress for a single file
 type FileProgress struct {
-	Path        string  `json:"path"`
-	Size        int64   `json:"size"`
-	Transferred int64   `json:"transferred"`
-	Percentage  float64 `json:"percentage"`
-	Status      string  `json:"status"` // "active", "pending", "complete"
+	Path             string  `json:"path"`
+	Size             int64   `json:"size"`
+	Transferred      int64   `json:"transferred"`
+	Percentage       float64 `json:"percentage"`
+	Status           string  `json:"status"`                     // "active", "pending", "complete"
+	CompressionRatio float64 `json:"compressionRatio,omitempty"` // File data per byte on the wire
+}
+
+// ScanProgress represents progress of a directory scan
+type ScanProgress struct {
+	RootPath string `json:"rootPath"`
+	Files    int    `json:"files"` // Files hashed so far
+	Bytes    int64  `json:"bytes"`
+	Done     bool   `json:"done"`
 }
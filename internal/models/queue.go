@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// TransferPriority orders queued transfers; higher priorities go first
+type TransferPriority int
+
+const (
+	PriorityLow    TransferPriority = -1
+	PriorityNormal TransferPriority = 0
+	PriorityHigh   TransferPriority = 1 // Pinned paths
+)
+
+// QueuedTransfer is a file transfer waiting in the queue or under way
+type QueuedTransfer struct {
+	ID           string           `json:"id"`
+	FolderPairID string           `json:"folderPairId"`
+	Path         string           `json:"path"`
+	PeerName     string           `json:"peerName"`
+	Direction    string           `json:"direction"` // "push" or "pull"
+	Size         int64            `json:"size"`
+	ModTime      time.Time        `json:"modTime"`
+	Priority     TransferPriority `json:"priority"`
+	Skipped      bool             `json:"skipped,omitempty"` // Passed over until the rest of the queue is done
+	Status       string           `json:"status"`            // "queued" or "active"
+	QueuedAt     time.Time        `json:"queuedAt"`
+}
@@ -0,0 +1,71 @@
+package models
+
+// VersionVector counts the changes each device made to a file, keyed by
+// device ID. Comparing vectors orders edits without relying on clocks.
+type VersionVector map[string]uint64
+
+// VersionOrdering is the result of comparing two version vectors
+type VersionOrdering int
+
+const (
+	VersionEqual      VersionOrdering = iota // Same history
+	VersionDominates                         // Includes every change of the other and more
+	VersionDominated                         // The other includes every change of this and more
+	VersionConcurrent                        // Each has changes the other lacks
+)
+
+// Compare orders v relative to other
+func (v VersionVector) Compare(other VersionVector) VersionOrdering {
+	greater, less := false, false
+
+	for device, counter := range v {
+		if counter > other[device] {
+			greater = true
+		} else if counter < other[device] {
+			less = true
+		}
+	}
+	for device, counter := range other {
+		if _, ok := v[device]; !ok && counter > 0 {
+			less = true
+		}
+	}
+
+	switch {
+	case greater && less:
+		return VersionConcurrent
+	case greater:
+		return VersionDominates
+	case less:
+		return VersionDominated
+	default:
+		return VersionEqual
+	}
+}
+
+// Copy returns an independent copy of the vector
+func (v VersionVector) Copy() VersionVector {
+	c := make(VersionVector, len(v)+1)
+	for device, counter := range v {
+		c[device] = counter
+	}
+	return c
+}
+
+// Bump returns a copy of the vector with deviceID's counter incremented
+func (v VersionVector) Bump(deviceID string) VersionVector {
+	c := v.Copy()
+	c[deviceID]++
+	return c
+}
+
+// Merge returns a vector that dominates or equals both v and other
+func (v VersionVector) Merge(other VersionVector) VersionVector {
+	c := v.Copy()
+	for device, counter := range other {
+		if counter > c[device] {
+			c[device] = counter
+		}
+	}
+	return c
+}
@@ -2,7 +2,6 @@ package network
 
 import (
 	"SyncDev/internal/config"
-	"bufio"
 	"context"
 	"fmt"
 	"log"
@@ -42,17 +41,15 @@ func (c *Client) ConnectWithContext(ctx context.Context, host string, port int)
 		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
 	}
 
-	peerConn := &PeerConnection{
-		Conn:   conn,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
-	}
+	peerConn := NewPeerConnection(conn)
 
 	// Send Hello message
 	hello := &HelloPayload{
-		DeviceID:   c.deviceID,
-		DeviceName: c.deviceName,
-		Version:    config.AppVersion,
+		DeviceID:    c.deviceID,
+		DeviceName:  c.deviceName,
+		Version:     config.AppVersion,
+		Protocol:    ProtocolVersion,
+		Compression: SupportedCompression,
 	}
 
 	msg, err := NewMessage(MsgTypeHello, hello)
@@ -70,6 +67,23 @@ func (c *Client) ConnectWithContext(ctx context.Context, host string, port int)
 	return peerConn, nil
 }
 
+// SendHello answers the hello of a peer that connected to us, telling it
+// the codecs we can decode
+func (c *Client) SendHello(peerConn *PeerConnection) error {
+	msg, err := NewMessage(MsgTypeHello, &HelloPayload{
+		DeviceID:    c.deviceID,
+		DeviceName:  c.deviceName,
+		Version:     config.AppVersion,
+		Protocol:    ProtocolVersion,
+		Compression: SupportedCompression,
+	})
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
+}
+
 // SendPairingRequest sends a pairing request to a peer
 func (c *Client) SendPairingRequest(peerConn *PeerConnection, code string) error {
 	payload := &PairingRequestPayload{
@@ -83,7 +97,7 @@ func (c *Client) SendPairingRequest(peerConn *PeerConnection, code string) error
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendPairingResponse sends a pairing response
@@ -99,7 +113,7 @@ func (c *Client) SendPairingResponse(peerConn *PeerConnection, accepted bool, sh
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendSyncRequest sends a sync request for a folder pair
@@ -115,7 +129,7 @@ func (c *Client) SendSyncRequest(peerConn *PeerConnection, folderPairID, localPa
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendIndexExchange sends a file index to the peer
@@ -125,7 +139,17 @@ func (c *Client) SendIndexExchange(peerConn *PeerConnection, payload *IndexExcha
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
+}
+
+// SendIndexAck sends the agreed base index back to the peer that started a sync
+func (c *Client) SendIndexAck(peerConn *PeerConnection, payload *IndexExchangePayload) error {
+	msg, err := NewMessage(MsgTypeIndexAck, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
 }
 
 // SendFileRequest requests a file from the peer
@@ -141,12 +165,59 @@ func (c *Client) SendFileRequest(peerConn *PeerConnection, folderPairID, filePat
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
+}
+
+// SendDeltaRequest requests a file as a delta against the signatures of
+// our copy, taken in blocks of blockSize
+func (c *Client) SendDeltaRequest(peerConn *PeerConnection, folderPairID, filePath string, blockSize int, blocks []BlockSignature) error {
+	payload := &FileRequestPayload{
+		FolderPairID: folderPairID,
+		FilePath:     filePath,
+		BlockSize:    blockSize,
+	}
+
+	msg, err := NewMessage(MsgTypeFileRequest, payload)
+	if err != nil {
+		return err
+	}
+	msg.Data = EncodeSignatures(blocks)
+
+	return peerConn.QueueMessage(msg)
+}
+
+// SendRangeRequest requests the given ranges of the version of a file with
+// the given hash; the rest of the file is already at hand
+func (c *Client) SendRangeRequest(peerConn *PeerConnection, folderPairID, filePath, hash string, ranges []ByteRange) error {
+	payload := &FileRequestPayload{
+		FolderPairID: folderPairID,
+		FilePath:     filePath,
+		Ranges:       ranges,
+		Hash:         hash,
+	}
+
+	msg, err := NewMessage(MsgTypeFileRequest, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
+}
+
+// SendFileOffer offers a file to the peer, which requests it with a
+// file_request
+func (c *Client) SendFileOffer(peerConn *PeerConnection, payload *FileResponsePayload) error {
+	msg, err := NewMessage(MsgTypeFileOffer, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
 }
 
 // SendFileChunk sends a file chunk to the peer
 func (c *Client) SendFileChunk(peerConn *PeerConnection, payload *FileChunkPayload) error {
-	msg, err := NewMessage(MsgTypeFileChunk, payload)
+	msg, err := NewChunkMessage(payload)
 	if err != nil {
 		return err
 	}
@@ -154,21 +225,27 @@ func (c *Client) SendFileChunk(peerConn *PeerConnection, payload *FileChunkPaylo
 	return peerConn.WriteMessage(msg)
 }
 
-// SendFileComplete signals file transfer completion
-func (c *Client) SendFileComplete(peerConn *PeerConnection, folderPairID, filePath string, success bool, errMsg string) error {
-	payload := &FileCompletePayload{
+// SendChunkAck acknowledges a chunk of a file
+func (c *Client) SendChunkAck(peerConn *PeerConnection, folderPairID, filePath string) error {
+	msg, err := NewMessage(MsgTypeChunkAck, &ChunkAckPayload{
 		FolderPairID: folderPairID,
 		FilePath:     filePath,
-		Success:      success,
-		Error:        errMsg,
+	})
+	if err != nil {
+		return err
 	}
 
+	return peerConn.QueueMessage(msg)
+}
+
+// SendFileComplete signals file transfer completion
+func (c *Client) SendFileComplete(peerConn *PeerConnection, payload *FileCompletePayload) error {
 	msg, err := NewMessage(MsgTypeFileComplete, payload)
 	if err != nil {
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendDeleteFile requests deletion of a file
@@ -183,7 +260,38 @@ func (c *Client) SendDeleteFile(peerConn *PeerConnection, folderPairID, filePath
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
+}
+
+// SendMoveFile asks the peer to rename a file
+func (c *Client) SendMoveFile(peerConn *PeerConnection, payload *MoveFilePayload) error {
+	msg, err := NewMessage(MsgTypeMoveFile, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
+}
+
+// SendSymlink asks the peer to create a symlink
+func (c *Client) SendSymlink(peerConn *PeerConnection, payload *SymlinkPayload) error {
+	msg, err := NewMessage(MsgTypeSymlink, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
+}
+
+// SendDirectory asks the peer to create a directory or update its
+// permissions
+func (c *Client) SendDirectory(peerConn *PeerConnection, payload *DirectoryPayload) error {
+	msg, err := NewMessage(MsgTypeDirectory, payload)
+	if err != nil {
+		return err
+	}
+
+	return peerConn.QueueMessage(msg)
 }
 
 // SendPing sends a ping message
@@ -193,7 +301,7 @@ func (c *Client) SendPing(peerConn *PeerConnection) error {
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendPong sends a pong response
@@ -203,7 +311,7 @@ func (c *Client) SendPong(peerConn *PeerConnection) error {
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
 
 // SendError sends an error message
@@ -218,5 +326,5 @@ func (c *Client) SendError(peerConn *PeerConnection, code, message string) error
 		return err
 	}
 
-	return peerConn.WriteMessage(msg)
+	return peerConn.QueueMessage(msg)
 }
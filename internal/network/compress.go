@@ -0,0 +1,63 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionZstd is the zstd codec for the data of file_chunk and
+// file_delta messages
+const CompressionZstd = "zstd"
+
+// SupportedCompression lists the codecs this version can decode, in order
+// of preference. Peers advertise them in their hello.
+var SupportedCompression = []string{CompressionZstd}
+
+var (
+	// The encoder and decoder are safe for concurrent EncodeAll and
+	// DecodeAll calls, so one of each serves every connection
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxMessageSize), zstd.WithDecoderConcurrency(0))
+)
+
+// NegotiateCompression picks the codec to send with to a peer that
+// advertised offered, or "" if there is none in common
+func NegotiateCompression(offered []string) string {
+	for _, codec := range SupportedCompression {
+		for _, o := range offered {
+			if o == codec {
+				return codec
+			}
+		}
+	}
+	return ""
+}
+
+// Compress compresses data with codec
+func Compress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data))), nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", codec)
+}
+
+// Decompress restores data compressed with codec. Data that isn't
+// compressed, with an empty codec, is returned as is.
+func Decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "":
+		return data, nil
+	case CompressionZstd:
+		out, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		if len(out) > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", codec)
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	if codec := NegotiateCompression([]string{"lz4", CompressionZstd}); codec != CompressionZstd {
+		t.Errorf("Expected zstd, got %q", codec)
+	}
+	if codec := NegotiateCompression(nil); codec != "" {
+		t.Errorf("Expected no compression with an older peer, got %q", codec)
+	}
+}
+
+func TestCompressedChunkRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &PeerConnection{SharedSecret: "secret", writer: bufio.NewWriter(&buf)}
+	reader := &PeerConnection{SharedSecret: "secret", reader: bufio.NewReader(&buf)}
+
+	data := bytes.Repeat([]byte("INFO request handled in 3ms\n"), 4096)
+	compressed, err := Compress(CompressionZstd, data)
+	if err != nil {
+		t.Fatalf("Compress failed: %v", err)
+	}
+	if len(compressed) >= len(data)/3 {
+		t.Errorf("Expected repetitive data to compress, got %d of %d bytes", len(compressed), len(data))
+	}
+
+	chunk, _ := NewChunkMessage(&FileChunkPayload{FilePath: "app.log", Data: compressed, Compression: CompressionZstd})
+	if err := writer.WriteMessage(chunk); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	payload, err := msg.ParseChunk()
+	if err != nil {
+		t.Fatalf("ParseChunk failed: %v", err)
+	}
+	if !bytes.Equal(payload.Data, data) {
+		t.Error("Expected the chunk to be decompressed")
+	}
+
+	if _, err := Decompress(CompressionZstd, []byte("not zstd")); err == nil {
+		t.Error("Expected corrupt data to fail")
+	}
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BlockSignature identifies a block of the receiver's copy of a file in a
+// delta transfer
+type BlockSignature struct {
+	Weak   uint32   // Rolling checksum
+	Strong [16]byte // Truncated SHA-256
+}
+
+// blockSignatureSize is the encoded size of a BlockSignature
+const blockSignatureSize = 20
+
+// DeltaOp is one instruction to rebuild a file from the receiver's copy:
+// either copy Count blocks starting at Block, or insert Data
+type DeltaOp struct {
+	Block uint32
+	Count uint32
+	Data  []byte
+}
+
+// Delta op tags
+const (
+	deltaOpCopy    byte = 1
+	deltaOpLiteral byte = 2
+)
+
+// EncodeSignatures encodes block signatures for the raw data of a
+// file_request
+func EncodeSignatures(blocks []BlockSignature) []byte {
+	data := make([]byte, 0, len(blocks)*blockSignatureSize)
+	for _, block := range blocks {
+		data = binary.BigEndian.AppendUint32(data, block.Weak)
+		data = append(data, block.Strong[:]...)
+	}
+	return data
+}
+
+// DecodeSignatures decodes block signatures encoded by EncodeSignatures
+func DecodeSignatures(data []byte) ([]BlockSignature, error) {
+	if len(data)%blockSignatureSize != 0 {
+		return nil, fmt.Errorf("invalid signature data length: %d", len(data))
+	}
+
+	blocks := make([]BlockSignature, len(data)/blockSignatureSize)
+	for i := range blocks {
+		b := data[i*blockSignatureSize:]
+		blocks[i].Weak = binary.BigEndian.Uint32(b)
+		copy(blocks[i].Strong[:], b[4:blockSignatureSize])
+	}
+	return blocks, nil
+}
+
+// EncodeDeltaOps encodes delta ops for the raw data of a file_delta
+func EncodeDeltaOps(ops []DeltaOp) []byte {
+	size := 0
+	for _, op := range ops {
+		size += 9 + len(op.Data)
+	}
+
+	data := make([]byte, 0, size)
+	for _, op := range ops {
+		if op.Data != nil {
+			data = append(data, deltaOpLiteral)
+			data = binary.BigEndian.AppendUint32(data, uint32(len(op.Data)))
+			data = append(data, op.Data...)
+			continue
+		}
+		data = append(data, deltaOpCopy)
+		data = binary.BigEndian.AppendUint32(data, op.Block)
+		data = binary.BigEndian.AppendUint32(data, op.Count)
+	}
+	return data
+}
+
+// DecodeDeltaOps decodes delta ops encoded by EncodeDeltaOps. Literal data
+// refers to data rather than being copied.
+func DecodeDeltaOps(data []byte) ([]DeltaOp, error) {
+	var ops []DeltaOp
+	for len(data) > 0 {
+		if len(data) < 5 {
+			return nil, fmt.Errorf("truncated delta op")
+		}
+		tag := data[0]
+		switch tag {
+		case deltaOpCopy:
+			if len(data) < 9 {
+				return nil, fmt.Errorf("truncated delta op")
+			}
+			ops = append(ops, DeltaOp{
+				Block: binary.BigEndian.Uint32(data[1:5]),
+				Count: binary.BigEndian.Uint32(data[5:9]),
+			})
+			data = data[9:]
+		case deltaOpLiteral:
+			n := int(binary.BigEndian.Uint32(data[1:5]))
+			if len(data)-5 < n {
+				return nil, fmt.Errorf("truncated delta literal")
+			}
+			ops = append(ops, DeltaOp{Data: data[5 : 5+n]})
+			data = data[5+n:]
+		default:
+			return nil, fmt.Errorf("unknown delta op: %d", tag)
+		}
+	}
+	return ops, nil
+}
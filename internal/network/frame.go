@@ -0,0 +1,101 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message travels in a frame with a fixed size header:
+//
+//	type        uint8   frameMessage, or frameData when raw data follows
+//	length      uint32  length of the JSON encoded message
+//	dataLength  uint32  length of the raw data that follows the message
+//
+// Integers are big-endian. File contents travel as raw data so they are
+// neither base64 encoded nor copied through the JSON encoder.
+const (
+	frameMessage byte = 1
+	frameData    byte = 2
+
+	frameHeaderSize = 9
+)
+
+// MaxMessageSize is the largest frame, message and raw data together, that
+// is accepted from a peer
+const MaxMessageSize = 64 * 1024 * 1024
+
+// ErrMessageTooLarge is returned when a peer announces a frame larger than
+// MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
+// encodeFrame returns the header and JSON encoding of a message, which
+// its raw data follows on the wire
+func encodeFrame(msg *Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %w", err)
+	}
+	if int64(len(data))+int64(len(msg.Data)) > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(data))
+	frame[0] = frameMessage
+	if len(msg.Data) > 0 {
+		frame[0] = frameData
+	}
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(msg.Data)))
+	return append(frame, data...), nil
+}
+
+// writeFrame writes an encoded message and its raw data as one frame
+func writeFrame(w *bufio.Writer, frame, data []byte) error {
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return w.Flush()
+}
+
+// readFrame reads one frame, refusing frames larger than MaxMessageSize
+// before allocating anything for them
+func readFrame(r io.Reader) (*Message, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	frameType := header[0]
+	length := int64(binary.BigEndian.Uint32(header[1:5]))
+	dataLength := int64(binary.BigEndian.Uint32(header[5:9]))
+	if frameType != frameMessage && frameType != frameData {
+		return nil, fmt.Errorf("unsupported frame type: %d", frameType)
+	}
+	if frameType == frameMessage && dataLength != 0 {
+		return nil, fmt.Errorf("unexpected data in message frame")
+	}
+	if length+dataLength > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	buf := make([]byte, length+dataLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := json.Unmarshal(buf[:length], &msg); err != nil {
+		return nil, fmt.Errorf("failed to parse message: %w", err)
+	}
+	if dataLength > 0 {
+		msg.Data = buf[length:]
+	}
+	return &msg, nil
+}
@@ -0,0 +1,83 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &PeerConnection{SharedSecret: "secret", writer: bufio.NewWriter(&buf)}
+	reader := &PeerConnection{SharedSecret: "secret", reader: bufio.NewReader(&buf)}
+
+	data := []byte{0, 1, 2, '\n', 255}
+	chunk, err := NewChunkMessage(&FileChunkPayload{FolderPairID: "fp", FilePath: "a.bin", Offset: 42, Data: data, IsLast: true})
+	if err != nil {
+		t.Fatalf("NewChunkMessage failed: %v", err)
+	}
+	ping, _ := NewMessage(MsgTypePing, nil)
+	if err := writer.WriteMessage(chunk); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	if err := writer.WriteMessage(ping); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	msg, err := reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	payload, err := msg.ParseChunk()
+	if err != nil {
+		t.Fatalf("ParseChunk failed: %v", err)
+	}
+	if payload.FilePath != "a.bin" || payload.Offset != 42 || !payload.IsLast || !bytes.Equal(payload.Data, data) {
+		t.Errorf("Expected chunk to round trip, got %+v", payload)
+	}
+
+	msg, err = reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage failed: %v", err)
+	}
+	if msg.Type != MsgTypePing || msg.Data != nil {
+		t.Errorf("Expected a ping without data, got %s", msg.Type)
+	}
+}
+
+func TestFrameTamperedData(t *testing.T) {
+	var buf bytes.Buffer
+	writer := &PeerConnection{SharedSecret: "secret", writer: bufio.NewWriter(&buf)}
+	chunk, _ := NewChunkMessage(&FileChunkPayload{FilePath: "a.bin", Data: []byte("hello")})
+	if err := writer.WriteMessage(chunk); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	frame := buf.Bytes()
+	frame[len(frame)-1] ^= 0xff
+
+	reader := &PeerConnection{SharedSecret: "secret", reader: bufio.NewReader(bytes.NewReader(frame))}
+	if _, err := reader.ReadMessage(); err == nil {
+		t.Error("Expected tampered chunk data to fail HMAC verification")
+	}
+}
+
+func TestFrameSizeCap(t *testing.T) {
+	var header [frameHeaderSize]byte
+	header[0] = frameData
+	binary.BigEndian.PutUint32(header[1:5], 100)
+	binary.BigEndian.PutUint32(header[5:9], MaxMessageSize)
+
+	reader := &PeerConnection{reader: bufio.NewReader(bytes.NewReader(header[:]))}
+	if _, err := reader.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected ErrMessageTooLarge, got %v", err)
+	}
+
+	header[0] = '{'
+	reader = &PeerConnection{reader: bufio.NewReader(bytes.NewReader(header[:]))}
+	if _, err := reader.ReadMessage(); err == nil {
+		t.Error("Expected an unknown frame type to be refused")
+	}
+}
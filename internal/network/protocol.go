@@ -3,6 +3,7 @@ package network
 import (
 	"SyncDev/internal/models"
 	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -24,11 +25,17 @@ const (
 
 	// File transfer messages
 	MsgTypeFileRequest   MessageType = "file_request"
+	MsgTypeFileOffer     MessageType = "file_offer"
 	MsgTypeFileResponse  MessageType = "file_response"
 	MsgTypeFileChunk     MessageType = "file_chunk"
+	MsgTypeFileDelta     MessageType = "file_delta"
+	MsgTypeChunkAck      MessageType = "chunk_ack"
 	MsgTypeFileComplete  MessageType = "file_complete"
 	MsgTypeDeleteFile    MessageType = "delete_file"
 	MsgTypeDeleteAck     MessageType = "delete_ack"
+	MsgTypeMoveFile      MessageType = "move_file"
+	MsgTypeSymlink       MessageType = "symlink"
+	MsgTypeDirectory     MessageType = "directory"
 
 	// Status messages
 	MsgTypePing          MessageType = "ping"
@@ -42,8 +49,9 @@ const (
 const (
 	// ChunkSize is the size of each file chunk (1MB)
 	ChunkSize = 1024 * 1024
-	// ProtocolVersion is the current protocol version
-	ProtocolVersion = "1.0"
+	// ProtocolVersion is the current protocol version. Version 2 replaced
+	// newline-delimited JSON with binary frames.
+	ProtocolVersion = "2.0"
 )
 
 // Message is the base structure for all protocol messages
@@ -52,13 +60,24 @@ type Message struct {
 	Timestamp int64           `json:"timestamp"`
 	Payload   json.RawMessage `json:"payload,omitempty"`
 	HMAC      string          `json:"hmac,omitempty"`
+	Data      []byte          `json:"-"` // Raw bytes sent after the message in its frame
 }
 
 // HelloPayload is sent when establishing a connection
 type HelloPayload struct {
-	DeviceID   string `json:"deviceId"`
-	DeviceName string `json:"deviceName"`
-	Version    string `json:"version"`
+	DeviceID    string   `json:"deviceId"`
+	DeviceName  string   `json:"deviceName"`
+	Version     string   `json:"version"`
+	Protocol    string   `json:"protocol,omitempty"`    // ProtocolVersion of the sender
+	Compression []string `json:"compression,omitempty"` // Codecs the sender can decode
+}
+
+// CompatibleProtocol reports whether a peer speaking the given protocol
+// version understands ours: the major versions must match
+func CompatibleProtocol(version string) bool {
+	major, _, _ := strings.Cut(version, ".")
+	ours, _, _ := strings.Cut(ProtocolVersion, ".")
+	return major == ours
 }
 
 // PairingRequestPayload is sent to initiate pairing
@@ -89,26 +108,57 @@ type SyncResponsePayload struct {
 	Error        string `json:"error,omitempty"`
 }
 
-// IndexExchangePayload contains the file index for a folder
+// IndexExchangePayload contains the file index for a folder.
+// It is also used by index_ack to share the agreed base index.
 type IndexExchangePayload struct {
 	FolderPairID string                      `json:"folderPairId"`
 	Index        map[string]*models.FileInfo `json:"index"`
+	Conflicts    []string                    `json:"conflicts,omitempty"` // Paths the receiver must keep as conflict copies
+	Paths        []string                    `json:"paths,omitempty"`     // Limits the comparison to these paths and their contents
+	Mode         models.SyncMode             `json:"mode,omitempty"`      // Sync mode of the sender's side of the pair
+	Ignore       []string                    `json:"ignore,omitempty"`    // Exclusion patterns of the sender's side
+	GitIgnore    bool                        `json:"gitIgnore,omitempty"` // Whether the sender honors .gitignore files
+	Symlinks     models.SymlinkPolicy        `json:"symlinks,omitempty"`  // Symlink policy of the sender's side
+	Xattrs       *models.XattrSettings       `json:"xattrs,omitempty"`    // Extended attributes the sender syncs, if any
 }
 
-// FileRequestPayload requests a file from the remote peer
+// FileRequestPayload requests a file from the remote peer. With a block
+// size, the message's Data holds the signatures of the requester's copy
+// and the file is sent as a delta against it. With ranges, only those
+// parts of the file are sent; the requester has the rest.
 type FileRequestPayload struct {
-	FolderPairID string `json:"folderPairId"`
-	FilePath     string `json:"filePath"`
-	Offset       int64  `json:"offset"`
+	FolderPairID string      `json:"folderPairId"`
+	FilePath     string      `json:"filePath"`
+	Offset       int64       `json:"offset"`
+	BlockSize    int         `json:"blockSize,omitempty"`
+	Ranges       []ByteRange `json:"ranges,omitempty"`
+	Hash         string      `json:"hash,omitempty"` // Version of the file the ranges belong to
+}
+
+// ByteRange is a part of a file
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
 }
 
-// FileResponsePayload provides metadata about a requested file
+// FileResponsePayload provides metadata about a file; it precedes the
+// chunks of every transfer. A file_offer uses it to announce a large file
+// so the receiver can request it from where an earlier download stopped.
 type FileResponsePayload struct {
-	FolderPairID string `json:"folderPairId"`
-	FilePath     string `json:"filePath"`
-	Size         int64  `json:"size"`
-	Hash         string `json:"hash"`
-	Error        string `json:"error,omitempty"`
+	FolderPairID string               `json:"folderPairId"`
+	FilePath     string               `json:"filePath"`
+	Size         int64                `json:"size"`
+	Hash         string               `json:"hash"`
+	Version      models.VersionVector `json:"version,omitempty"`
+	ModTime      time.Time            `json:"modTime,omitempty"`
+	Permission   uint32               `json:"permission,omitempty"`
+	Offset       int64                `json:"offset,omitempty"`    // Where the chunks start when resuming
+	BlockSize    int                  `json:"blockSize,omitempty"` // Set when the file follows as file_delta messages
+	Ranges       bool                 `json:"ranges,omitempty"`    // Set when only the requested ranges follow
+	Chunks       []models.FileChunk   `json:"chunks,omitempty"`    // Content-defined chunks of an offered file
+	Xattrs       map[string][]byte    `json:"xattrs,omitempty"`    // Extended attributes the sender syncs
+	Holes        []ByteRange          `json:"holes,omitempty"`     // Ranges left out of the chunks that read as zeros
+	Error        string               `json:"error,omitempty"`
 }
 
 // FileChunkPayload contains a chunk of file data
@@ -116,16 +166,36 @@ type FileChunkPayload struct {
 	FolderPairID string `json:"folderPairId"`
 	FilePath     string `json:"filePath"`
 	Offset       int64  `json:"offset"`
-	Data         []byte `json:"data"`
+	Data         []byte `json:"-"` // Sent raw as the message's Data
 	IsLast       bool   `json:"isLast"`
+	Compression  string `json:"compression,omitempty"` // Codec the Data is compressed with
 }
 
-// FileCompletePayload signals that a file transfer is complete
-type FileCompletePayload struct {
+// ChunkAckPayload acknowledges a file_chunk or file_delta message, which
+// lets the sender send another within its window
+type ChunkAckPayload struct {
 	FolderPairID string `json:"folderPairId"`
 	FilePath     string `json:"filePath"`
-	Success      bool   `json:"success"`
-	Error        string `json:"error,omitempty"`
+}
+
+// FileDeltaPayload carries instructions to rebuild a file from the
+// receiver's copy, encoded in the message's Data
+type FileDeltaPayload struct {
+	FolderPairID string `json:"folderPairId"`
+	FilePath     string `json:"filePath"`
+	IsLast       bool   `json:"isLast"`
+	Compression  string `json:"compression,omitempty"` // Codec the Data is compressed with
+}
+
+// FileCompletePayload reports the outcome of a file transfer to the sender
+type FileCompletePayload struct {
+	FolderPairID string               `json:"folderPairId"`
+	FilePath     string               `json:"filePath"`
+	Hash         string               `json:"hash,omitempty"`    // Hash of the file as written by the receiver
+	Version      models.VersionVector `json:"version,omitempty"` // Version the receiver recorded
+	Success      bool                 `json:"success"`
+	Error        string               `json:"error,omitempty"`
+	Quarantined  bool                 `json:"quarantined,omitempty"` // The data didn't verify and was set aside
 }
 
 // DeleteFilePayload requests deletion of a file
@@ -134,6 +204,33 @@ type DeleteFilePayload struct {
 	FilePath     string `json:"filePath"`
 }
 
+// MoveFilePayload asks the peer to rename a file it already has instead of
+// receiving the content again
+type MoveFilePayload struct {
+	FolderPairID string               `json:"folderPairId"`
+	FromPath     string               `json:"fromPath"`
+	ToPath       string               `json:"toPath"`
+	Hash         string               `json:"hash"`
+	Version      models.VersionVector `json:"version,omitempty"`
+}
+
+// SymlinkPayload asks the peer to create a symlink, which carries no data
+type SymlinkPayload struct {
+	FolderPairID string               `json:"folderPairId"`
+	FilePath     string               `json:"filePath"`
+	Target       string               `json:"target"` // Relative to the link, with forward slashes
+	Version      models.VersionVector `json:"version,omitempty"`
+}
+
+// DirectoryPayload asks the peer to create a directory, or to give its
+// directory the sender's permissions
+type DirectoryPayload struct {
+	FolderPairID string               `json:"folderPairId"`
+	FilePath     string               `json:"filePath"`
+	Permission   uint32               `json:"permission,omitempty"`
+	Version      models.VersionVector `json:"version,omitempty"`
+}
+
 // ErrorPayload contains error information
 type ErrorPayload struct {
 	Code    string `json:"code"`
@@ -142,10 +239,11 @@ type ErrorPayload struct {
 
 // FolderPairSyncPayload shares a folder pair configuration with the peer
 type FolderPairSyncPayload struct {
-	FolderPairID string `json:"folderPairId"`
-	LocalPath    string `json:"localPath"`  // Path on the sender's machine
-	RemotePath   string `json:"remotePath"` // Path on the receiver's machine
-	Action       string `json:"action"`     // "add" or "remove"
+	FolderPairID string          `json:"folderPairId"`
+	LocalPath    string          `json:"localPath"`      // Path on the sender's machine
+	RemotePath   string          `json:"remotePath"`     // Path on the receiver's machine
+	Action       string          `json:"action"`         // "add", "update" or "remove"
+	Mode         models.SyncMode `json:"mode,omitempty"` // Mode for the receiver's side of the pair
 }
 
 // NewMessage creates a new protocol message
@@ -166,6 +264,32 @@ func NewMessage(msgType MessageType, payload interface{}) (*Message, error) {
 	}, nil
 }
 
+// NewChunkMessage creates a file_chunk message whose data travels as raw
+// bytes after the JSON encoded metadata
+func NewChunkMessage(payload *FileChunkPayload) (*Message, error) {
+	msg, err := NewMessage(MsgTypeFileChunk, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Data = payload.Data
+	return msg, nil
+}
+
+// ParseChunk parses a file_chunk message along with its raw data, which
+// is decompressed if the sender compressed it
+func (m *Message) ParseChunk() (*FileChunkPayload, error) {
+	var payload FileChunkPayload
+	if err := m.ParsePayload(&payload); err != nil {
+		return nil, err
+	}
+	data, err := Decompress(payload.Compression, m.Data)
+	if err != nil {
+		return nil, err
+	}
+	payload.Data = data
+	return &payload, nil
+}
+
 // ParsePayload parses the payload into the given type
 func (m *Message) ParsePayload(v interface{}) error {
 	if m.Payload == nil {
@@ -0,0 +1,17 @@
+package network
+
+import "testing"
+
+func TestCompatibleProtocol(t *testing.T) {
+	for version, expected := range map[string]bool{
+		ProtocolVersion: true,
+		"2.1":           true,
+		"1.0":           false,
+		"3.0":           false,
+		"":              false, // Peers from before the version was sent
+	} {
+		if got := CompatibleProtocol(version); got != expected {
+			t.Errorf("Expected CompatibleProtocol(%q) to be %v, got %v", version, expected, got)
+		}
+	}
+}
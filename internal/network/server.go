@@ -8,11 +8,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,9 +44,31 @@ type PeerConnection struct {
 	Paired       bool
 	reader       *bufio.Reader
 	writer       *bufio.Writer
-	writeMu      sync.Mutex
+	compression  atomic.Value // Codec negotiated for data sent to the peer
+
+	// Frames wait in a queue for the connection's writer, so reading the
+	// connection never waits for a write the peer doesn't read
+	initOnce  sync.Once
+	startOnce sync.Once
+	closeOnce sync.Once
+	outgoing  []*outgoingFrame // Guarded by queueMu
+	writeErr  error            // Why the writer stopped, guarded by queueMu
+	queueMu   sync.Mutex
+	wake      chan struct{}
+	closing   chan struct{}
 }
 
+// outgoingFrame is an encoded message waiting for the connection's writer
+type outgoingFrame struct {
+	frame []byte
+	data  []byte
+	done  chan error // Receives the outcome, nil if nobody waits for it
+}
+
+// errConnectionClosed fails the messages still queued when a connection
+// is closed
+var errConnectionClosed = errors.New("connection closed")
+
 // NewServer creates a new TCP server
 func NewServer(port int) *Server {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -110,11 +133,7 @@ func (s *Server) acceptLoop() {
 
 // handleConnection handles a new incoming connection
 func (s *Server) handleConnection(conn net.Conn) {
-	peerConn := &PeerConnection{
-		Conn:   conn,
-		reader: bufio.NewReader(conn),
-		writer: bufio.NewWriter(conn),
-	}
+	peerConn := NewPeerConnection(conn)
 
 	// Wait for Hello message to identify peer
 	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
@@ -138,9 +157,15 @@ func (s *Server) handleConnection(conn net.Conn) {
 		conn.Close()
 		return
 	}
+	if !CompatibleProtocol(hello.Protocol) {
+		log.Printf("TCP Server: %s speaks protocol %q, expected %s", hello.DeviceName, hello.Protocol, ProtocolVersion)
+		conn.Close()
+		return
+	}
 
 	peerConn.PeerID = hello.DeviceID
 	peerConn.PeerName = hello.DeviceName
+	peerConn.SetCompression(NegotiateCompression(hello.Compression))
 
 	// Store connection
 	s.mu.Lock()
@@ -204,64 +229,172 @@ func (s *Server) AddConnection(peerConn *PeerConnection) {
 	s.connections[peerConn.PeerID] = peerConn
 }
 
-// ReadMessage reads a message from the connection
+// NewPeerConnection wraps an established connection to a peer
+func NewPeerConnection(conn net.Conn) *PeerConnection {
+	return &PeerConnection{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+}
+
+// ReadMessage reads a message from the connection. Messages larger than
+// MaxMessageSize fail with ErrMessageTooLarge.
 func (pc *PeerConnection) ReadMessage() (*Message, error) {
-	line, err := pc.reader.ReadBytes('\n')
+	msg, err := readFrame(pc.reader)
 	if err != nil {
 		return nil, err
 	}
 
-	var msg Message
-	if err := json.Unmarshal(line, &msg); err != nil {
-		return nil, fmt.Errorf("failed to parse message: %w", err)
-	}
-
 	// Verify HMAC if we have a shared secret
 	if pc.SharedSecret != "" && msg.HMAC != "" {
-		if !pc.VerifyHMAC(&msg) {
+		if !pc.VerifyHMAC(msg) {
 			return nil, fmt.Errorf("HMAC verification failed")
 		}
 	}
 
-	return &msg, nil
+	return msg, nil
 }
 
-// WriteMessage writes a message to the connection
+// WriteMessage writes a message to the connection after the messages
+// queued before it, and waits until it is written
 func (pc *PeerConnection) WriteMessage(msg *Message) error {
-	pc.writeMu.Lock()
-	defer pc.writeMu.Unlock()
+	done := make(chan error, 1)
+	if err := pc.enqueue(msg, done); err != nil {
+		return err
+	}
+	return <-done
+}
 
+// QueueMessage queues a message to be written after the messages queued
+// before it, without waiting for the peer to take it. Replies sent while
+// reading the connection are queued, so the read loop keeps draining the
+// peer's data while our own writes are stalled. Only errors encoding the
+// message, or of earlier writes, are returned.
+func (pc *PeerConnection) QueueMessage(msg *Message) error {
+	return pc.enqueue(msg, nil)
+}
+
+// enqueue signs and encodes a message and hands it to the writer, which
+// reports the outcome on done if it isn't nil
+func (pc *PeerConnection) enqueue(msg *Message, done chan error) error {
 	// Sign message if we have a shared secret
 	if pc.SharedSecret != "" {
 		msg.HMAC = pc.ComputeHMAC(msg)
 	}
-
-	data, err := json.Marshal(msg)
+	frame, err := encodeFrame(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return err
 	}
 
-	data = append(data, '\n')
-	if _, err := pc.writer.Write(data); err != nil {
-		return fmt.Errorf("failed to write message: %w", err)
+	pc.initWriter()
+	pc.startOnce.Do(func() { go pc.writeLoop() })
+
+	pc.queueMu.Lock()
+	if pc.writeErr != nil {
+		err := pc.writeErr
+		pc.queueMu.Unlock()
+		return err
 	}
+	pc.outgoing = append(pc.outgoing, &outgoingFrame{frame: frame, data: msg.Data, done: done})
+	pc.queueMu.Unlock()
 
-	return pc.writer.Flush()
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+	return nil
 }
 
-// Close closes the connection
+// initWriter creates the channels of the connection's writer
+func (pc *PeerConnection) initWriter() {
+	pc.initOnce.Do(func() {
+		pc.wake = make(chan struct{}, 1)
+		pc.closing = make(chan struct{})
+	})
+}
+
+// writeLoop writes the queued frames in order until a write fails or the
+// connection is closed
+func (pc *PeerConnection) writeLoop() {
+	for {
+		select {
+		case <-pc.wake:
+		case <-pc.closing:
+			pc.failWrites(errConnectionClosed)
+			return
+		}
+
+		for {
+			pc.queueMu.Lock()
+			if len(pc.outgoing) == 0 {
+				pc.queueMu.Unlock()
+				break
+			}
+			next := pc.outgoing[0]
+			pc.outgoing[0] = nil
+			pc.outgoing = pc.outgoing[1:]
+			pc.queueMu.Unlock()
+
+			err := writeFrame(pc.writer, next.frame, next.data)
+			if next.done != nil {
+				next.done <- err
+			}
+			if err != nil {
+				pc.failWrites(err)
+				return
+			}
+		}
+	}
+}
+
+// failWrites stops the writer, failing the queued frames and any written
+// later with err
+func (pc *PeerConnection) failWrites(err error) {
+	pc.queueMu.Lock()
+	pc.writeErr = err
+	pending := pc.outgoing
+	pc.outgoing = nil
+	pc.queueMu.Unlock()
+
+	for _, f := range pending {
+		if f.done != nil {
+			f.done <- err
+		}
+	}
+}
+
+// Compression returns the codec negotiated for data sent to the peer, or
+// "" if the data is sent uncompressed
+func (pc *PeerConnection) Compression() string {
+	codec, _ := pc.compression.Load().(string)
+	return codec
+}
+
+// SetCompression sets the codec negotiated for data sent to the peer
+func (pc *PeerConnection) SetCompression(codec string) {
+	pc.compression.Store(codec)
+}
+
+// Close closes the connection, failing the messages still queued
 func (pc *PeerConnection) Close() error {
+	pc.initWriter()
+	pc.closeOnce.Do(func() { close(pc.closing) })
 	if pc.Conn != nil {
 		return pc.Conn.Close()
 	}
 	return nil
 }
 
-// ComputeHMAC computes the HMAC for a message
+// ComputeHMAC computes the HMAC for a message, including its raw data
 func (pc *PeerConnection) ComputeHMAC(msg *Message) string {
 	data := fmt.Sprintf("%s:%d:%s", msg.Type, msg.Timestamp, string(msg.Payload))
 	h := hmac.New(sha256.New, []byte(pc.SharedSecret))
 	h.Write([]byte(data))
+	if len(msg.Data) > 0 {
+		h.Write([]byte(":"))
+		h.Write(msg.Data)
+	}
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"SyncDev/internal/config"
+	"sync"
+	"time"
+)
+
+// bandwidthCheckInterval is how often the limits are reevaluated so that
+// time of day schedules take effect
+const bandwidthCheckInterval = time.Minute
+
+// rateLimiter limits the rate of data passing through it. Data may go out
+// up to a second's worth ahead; waits are paid back afterwards.
+type rateLimiter struct {
+	rate    float64 // Bytes per second; 0 is unlimited
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // Closed when the rate changes
+	mu      sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{changed: make(chan struct{})}
+}
+
+// setRate changes the rate, in bytes per second. Waits under the old rate
+// end right away.
+func (l *rateLimiter) setRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if float64(bytesPerSec) == l.rate {
+		return
+	}
+	l.rate = float64(bytesPerSec)
+	l.tokens = l.rate
+	l.last = time.Now()
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// reserve takes n bytes from the limiter and returns how long to wait
+// before sending them
+func (l *rateLimiter) reserve(n int) (time.Duration, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, l.changed
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, l.changed
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), l.changed
+}
+
+// throttle is the limiters that data to or from a peer passes through:
+// the global ones and the peer's
+type throttle []*rateLimiter
+
+// wait blocks until n bytes may pass every limiter
+func (t throttle) wait(n int) {
+	pause(t.reserve(n))
+}
+
+// reserve takes n bytes from every limiter. It returns how long they must
+// wait to pass, and a channel that is closed if the limits change first.
+func (t throttle) reserve(n int) (time.Duration, <-chan struct{}) {
+	var delay time.Duration
+	var changed <-chan struct{}
+	for _, l := range t {
+		if d, c := l.reserve(n); d > delay {
+			delay, changed = d, c
+		}
+	}
+	return delay, changed
+}
+
+// pause blocks for delay, or until changed is closed
+func pause(delay time.Duration, changed <-chan struct{}) {
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-changed:
+	}
+}
+
+// peerBandwidth is the limiters of the transfers with one peer
+type peerBandwidth struct {
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+// Bandwidth limits the upload and download rates of all transfers
+// together and of the transfers with each peer, following the limits and
+// schedules of the configuration
+type Bandwidth struct {
+	upload   *rateLimiter
+	download *rateLimiter
+	peers    map[string]*peerBandwidth
+	config   *config.Config
+	mu       sync.Mutex
+}
+
+// NewBandwidth creates a Bandwidth with the limits of cfg
+func NewBandwidth(cfg *config.Config) *Bandwidth {
+	b := &Bandwidth{
+		upload:   newRateLimiter(),
+		download: newRateLimiter(),
+		peers:    make(map[string]*peerBandwidth),
+	}
+	b.Apply(cfg, time.Now())
+	return b
+}
+
+// Apply sets the limits cfg has in effect at now
+func (b *Bandwidth) Apply(cfg *config.Config, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.config = cfg
+	global, _ := cfg.BandwidthLimits("", now)
+	b.upload.setRate(kbps(global.UploadKBps))
+	b.download.setRate(kbps(global.DownloadKBps))
+	for peerID, peer := range b.peers {
+		b.applyPeer(peerID, peer, now)
+	}
+}
+
+func (b *Bandwidth) applyPeer(peerID string, peer *peerBandwidth, now time.Time) {
+	_, limit := b.config.BandwidthLimits(peerID, now)
+	peer.upload.setRate(kbps(limit.UploadKBps))
+	peer.download.setRate(kbps(limit.DownloadKBps))
+}
+
+// peer returns the limiters of a peer, creating them on first use
+func (b *Bandwidth) peer(peerID string) *peerBandwidth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peer := b.peers[peerID]
+	if peer == nil {
+		peer = &peerBandwidth{upload: newRateLimiter(), download: newRateLimiter()}
+		b.applyPeer(peerID, peer, time.Now())
+		b.peers[peerID] = peer
+	}
+	return peer
+}
+
+// uploadTo returns the throttle of data sent to a peer
+func (b *Bandwidth) uploadTo(peerID string) throttle {
+	return throttle{b.upload, b.peer(peerID).upload}
+}
+
+// downloadFrom returns the throttle of data received from a peer
+func (b *Bandwidth) downloadFrom(peerID string) throttle {
+	return throttle{b.download, b.peer(peerID).download}
+}
+
+// kbps converts a limit in KiB/s to bytes per second
+func kbps(limit int) int64 {
+	if limit <= 0 {
+		return 0
+	}
+	return int64(limit) * 1024
+}
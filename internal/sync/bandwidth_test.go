@@ -0,0 +1,50 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"SyncDev/internal/config"
+)
+
+func TestBandwidthLimitsRate(t *testing.T) {
+	b := NewBandwidth(&config.Config{
+		PeerBandwidth: map[string]config.BandwidthLimit{"laptop": {UploadKBps: 100}},
+	})
+
+	// A second's worth goes out right away, the next has to wait for it
+	upload := b.uploadTo("laptop")
+	start := time.Now()
+	upload.wait(50 * 1024)
+	upload.wait(50 * 1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected the first second's worth not to wait, waited %v", elapsed)
+	}
+	start = time.Now()
+	upload.wait(20 * 1024)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected data over the limit to wait, waited %v", elapsed)
+	}
+
+	// Other peers and downloads are unlimited
+	start = time.Now()
+	b.uploadTo("desktop").wait(10 * 1024 * 1024)
+	b.downloadFrom("laptop").wait(10 * 1024 * 1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected unlimited transfers not to wait, waited %v", elapsed)
+	}
+
+	// Lifting the limit ends a wait under way
+	done := make(chan struct{})
+	go func() {
+		upload.wait(1024 * 1024)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	b.Apply(&config.Config{}, time.Now())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected lifting the limit to end the wait")
+	}
+}
@@ -0,0 +1,168 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sync"
+)
+
+const (
+	// Chunk sizes of content-defined chunking. Files smaller than
+	// minChunkSize aren't split and dedup as a whole.
+	minChunkSize = 128 * 1024
+	avgChunkSize = 512 * 1024
+	maxChunkSize = 2 * 1024 * 1024
+
+	// Boundaries are harder to hit below the average size and easier above,
+	// which keeps chunk sizes close to it
+	chunkMaskSmall uint64 = (1<<21 - 1) << (64 - 21)
+	chunkMaskLarge uint64 = (1<<17 - 1) << (64 - 17)
+)
+
+// gearTable maps bytes to the random values of the gear hash. It is
+// generated from a fixed seed so every peer cuts the same boundaries.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x5379_6e63_4465_7600)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkWriter splits the data written to it into content-defined chunks,
+// cutting where a gear hash of the last bytes hits a mask. An insertion
+// only changes the chunks around it.
+type chunkWriter struct {
+	chunks []models.FileChunk
+	hasher hash.Hash
+	size   int64
+	gear   uint64
+}
+
+func newChunkWriter() *chunkWriter {
+	return &chunkWriter{hasher: sha256.New()}
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		cut := w.boundary(p)
+		if cut < 0 {
+			w.hasher.Write(p)
+			w.size += int64(len(p))
+			break
+		}
+		w.hasher.Write(p[:cut])
+		w.size += int64(cut)
+		w.cut()
+		p = p[cut:]
+	}
+	return n, nil
+}
+
+// boundary returns how many bytes of p complete the current chunk, or -1
+// if the chunk continues past p
+func (w *chunkWriter) boundary(p []byte) int {
+	for i, b := range p {
+		size := w.size + int64(i) + 1
+		if size < minChunkSize {
+			continue
+		}
+		w.gear = w.gear<<1 + gearTable[b]
+		mask := chunkMaskSmall
+		if size >= avgChunkSize {
+			mask = chunkMaskLarge
+		}
+		if w.gear&mask == 0 || size >= maxChunkSize {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// cut ends the current chunk
+func (w *chunkWriter) cut() {
+	w.chunks = append(w.chunks, models.FileChunk{
+		Hash: hex.EncodeToString(w.hasher.Sum(nil)),
+		Size: w.size,
+	})
+	w.hasher.Reset()
+	w.size = 0
+	w.gear = 0
+}
+
+// Chunks ends the last chunk and returns the chunks of the data written
+func (w *chunkWriter) Chunks() []models.FileChunk {
+	if w.size > 0 {
+		w.cut()
+	}
+	return w.chunks
+}
+
+// fileChunks returns the chunks of a file. A file without a chunk list is
+// a single chunk with the file's hash.
+func fileChunks(info *models.FileInfo) []models.FileChunk {
+	if len(info.Chunks) > 0 {
+		return info.Chunks
+	}
+	if info.IsDir || info.Hash == "" || info.Size == 0 {
+		return nil
+	}
+	return []models.FileChunk{{Hash: info.Hash, Size: info.Size}}
+}
+
+// chunkSource is where a chunk can be read from a local file
+type chunkSource struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// chunkIndex locates chunks in the local files of a folder pair. Entries
+// can be stale, so chunks are verified when read.
+type chunkIndex struct {
+	chunks map[string]chunkSource
+	mu     sync.RWMutex
+}
+
+// newChunkIndex indexes the chunks of the files in index
+func newChunkIndex(index *models.FileIndex) *chunkIndex {
+	ci := &chunkIndex{chunks: make(map[string]chunkSource)}
+	if index != nil {
+		for _, info := range index.Files {
+			ci.add(info)
+		}
+	}
+	return ci
+}
+
+// add indexes the chunks of a file
+func (ci *chunkIndex) add(info *models.FileInfo) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	var offset int64
+	for _, chunk := range fileChunks(info) {
+		if _, ok := ci.chunks[chunk.Hash]; !ok {
+			ci.chunks[chunk.Hash] = chunkSource{path: info.Path, offset: offset, size: chunk.Size}
+		}
+		offset += chunk.Size
+	}
+}
+
+// lookup returns where a chunk can be read locally
+func (ci *chunkIndex) lookup(chunk models.FileChunk) (chunkSource, bool) {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	source, ok := ci.chunks[chunk.Hash]
+	return source, ok && source.size == chunk.Size
+}
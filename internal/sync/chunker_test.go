@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+)
+
+func chunkData(data []byte) []models.FileChunk {
+	w := newChunkWriter()
+	// Uneven writes must cut the same boundaries as one large write
+	for len(data) > 0 {
+		n := min(len(data), 100000)
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	return w.Chunks()
+}
+
+func TestChunkBoundariesSurviveInsertion(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	data := make([]byte, 8*1024*1024)
+	rng.Read(data)
+
+	chunks := chunkData(data)
+	var total int64
+	for i, chunk := range chunks {
+		if chunk.Size > maxChunkSize || (chunk.Size < minChunkSize && i < len(chunks)-1) {
+			t.Errorf("Expected chunk %d within the size limits, got %d bytes", i, chunk.Size)
+		}
+		total += chunk.Size
+	}
+	if total != int64(len(data)) {
+		t.Fatalf("Expected chunks to cover %d bytes, got %d", len(data), total)
+	}
+
+	mid := len(data) / 2
+	edited := append(append(append([]byte(nil), data[:mid]...), []byte("inserted")...), data[mid:]...)
+	known := make(map[string]bool)
+	for _, chunk := range chunks {
+		known[chunk.Hash] = true
+	}
+	changed := 0
+	for _, chunk := range chunkData(edited) {
+		if !known[chunk.Hash] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("Expected an insertion to change at most 2 chunks, got %d of %d", changed, len(chunks))
+	}
+}
+
+func TestChunkReceiverReusesLocalChunks(t *testing.T) {
+	root := t.TempDir()
+	rng := rand.New(rand.NewSource(2))
+	logData := make([]byte, 3*1024*1024)
+	rng.Read(logData)
+	os.MkdirAll(filepath.Join(root, "old"), 0755)
+	os.WriteFile(filepath.Join(root, "old", "app.log"), logData, 0644)
+	os.WriteFile(filepath.Join(root, "old", "small.txt"), []byte("small file"), 0644)
+
+	scanner := NewScanner(nil)
+	scanner.SetChunking(true)
+	local, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+	if len(local.Files["old/app.log"].Chunks) == 0 {
+		t.Fatal("Expected the scanner to record chunks")
+	}
+	index := newChunkIndex(local)
+
+	// The peer's copy of the log has more lines appended
+	appended := make([]byte, 300*1024)
+	rng.Read(appended)
+	content := append(append([]byte(nil), logData...), appended...)
+	sum := sha256.Sum256(content)
+	info := &models.FileInfo{Path: "new/app.log", Size: int64(len(content)), Hash: hex.EncodeToString(sum[:]), Chunks: chunkData(content)}
+
+	receiver, missing, err := NewChunkReceiver(root, info, index, nil)
+	if err != nil {
+		t.Fatalf("NewChunkReceiver failed: %v", err)
+	}
+	var missingBytes int64
+	for _, r := range missing {
+		missingBytes += r.Size
+		if err := receiver.WriteChunk(content[r.Offset:r.Offset+r.Size], r.Offset); err != nil {
+			t.Fatalf("WriteChunk failed: %v", err)
+		}
+	}
+	if missingBytes == 0 || missingBytes > int64(len(appended))+maxChunkSize {
+		t.Errorf("Expected only the appended part to be missing, got %d bytes", missingBytes)
+	}
+	if err := receiver.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "new", "app.log")); !bytes.Equal(data, content) {
+		t.Error("Expected the built file to match the peer's copy")
+	}
+
+	// A duplicate of a small file needs no transfer at all
+	small := local.Files["old/small.txt"]
+	receiver, missing, err = NewChunkReceiver(root, &models.FileInfo{Path: "copy.txt", Size: small.Size, Hash: small.Hash}, index, nil)
+	if err != nil {
+		t.Fatalf("NewChunkReceiver failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("Expected nothing missing for a duplicate, got %v", missing)
+	}
+	if err := receiver.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	receiver.Abort()
+}
+
+func TestChunkReceiverCopiesWholeFiles(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, 3*network.ChunkSize+100)
+	rand.New(rand.NewSource(3)).Read(content)
+	os.WriteFile(filepath.Join(root, "disk.img"), content, 0644)
+
+	// Without chunking the whole file is a single chunk
+	local, err := NewScanner(nil).ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+	original := local.Files["disk.img"]
+	if len(original.Chunks) != 0 {
+		t.Fatal("Expected no chunks without chunking")
+	}
+
+	info := &models.FileInfo{Path: "copy.img", Size: original.Size, Hash: original.Hash}
+	receiver, missing, err := NewChunkReceiver(root, info, newChunkIndex(local), nil)
+	if err != nil {
+		t.Fatalf("NewChunkReceiver failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("Expected nothing missing for a duplicate, got %v", missing)
+	}
+	if err := receiver.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "copy.img")); !bytes.Equal(data, content) {
+		t.Error("Expected the copy to match the original")
+	}
+}
@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"SyncDev/internal/network"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// compressTrialSize is how much of a file is compressed on trial before
+	// deciding whether the rest is worth compressing
+	compressTrialSize = 64 * 1024
+	// minCompressGain is the smallest saving, as a fraction of the data,
+	// that compressed data has to achieve to be sent compressed
+	minCompressGain = 0.05
+)
+
+// compressedExtensions are formats that are compressed already and gain
+// nothing from compressing again
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".br": true, ".bz2": true, ".dmg": true,
+	".docx": true, ".epub": true, ".flac": true, ".gif": true, ".gz": true,
+	".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true,
+	".m4a": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true,
+	".odt": true, ".ogg": true, ".pptx": true, ".png": true, ".rar": true,
+	".tgz": true, ".webm": true, ".webp": true, ".woff2": true, ".xlsx": true,
+	".xz": true, ".zip": true, ".zst": true,
+}
+
+// compressor compresses the data of one file's chunks with the codec
+// negotiated with the peer. Files of compressed formats, and files whose
+// first data doesn't compress, are sent as is.
+type compressor struct {
+	codec  string // "" once compression is off for the file
+	trial  bool   // Set until enough data was tried to decide
+	raw    int64  // Data bytes sent
+	wire   int64  // Bytes those took on the wire
+	tested int64  // Data bytes tried so far
+}
+
+// newCompressor creates a compressor for the file at relPath
+func newCompressor(codec, relPath string) *compressor {
+	if compressedExtensions[strings.ToLower(filepath.Ext(relPath))] {
+		codec = ""
+	}
+	return &compressor{codec: codec, trial: true}
+}
+
+// compress returns the data to send for data and the codec it is
+// compressed with, "" if it is sent as is
+func (c *compressor) compress(data []byte) ([]byte, string) {
+	out, codec := c.encode(data)
+	c.raw += int64(len(data))
+	c.wire += int64(len(out))
+	return out, codec
+}
+
+// encode compresses data unless the file is sent as is or the data
+// doesn't compress enough, returning the codec used, "" for none. Data
+// that fails the trial turns compression off for the rest of the file.
+func (c *compressor) encode(data []byte) ([]byte, string) {
+	if c.codec == "" || len(data) == 0 {
+		return data, ""
+	}
+
+	compressed, err := network.Compress(c.codec, data)
+	worthIt := err == nil && float64(len(compressed)) <= float64(len(data))*(1-minCompressGain)
+	if c.trial {
+		c.tested += int64(len(data))
+		if !worthIt {
+			// Data that doesn't compress at the start of a file rarely
+			// does further on
+			c.codec = ""
+		} else if c.tested >= compressTrialSize {
+			c.trial = false
+		}
+	}
+	if !worthIt {
+		return data, ""
+	}
+	return compressed, c.codec
+}
+
+// ratio returns how many data bytes were sent per byte on the wire, or 0
+// before any data was sent
+func (c *compressor) ratio() float64 {
+	return compressionRatio(c.raw, c.wire)
+}
+
+// compressionRatio is the ratio of raw data to the bytes it took on the
+// wire, or 0 when nothing was sent
+func compressionRatio(raw, wire int64) float64 {
+	if raw == 0 || wire == 0 {
+		return 0
+	}
+	return float64(raw) / float64(wire)
+}
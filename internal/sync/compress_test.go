@@ -0,0 +1,44 @@
+package sync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"SyncDev/internal/network"
+)
+
+func TestCompressorSkipsIncompressibleData(t *testing.T) {
+	text := bytes.Repeat([]byte("func main() { fmt.Println(\"hello\") }\n"), 2000)
+	random := make([]byte, 2*compressTrialSize)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	comp := newCompressor(network.CompressionZstd, "src/main.go")
+	data, codec := comp.compress(text)
+	if codec != network.CompressionZstd || len(data) >= len(text) {
+		t.Fatalf("Expected source code to be compressed, got %d of %d bytes", len(data), len(text))
+	}
+	if ratio := comp.ratio(); ratio < 3 {
+		t.Errorf("Expected a compression ratio of at least 3, got %.2f", ratio)
+	}
+
+	// A file that starts incompressible is sent as is from then on
+	comp = newCompressor(network.CompressionZstd, "data.bin")
+	if _, codec := comp.compress(random); codec != "" {
+		t.Error("Expected random data to be sent as is")
+	}
+	if _, codec := comp.compress(text); codec != "" {
+		t.Error("Expected compression to stay off after a failed trial")
+	}
+
+	// Compressed formats aren't tried at all
+	comp = newCompressor(network.CompressionZstd, "photos/IMG_0001.JPG")
+	if data, codec := comp.compress(text); codec != "" || !bytes.Equal(data, text) {
+		t.Error("Expected a JPEG to be sent as is")
+	}
+
+	// Without a negotiated codec nothing is compressed
+	if _, codec := newCompressor("", "src/main.go").compress(text); codec != "" {
+		t.Error("Expected no compression without a codec")
+	}
+}
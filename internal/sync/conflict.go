@@ -0,0 +1,184 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// conflictMarker separates the original name from the conflict details
+	conflictMarker = ".sync-conflict-"
+	// conflictTimeFormat is the timestamp layout used in conflict copy names
+	conflictTimeFormat = "20060102-150405"
+)
+
+// conflictNamePattern matches name.sync-conflict-<timestamp>-<device>[.ext]
+var conflictNamePattern = regexp.MustCompile(`^(.*)\.sync-conflict-(\d{8}-\d{6})-([^.]+)(\.[^.]*)?$`)
+
+// ConflictInfo describes a conflict copy kept next to the winning file
+type ConflictInfo struct {
+	FolderPairID string    `json:"folderPairId"`
+	LocalPath    string    `json:"localPath"`
+	Path         string    `json:"path"`         // Relative path of the conflict copy
+	OriginalPath string    `json:"originalPath"` // Relative path of the winning file
+	Device       string    `json:"device"`       // Device whose edit lost
+	Time         time.Time `json:"time"`
+	Size         int64     `json:"size"`
+}
+
+// ConflictCopyName returns the name used to keep the losing version of
+// relPath, e.g. notes.sync-conflict-20240102-150405-MacBook.txt
+func ConflictCopyName(relPath, device string, t time.Time) string {
+	dir, name := filepath.Split(relPath)
+
+	ext := filepath.Ext(name)
+	if ext == name {
+		// Dotfiles like .bashrc have no extension
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	return dir + stem + conflictMarker + t.Format(conflictTimeFormat) + "-" + sanitizeDeviceName(device) + ext
+}
+
+// parseConflictCopy extracts the original path, device and time from a
+// conflict copy path
+func parseConflictCopy(relPath string) (original, device string, t time.Time, ok bool) {
+	dir, name := filepath.Split(relPath)
+	m := conflictNamePattern.FindStringSubmatch(name)
+	if m == nil {
+		return "", "", time.Time{}, false
+	}
+
+	t, err := time.ParseInLocation(conflictTimeFormat, m[2], time.Local)
+	if err != nil {
+		return "", "", time.Time{}, false
+	}
+	return dir + m[1] + m[4], m[3], t, true
+}
+
+// sanitizeDeviceName makes a device name safe to embed in a file name
+func sanitizeDeviceName(device string) string {
+	var b strings.Builder
+	for _, r := range device {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "unknown"
+	}
+	return b.String()
+}
+
+// makeConflictCopy copies the local version of relPath to a conflict copy
+// and returns the relative path of the copy
+func makeConflictCopy(rootPath, relPath, device string) (string, error) {
+	if err := checkLocalPath(rootPath, relPath); err != nil {
+		return "", err
+	}
+	copyPath := ConflictCopyName(relPath, device, time.Now())
+	src := diskPath(rootPath, relPath)
+	dst := diskPath(rootPath, copyPath)
+
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("conflict copy already exists: %s", copyPath)
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to create conflict copy: %w", err)
+	}
+
+	// A link is kept as a link to the same target
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err == nil {
+			err = os.Symlink(target, dst)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create conflict copy: %w", err)
+		}
+		return copyPath, nil
+	}
+
+	if err := CopyFile(src, dst); err != nil {
+		return "", fmt.Errorf("failed to create conflict copy: %w", err)
+	}
+	return copyPath, nil
+}
+
+// keepConflictCopy saves the local losing version of a file and records a
+// conflict event for it
+func (e *Engine) keepConflictCopy(folderPairID, rootPath, relPath, peerName string) {
+	device := e.config.Get().DeviceName
+	copyPath, err := makeConflictCopy(rootPath, relPath, device)
+	if err != nil {
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  folderPairID,
+			FilePath:    relPath,
+			PeerName:    peerName,
+			Description: fmt.Sprintf("Conflict copy failed: %v", err),
+		})
+		return
+	}
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "conflict",
+		FolderPair:  folderPairID,
+		FilePath:    relPath,
+		PeerName:    peerName,
+		Description: fmt.Sprintf("Conflicting edit kept as %s", copyPath),
+	})
+}
+
+// GetConflicts lists the conflict copies present in all enabled folder pairs
+func (e *Engine) GetConflicts() []*ConflictInfo {
+	cfg := e.config.Get()
+	conflicts := make([]*ConflictInfo, 0)
+
+	for _, fp := range cfg.FolderPairs {
+		if !fp.Enabled {
+			continue
+		}
+
+		index, err := e.scannerFor(fp).QuickScan(fp.LocalPath)
+		if err != nil {
+			continue
+		}
+
+		for path, info := range index.Files {
+			if info.IsDir {
+				continue
+			}
+			original, device, t, ok := parseConflictCopy(path)
+			if !ok {
+				continue
+			}
+			conflicts = append(conflicts, &ConflictInfo{
+				FolderPairID: fp.ID,
+				LocalPath:    fp.LocalPath,
+				Path:         path,
+				OriginalPath: original,
+				Device:       device,
+				Time:         t,
+				Size:         info.Size,
+			})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Time.After(conflicts[j].Time)
+	})
+	return conflicts
+}
@@ -0,0 +1,75 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConflictCopyName(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 15, 4, 5, 0, time.Local)
+
+	tests := []struct {
+		path     string
+		device   string
+		expected string
+	}{
+		{"notes.txt", "MacBook", "notes.sync-conflict-20240102-150405-MacBook.txt"},
+		{"src/archive.tar.gz", "mini", "src/archive.tar.sync-conflict-20240102-150405-mini.gz"},
+		{"Makefile", "mini", "Makefile.sync-conflict-20240102-150405-mini"},
+		{".bashrc", "John's Mac.local", ".bashrc.sync-conflict-20240102-150405-John_s_Mac_local"},
+	}
+
+	for _, tt := range tests {
+		got := ConflictCopyName(tt.path, tt.device, ts)
+		if got != tt.expected {
+			t.Errorf("ConflictCopyName(%q) = %q, expected %q", tt.path, got, tt.expected)
+		}
+
+		original, device, parsed, ok := parseConflictCopy(got)
+		if !ok {
+			t.Errorf("Failed to parse conflict copy %q", got)
+			continue
+		}
+		if original != tt.path || device != sanitizeDeviceName(tt.device) || !parsed.Equal(ts) {
+			t.Errorf("parseConflictCopy(%q) = %q, %q, %v", got, original, device, parsed)
+		}
+	}
+}
+
+func TestMakeConflictCopy(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("mine"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	copyPath, err := makeConflictCopy(root, "a.txt", "dev")
+	if err != nil {
+		t.Fatalf("makeConflictCopy failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, copyPath))
+	if err != nil {
+		t.Fatalf("Failed to read conflict copy: %v", err)
+	}
+	if string(data) != "mine" {
+		t.Errorf("Expected conflict copy to keep local content, got %q", data)
+	}
+}
+
+func TestMakeConflictCopyOfSymlink(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "target.txt"), []byte("target"), 0644)
+	if err := os.Symlink("target.txt", filepath.Join(root, "link")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+
+	copyPath, err := makeConflictCopy(root, "link", "dev")
+	if err != nil {
+		t.Fatalf("makeConflictCopy failed: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, copyPath)); err != nil || target != "target.txt" {
+		t.Errorf("Expected the conflict copy to link to target.txt, got %q (%v)", target, err)
+	}
+}
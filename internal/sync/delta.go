@@ -0,0 +1,257 @@
+package sync
+
+import (
+	"SyncDev/internal/network"
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// deltaMinSize is the smallest file sent as a delta; smaller files are
+	// cheaper to send in full than to sign and compare
+	deltaMinSize = network.ChunkSize
+
+	minDeltaBlockSize = 2 * 1024
+	maxDeltaBlockSize = 128 * 1024
+)
+
+// Signatures are the block signatures of the receiver's copy of a file,
+// which the sender matches its version against to send only what changed
+type Signatures struct {
+	BlockSize int
+	Blocks    []network.BlockSignature
+}
+
+// deltaBlockSize picks the block size for a file of the given size: about
+// its square root, which balances signature count against match
+// granularity
+func deltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 1023) &^ 1023
+	if blockSize < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+	if blockSize > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+	return blockSize
+}
+
+// rollingChecksum is the rsync weak checksum of a window of bytes, which
+// can slide forward one byte at a time
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(window []byte) rollingChecksum {
+	r := rollingChecksum{n: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+// roll slides the window forward, dropping out and adding in
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// strongChecksum is the checksum that confirms a weak checksum match
+func strongChecksum(block []byte) [16]byte {
+	var strong [16]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+	return strong
+}
+
+// fileSignatures computes the signatures of a file's blocks
+func fileSignatures(path string) (*Signatures, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sigs := &Signatures{BlockSize: deltaBlockSize(info.Size())}
+	block := make([]byte, sigs.BlockSize)
+	for {
+		n, err := io.ReadFull(file, block)
+		if n > 0 {
+			sigs.Blocks = append(sigs.Blocks, network.BlockSignature{
+				Weak:   newRollingChecksum(block[:n]).sum(),
+				Strong: strongChecksum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sigs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// computeDelta reads the new version of a file from r and emits the ops
+// that rebuild it from the blocks described by sigs. Literal runs are
+// emitted in pieces of at most maxLiteral bytes.
+func computeDelta(r io.Reader, sigs *Signatures, maxLiteral int, emit func(network.DeltaOp) error) error {
+	blockSize := sigs.BlockSize
+	table := make(map[uint32][]uint32, len(sigs.Blocks))
+	for i, block := range sigs.Blocks {
+		table[block.Weak] = append(table[block.Weak], uint32(i))
+	}
+
+	// Only one copy op is held back so runs of consecutive blocks merge
+	var pending *network.DeltaOp
+	flushCopy := func() error {
+		if pending == nil {
+			return nil
+		}
+		op := *pending
+		pending = nil
+		return emit(op)
+	}
+	emitCopy := func(block uint32) error {
+		if pending != nil && pending.Block+pending.Count == block {
+			pending.Count++
+			return nil
+		}
+		if err := flushCopy(); err != nil {
+			return err
+		}
+		pending = &network.DeltaOp{Block: block, Count: 1}
+		return nil
+	}
+	emitLiteral := func(data []byte) error {
+		if len(data) == 0 {
+			return nil
+		}
+		if err := flushCopy(); err != nil {
+			return err
+		}
+		return emit(network.DeltaOp{Data: append([]byte(nil), data...)})
+	}
+	match := func(weak uint32, window []byte) (uint32, bool) {
+		candidates, ok := table[weak]
+		if !ok {
+			return 0, false
+		}
+		strong := strongChecksum(window)
+		for _, i := range candidates {
+			if sigs.Blocks[i].Strong == strong {
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	reader := bufio.NewReaderSize(r, network.ChunkSize)
+	readBuf := make([]byte, network.ChunkSize)
+	// data holds the pending literal from litStart followed by the window
+	// at pos
+	var data []byte
+	litStart, pos := 0, 0
+	eof := false
+
+	// fill reads until the window has a byte after it to roll in
+	fill := func() error {
+		for !eof && len(data)-pos <= blockSize {
+			n, err := reader.Read(readBuf)
+			data = append(data, readBuf[:n]...)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	var sum rollingChecksum
+	fresh := true
+	for len(data)-pos >= blockSize {
+		window := data[pos : pos+blockSize]
+		if fresh {
+			sum = newRollingChecksum(window)
+			fresh = false
+		}
+
+		if block, ok := match(sum.sum(), window); ok {
+			if err := emitLiteral(data[litStart:pos]); err != nil {
+				return err
+			}
+			if err := emitCopy(block); err != nil {
+				return err
+			}
+			pos += blockSize
+			litStart = pos
+			fresh = true
+		} else {
+			if pos-litStart >= maxLiteral {
+				if err := emitLiteral(data[litStart:pos]); err != nil {
+					return err
+				}
+				litStart = pos
+			}
+			// At the end of the file the window can't slide any further
+			if len(data)-pos == blockSize {
+				break
+			}
+			sum.roll(data[pos], data[pos+blockSize])
+			pos++
+		}
+
+		// Drop what has been emitted so memory stays bounded
+		if litStart > 2*network.ChunkSize {
+			data = append(data[:0], data[litStart:]...)
+			pos -= litStart
+			litStart = 0
+		}
+		if err := fill(); err != nil {
+			return err
+		}
+	}
+
+	// The tail may match the receiver's last, shorter block
+	tail := data[pos:]
+	if len(tail) > 0 && len(tail) < blockSize {
+		if block, ok := match(newRollingChecksum(tail).sum(), tail); ok {
+			if err := emitLiteral(data[litStart:pos]); err != nil {
+				return err
+			}
+			if err := emitCopy(block); err != nil {
+				return err
+			}
+			return flushCopy()
+		}
+	}
+
+	for start := litStart; start < len(data); start += maxLiteral {
+		end := start + maxLiteral
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := emitLiteral(data[start:end]); err != nil {
+			return err
+		}
+	}
+	return flushCopy()
+}
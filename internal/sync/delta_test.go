@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+)
+
+func TestRollingChecksum(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	window := 16
+
+	sum := newRollingChecksum(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		sum.roll(data[i-1], data[i+window-1])
+		if expected := newRollingChecksum(data[i : i+window]).sum(); sum.sum() != expected {
+			t.Fatalf("Expected rolled checksum %d at %d, got %d", expected, i, sum.sum())
+		}
+	}
+}
+
+func TestDeltaRebuildsFile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	basis := make([]byte, 3*deltaMinSize+123)
+	rng.Read(basis)
+
+	// Edit the start, insert in the middle, drop a piece and change the end
+	updated := append([]byte("prefix"), basis[10:]...)
+	mid := len(updated) / 2
+	updated = append(updated[:mid], append([]byte("inserted data"), updated[mid:]...)...)
+	updated = append(updated[:mid+50000], updated[mid+60000:]...)
+	updated = append(updated[:len(updated)-10], []byte("new tail")...)
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"edited", updated},
+		{"unchanged", basis},
+		{"unrelated", bytes.Repeat([]byte("x"), deltaMinSize)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			path := filepath.Join(root, "file.bin")
+			os.WriteFile(path, basis, 0644)
+
+			sigs, err := fileSignatures(path)
+			if err != nil {
+				t.Fatalf("fileSignatures failed: %v", err)
+			}
+
+			var ops []network.DeltaOp
+			literal := 0
+			err = computeDelta(bytes.NewReader(tt.content), sigs, network.ChunkSize, func(op network.DeltaOp) error {
+				ops = append(ops, op)
+				literal += len(op.Data)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("computeDelta failed: %v", err)
+			}
+
+			// Ops survive the wire format
+			ops, err = network.DecodeDeltaOps(network.EncodeDeltaOps(ops))
+			if err != nil {
+				t.Fatalf("DecodeDeltaOps failed: %v", err)
+			}
+
+			sum := sha256.Sum256(tt.content)
+			info := &models.FileInfo{Path: "file.bin", Size: int64(len(tt.content)), Hash: hex.EncodeToString(sum[:])}
+			receiver, err := NewDeltaReceiver(root, info, sigs.BlockSize, nil)
+			if err != nil {
+				t.Fatalf("NewDeltaReceiver failed: %v", err)
+			}
+			if err := receiver.ApplyDelta(ops); err != nil {
+				t.Fatalf("ApplyDelta failed: %v", err)
+			}
+			if err := receiver.Verify(); err != nil {
+				t.Fatalf("Verify failed: %v", err)
+			}
+			if err := receiver.Finalize(); err != nil {
+				t.Fatalf("Finalize failed: %v", err)
+			}
+
+			if data, _ := os.ReadFile(path); !bytes.Equal(data, tt.content) {
+				t.Error("Expected the rebuilt file to match the new version")
+			}
+			if tt.name == "edited" && literal > 4*sigs.BlockSize+100 {
+				t.Errorf("Expected only the edits to be sent, got %d literal bytes", literal)
+			}
+			if tt.name == "unchanged" && literal != 0 {
+				t.Errorf("Expected no literal data for an unchanged file, got %d bytes", literal)
+			}
+		})
+	}
+}
+
+func TestDeltaVerifyMismatch(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file.bin"), []byte("old content"), 0644)
+
+	info := &models.FileInfo{Path: "file.bin", Size: 11, Hash: "expected"}
+	receiver, err := NewDeltaReceiver(root, info, minDeltaBlockSize, nil)
+	if err != nil {
+		t.Fatalf("NewDeltaReceiver failed: %v", err)
+	}
+	defer receiver.Abort()
+
+	receiver.ApplyDelta([]network.DeltaOp{{Block: 0, Count: 1}})
+	if err := receiver.Verify(); err == nil {
+		t.Error("Expected a hash mismatch to fail verification")
+	}
+}
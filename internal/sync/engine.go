@@ -6,11 +6,14 @@ import (
 	"SyncDev/internal/network"
 	"SyncDev/internal/secrets"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,7 +30,7 @@ const (
 // SyncEvent represents a sync activity event
 type SyncEvent struct {
 	Time        time.Time `json:"time"`
-	Type        string    `json:"type"` // "push", "pull", "delete", "error"
+	Type        string    `json:"type"` // "push", "pull", "delete", "move", "conflict", "error"
 	FolderPair  string    `json:"folderPair"`
 	FilePath    string    `json:"filePath"`
 	PeerName    string    `json:"peerName"`
@@ -38,6 +41,7 @@ type SyncEvent struct {
 type Engine struct {
 	config       *config.Store
 	indexManager *IndexManager
+	hashCache    *HashCache
 	scanner      *Scanner
 	server       *network.Server
 	client       *network.Client
@@ -50,12 +54,24 @@ type Engine struct {
 
 	connections   map[string]*network.PeerConnection
 	fileReceivers map[string]*FileReceiver
+	partials      *PartialStore
+	offers        map[string]*network.PeerConnection // Files offered and not yet requested, by receiver key
+	withdrawn     map[string]*network.PeerConnection // Offers canceled before the peer requested them, by receiver key
+	canceled      map[string]*network.PeerConnection // Pulls canceled before their data arrived, by receiver key
+	chunkIndexes  map[string]*chunkIndex             // Chunks of local files by folder pair, built on demand
+	verifyErrors  map[string]int                     // Failed verifications of files being received, by receiver key
+	transfers     *TransferScheduler
+	bandwidth     *Bandwidth
 
 	onStatusChange func(SyncStatus, string)
 	onProgress     func(*models.TransferProgress)
 	onEvent        func(*SyncEvent)
 	onPeerChange   func()
 
+	// Transfer queue updates, emitted at most every queueEmitInterval
+	onQueueChange    func([]models.QueuedTransfer)
+	queueEmitPending atomic.Bool
+
 	// Progress aggregation
 	progressAggregator    *ProgressAggregator
 	onAggregateProgress   func(*models.AggregateProgress)
@@ -69,6 +85,17 @@ type Engine struct {
 	schedulerMu   sync.Mutex
 	schedulerRunning bool
 
+	watchers    map[string]*FolderWatcher
+	watcherKeys map[string]string
+	watching    bool
+	watchMu     sync.Mutex
+
+	scanCtx    context.Context
+	scanCancel context.CancelFunc
+	scanMu     sync.Mutex
+	scans      int  // Scans under way, guarded by mu
+	scanShown  bool // Whether scan progress replaced the idle status, guarded by mu
+
 	pairingCode   string
 	pairingCodeMu sync.RWMutex
 }
@@ -83,23 +110,48 @@ func NewEngine(cfg *config.Store) (*Engine, error) {
 		return nil, fmt.Errorf("failed to create index manager: %w", err)
 	}
 
+	hashCache, err := NewHashCache(filepath.Join(cfg.GetDataDir(), "hashcache.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hash cache: %w", err)
+	}
+
+	partials, err := NewPartialStore(filepath.Join(cfg.GetDataDir(), "partials.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load partial transfers: %w", err)
+	}
+
+	// Folder scans use a scanner per pair, see scannerFor
 	scanner := NewScanner(cfgData.GlobalExclusions)
+	scanner.SetHashCache(hashCache)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	engine := &Engine{
 		config:        cfg,
 		indexManager:  indexManager,
+		hashCache:     hashCache,
 		scanner:       scanner,
 		status:        StatusIdle,
 		connections:   make(map[string]*network.PeerConnection),
 		fileReceivers: make(map[string]*FileReceiver),
+		partials:      partials,
+		offers:        make(map[string]*network.PeerConnection),
+		withdrawn:     make(map[string]*network.PeerConnection),
+		canceled:      make(map[string]*network.PeerConnection),
+		chunkIndexes:  make(map[string]*chunkIndex),
+		verifyErrors:  make(map[string]int),
+		transfers:     NewTransferScheduler(cfgData.TransferLimits()),
+		bandwidth:     NewBandwidth(cfgData),
 		recentEvents:  make([]*SyncEvent, 0),
 		ctx:           ctx,
 		cancel:        cancel,
 		schedulerStop: make(chan struct{}),
+		watchers:      make(map[string]*FolderWatcher),
+		watcherKeys:   make(map[string]string),
 	}
 
+	engine.transfers.SetChangeCallback(engine.queueChanged)
+
 	// Create network components
 	engine.server = network.NewServer(cfgData.Port)
 	engine.server.SetHandler(engine)
@@ -139,6 +191,11 @@ func (e *Engine) Start() error {
 		go e.startScheduler()
 	}
 
+	// Watch folders for changes between periodic full syncs
+	e.setWatching(cfg.AutoSync)
+
+	go e.runBandwidthSchedules()
+
 	log.Println("Sync engine started")
 	return nil
 }
@@ -154,6 +211,7 @@ func (e *Engine) Stop() {
 		}
 	}
 	e.schedulerMu.Unlock()
+	e.setWatching(false)
 	e.server.Stop()
 	e.discovery.Stop()
 
@@ -230,6 +288,102 @@ func (e *Engine) NotifySyncEnd() {
 	}
 }
 
+// ApplyBandwidthLimits applies the bandwidth limits of the configuration,
+// including to transfers under way
+func (e *Engine) ApplyBandwidthLimits() {
+	e.bandwidth.Apply(e.config.Get(), time.Now())
+}
+
+// runBandwidthSchedules reapplies the bandwidth limits as time of day
+// schedules start and end, until the engine stops
+func (e *Engine) runBandwidthSchedules() {
+	ticker := time.NewTicker(bandwidthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.ApplyBandwidthLimits()
+		}
+	}
+}
+
+// SetQueueCallback sets the callback for changes of the transfer queue
+func (e *Engine) SetQueueCallback(cb func([]models.QueuedTransfer)) {
+	e.onQueueChange = cb
+}
+
+// queueChanged emits the transfer queue after it changed, at most every
+// queueEmitInterval
+func (e *Engine) queueChanged() {
+	if e.onQueueChange == nil || !e.queueEmitPending.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(queueEmitInterval, func() {
+		e.queueEmitPending.Store(false)
+		e.onQueueChange(e.transfers.Queue())
+	})
+}
+
+// GetTransferQueue returns the transfers under way followed by the queued
+// ones, in the order they will start
+func (e *Engine) GetTransferQueue() []models.QueuedTransfer {
+	return e.transfers.Queue()
+}
+
+// ReprioritizeTransfer changes the priority of a queued transfer
+func (e *Engine) ReprioritizeTransfer(id string, priority models.TransferPriority) error {
+	return e.transfers.Reprioritize(id, priority)
+}
+
+// SkipTransfer passes over a queued transfer until the rest of the queue
+// is done
+func (e *Engine) SkipTransfer(id string) error {
+	return e.transfers.Skip(id)
+}
+
+// CancelTransfer drops a queued transfer or stops one under way. The file
+// is transferred again by the next sync.
+func (e *Engine) CancelTransfer(id string) error {
+	conn, info, found := e.transfers.Transfer(id)
+	if found && info.Direction == "pull" {
+		// The peer may already be sending the file
+		e.mu.Lock()
+		e.canceled[id] = conn
+		e.mu.Unlock()
+	}
+	if err := e.transfers.Cancel(id); err != nil {
+		e.mu.Lock()
+		delete(e.canceled, id)
+		e.mu.Unlock()
+		return err
+	}
+
+	e.mu.Lock()
+	receiver := e.fileReceivers[id]
+	delete(e.fileReceivers, id)
+	if conn := e.offers[id]; conn != nil {
+		// The peer may still request the file it was offered
+		e.withdrawn[id] = conn
+		delete(e.offers, id)
+	}
+	e.mu.Unlock()
+	if receiver != nil {
+		// The rest of the data has no receiver and is ignored
+		receiver.Abort()
+		e.partials.Remove(id)
+	}
+	return nil
+}
+
+// SetTransferLimits changes the files in flight and the chunk window per
+// peer, including for transfers under way
+func (e *Engine) SetTransferLimits(filesInFlight, chunkWindow int) {
+	e.transfers.SetLimits(filesInFlight, chunkWindow)
+}
+
 // GetStatus returns the current sync status
 func (e *Engine) GetStatus() (SyncStatus, string) {
 	e.mu.RLock()
@@ -386,6 +540,7 @@ func (e *Engine) UpdateAutoSync(enabled bool) {
 			}
 		}
 	}
+	e.setWatching(enabled)
 	log.Printf("Auto-sync updated: %v", enabled)
 }
 
@@ -418,6 +573,32 @@ func (e *Engine) SyncAllPairs() {
 
 // SyncFolderPair syncs a specific folder pair
 func (e *Engine) SyncFolderPair(folderPairID string) error {
+	return e.syncFolderPair(folderPairID, nil)
+}
+
+// VerifyFolderPair discards the cached hashes of a folder pair so every file
+// is read and hashed again, then syncs it
+func (e *Engine) VerifyFolderPair(folderPairID string) error {
+	fp := e.config.Get().GetFolderPair(folderPairID)
+	if fp == nil {
+		return fmt.Errorf("folder pair not found: %s", folderPairID)
+	}
+
+	e.hashCache.Invalidate(fp.LocalPath)
+	return e.syncFolderPair(folderPairID, nil)
+}
+
+// SyncFolderPaths syncs only the given relative paths of a folder pair,
+// and everything below them
+func (e *Engine) SyncFolderPaths(folderPairID string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	return e.syncFolderPair(folderPairID, paths)
+}
+
+// syncFolderPair syncs a folder pair, limited to paths if any are given
+func (e *Engine) syncFolderPair(folderPairID string, paths []string) error {
 	cfg := e.config.Get()
 	fp := cfg.GetFolderPair(folderPairID)
 	if fp == nil {
@@ -444,7 +625,12 @@ func (e *Engine) SyncFolderPair(folderPairID string) error {
 	e.setStatus(StatusScanning, fmt.Sprintf("Scanning %s", fp.LocalPath))
 
 	// Scan local directory
-	localIndex, err := e.scanner.ScanDirectory(fp.LocalPath)
+	scanner := e.scannerFor(fp)
+	localIndex, err := e.scanFolderPairWith(scanner, fp, paths)
+	if errors.Is(err, context.Canceled) {
+		e.setStatus(StatusIdle, "")
+		return fmt.Errorf("scan cancelled: %w", err)
+	}
 	if err != nil {
 		e.setStatus(StatusError, err.Error())
 		return fmt.Errorf("failed to scan local directory: %w", err)
@@ -469,14 +655,23 @@ func (e *Engine) SyncFolderPair(folderPairID string) error {
 		FolderPairID: fp.ID,
 		Index:        localIndex.Files,
 	}
+	indexPayload.Mode = fp.Mode
+	indexPayload.Ignore = scanner.Patterns()
+	indexPayload.GitIgnore = scanner.GitIgnore()
+	indexPayload.Symlinks = fp.Symlinks
+	if fp.Xattrs.Enabled {
+		xattrs := fp.Xattrs
+		indexPayload.Xattrs = &xattrs
+	}
+	if len(paths) > 0 {
+		indexPayload.Index = scopeIndex(localIndex, paths).Files
+		indexPayload.Paths = paths
+	}
 	if err := e.client.SendIndexExchange(conn, indexPayload); err != nil {
 		return fmt.Errorf("failed to send index: %w", err)
 	}
 
-	// Save local index
-	if err := e.indexManager.SaveIndex(fp.ID, localIndex); err != nil {
-		log.Printf("Failed to save index: %v", err)
-	}
+	// The peer compares against its base index and answers with index_ack
 
 	// Update last sync time
 	e.config.Update(func(c *config.Config) {
@@ -523,6 +718,8 @@ func (e *Engine) readConnectionLoop(conn *network.PeerConnection) {
 		delete(e.connections, conn.PeerID)
 		e.mu.Unlock()
 		conn.Close()
+		e.suspendReceivers(conn)
+		e.transfers.Close(conn)
 	}()
 
 	for {
@@ -543,6 +740,8 @@ func (e *Engine) readConnectionLoop(conn *network.PeerConnection) {
 // HandleMessage handles incoming protocol messages
 func (e *Engine) HandleMessage(conn *network.PeerConnection, msg *network.Message) {
 	switch msg.Type {
+	case network.MsgTypeHello:
+		e.handleHello(conn, msg)
 	case network.MsgTypePairingReq:
 		e.handlePairingRequest(conn, msg)
 	case network.MsgTypePairingResp:
@@ -553,14 +752,32 @@ func (e *Engine) HandleMessage(conn *network.PeerConnection, msg *network.Messag
 		e.handleSyncResponse(conn, msg)
 	case network.MsgTypeIndexExchange:
 		e.handleIndexExchange(conn, msg)
+	case network.MsgTypeIndexAck:
+		e.handleIndexAck(conn, msg)
 	case network.MsgTypeFileRequest:
 		e.handleFileRequest(conn, msg)
+	case network.MsgTypeFileOffer:
+		e.handleFileOffer(conn, msg)
+	case network.MsgTypeFileResponse:
+		e.handleFileResponse(conn, msg)
 	case network.MsgTypeFileChunk:
 		e.handleFileChunk(conn, msg)
+	case network.MsgTypeFileDelta:
+		e.handleFileDelta(conn, msg)
+	case network.MsgTypeChunkAck:
+		e.handleChunkAck(conn, msg)
 	case network.MsgTypeFileComplete:
 		e.handleFileComplete(conn, msg)
 	case network.MsgTypeDeleteFile:
 		e.handleDeleteFile(conn, msg)
+	case network.MsgTypeDeleteAck:
+		e.handleDeleteAck(conn, msg)
+	case network.MsgTypeMoveFile:
+		e.handleMoveFile(conn, msg)
+	case network.MsgTypeSymlink:
+		e.handleSymlink(conn, msg)
+	case network.MsgTypeDirectory:
+		e.handleDirectory(conn, msg)
 	case network.MsgTypePing:
 		e.client.SendPong(conn)
 	case network.MsgTypeFolderPairSync:
@@ -581,6 +798,14 @@ func (e *Engine) OnConnect(conn *network.PeerConnection) {
 		conn.Paired = true
 	}
 
+	// A peer that advertised codecs expects our hello to learn which of
+	// them it may send with; older peers don't expect one
+	if conn.Compression() != "" {
+		if err := e.client.SendHello(conn); err != nil {
+			log.Printf("Failed to answer hello from %s: %v", conn.PeerName, err)
+		}
+	}
+
 	if e.onPeerChange != nil {
 		e.onPeerChange()
 	}
@@ -590,11 +815,30 @@ func (e *Engine) OnConnect(conn *network.PeerConnection) {
 func (e *Engine) OnDisconnect(conn *network.PeerConnection) {
 	log.Printf("Peer disconnected: %s (%s)", conn.PeerName, conn.PeerID)
 
+	e.suspendReceivers(conn)
+	e.transfers.Close(conn)
+
 	if e.onPeerChange != nil {
 		e.onPeerChange()
 	}
 }
 
+// handleHello handles the answer to our hello from the peer we connected
+// to, picking the codec to compress the data we send it with. Peers
+// speaking an incompatible protocol are disconnected.
+func (e *Engine) handleHello(conn *network.PeerConnection, msg *network.Message) {
+	var hello network.HelloPayload
+	if err := msg.ParsePayload(&hello); err != nil {
+		return
+	}
+	if !network.CompatibleProtocol(hello.Protocol) {
+		log.Printf("Disconnecting %s: it speaks protocol %q, expected %s", conn.PeerName, hello.Protocol, network.ProtocolVersion)
+		conn.Close()
+		return
+	}
+	conn.SetCompression(network.NegotiateCompression(hello.Compression))
+}
+
 // handlePeerFound is called when a peer is discovered via mDNS
 func (e *Engine) handlePeerFound(peer *models.Peer) {
 	// Check if already paired
@@ -760,7 +1004,7 @@ func (e *Engine) handleSyncRequest(conn *network.PeerConnection, msg *network.Me
 	}
 
 	respMsg, _ := network.NewMessage(network.MsgTypeSyncResponse, respPayload)
-	conn.WriteMessage(respMsg)
+	conn.QueueMessage(respMsg)
 }
 
 // handleSyncResponse handles a sync response
@@ -792,7 +1036,8 @@ func (e *Engine) handleIndexExchange(conn *network.PeerConnection, msg *network.
 	}
 
 	// Scan our local directory
-	localIndex, err := e.scanner.ScanDirectory(fp.LocalPath)
+	scanner := e.scannerFor(fp)
+	localIndex, err := e.scanFolderPairWith(scanner, fp, payload.Paths)
 	if err != nil {
 		log.Printf("Failed to scan local directory: %v", err)
 		return
@@ -801,20 +1046,102 @@ func (e *Engine) handleIndexExchange(conn *network.PeerConnection, msg *network.
 	// Build remote index
 	remoteIndex := &models.FileIndex{
 		FolderPath: fp.RemotePath,
-		Files:      payload.Index,
+		Files:      cleanPeerFiles(payload.Index),
+	}
+	if err := e.indexManager.SaveIndex(remoteIndexKey(fp.ID), remoteIndex); err != nil {
+		log.Printf("Failed to save remote index: %v", err)
+	}
+
+	// The last agreed index is the common ancestor for this comparison
+	baseIndex, err := e.indexManager.LoadIndex(fp.ID)
+	if err != nil {
+		log.Printf("Failed to load base index: %v", err)
+	}
+
+	// Only compare paths within the sync's scope that neither side
+	// excludes; the rest is left alone on both sides
+	peerScanner := NewScanner(payload.Ignore)
+	if payload.GitIgnore {
+		// .gitignore files sync like any other file, so our copies stand
+		// in for the peer's
+		peerScanner.SetGitIgnore(fp.LocalPath)
 	}
+	keepLinks := fp.Symlinks == models.SymlinkPreserve && payload.Symlinks == models.SymlinkPreserve
+	compared := func(path string, info *models.FileInfo) bool {
+		if len(payload.Paths) > 0 && !inScope(path, payload.Paths) {
+			return false
+		}
+		if info.IsSymlink() && !keepLinks {
+			// Only synced as links when both sides keep them
+			return false
+		}
+		return !scanner.isExcludedPath(path, info.IsDir) && !peerScanner.isExcludedPath(path, info.IsDir)
+	}
+	compareLocal := filterIndex(localIndex, compared)
+	compareBase := filterIndex(baseIndex, compared)
+	remoteIndex = filterIndex(remoteIndex, compared)
+
+	// Extended attributes are compared by the names both sides sync
+	xattrs := newXattrFilter(fp.Xattrs).intersect(payload.Xattrs)
+	compareLocal = scopeXattrs(compareLocal, xattrs)
+	compareBase = scopeXattrs(compareBase, xattrs)
+	remoteIndex = scopeXattrs(remoteIndex, xattrs)
 
 	// Compare indices
-	actions := CompareIndices(localIndex, remoteIndex)
+	actions := CompareIndicesWithModes(compareLocal, remoteIndex, compareBase, fp.Mode, payload.Mode)
+
+	// Agree on the new base before any transfer starts. Entries for files
+	// still in flight are added once each transfer is confirmed.
+	agreed := BuildBaseIndex(compareLocal, remoteIndex)
+	keepRefusedBase(agreed, compareBase, compareLocal, remoteIndex, fp.Mode, payload.Mode)
+	newBase := rebaseIndex(baseIndex, agreed, compared)
+	if err := e.indexManager.SaveIndex(fp.ID, newBase); err != nil {
+		log.Printf("Failed to save base index: %v", err)
+	}
+	e.adoptBaseVersions(fp, newBase)
+	ackPayload := &network.IndexExchangePayload{
+		FolderPairID: fp.ID,
+		Index:        newBase.Files,
+	}
+	for _, action := range actions {
+		// Our edit wins; the peer keeps its version before receiving ours
+		if action.Conflict && action.Action == models.FileActionPush {
+			ackPayload.Conflicts = append(ackPayload.Conflicts, action.LocalFile.Path)
+		}
+	}
+	if err := e.client.SendIndexAck(conn, ackPayload); err != nil {
+		log.Printf("Failed to send index ack: %v", err)
+		return
+	}
+
+	go e.runActions(conn, fp, actions)
+}
+
+// runActions carries out the actions of a sync with the peer. Deletes and
+// moves run in order, while file transfers are handed to the transfer
+// scheduler, which keeps a bounded number in flight. It returns once every
+// transfer has finished.
+func (e *Engine) runActions(conn *network.PeerConnection, fp *models.FolderPair, actions []*models.SyncAction) {
+	unlock := e.transfers.LockPair(fp.ID)
+	defer unlock()
+
+	// Files that only differ by case can't both exist here
+	if caseInsensitive(fp.LocalPath) {
+		var collided map[*models.SyncAction]string
+		actions, collided = caseCollisions(actions)
+		for action, existing := range collided {
+			e.refuseCaseCollision(conn, fp, action.RemoteFile.Path, existing)
+		}
+	}
 
 	// Calculate total files and bytes for sync
 	totalFiles := 0
 	var totalBytes int64
 	for _, action := range actions {
-		if action.Action == models.FileActionPush && action.LocalFile != nil && !action.LocalFile.IsDir {
+		if action.Action == models.FileActionPush && action.LocalFile != nil && !action.LocalFile.IsDir && !action.LocalFile.IsSymlink() {
 			totalFiles++
 			totalBytes += action.LocalFile.Size
-		} else if action.Action == models.FileActionPull && action.RemoteFile != nil && !action.RemoteFile.IsDir {
+		} else if action.Action == models.FileActionPull && action.RemoteFile != nil && !action.RemoteFile.IsDir && !action.RemoteFile.IsSymlink() {
 			totalFiles++
 			totalBytes += action.RemoteFile.Size
 		}
@@ -825,59 +1152,400 @@ func (e *Engine) handleIndexExchange(conn *network.PeerConnection, msg *network.
 		e.NotifySyncStart(totalFiles, totalBytes)
 	}
 
-	// Execute actions
+	var transfers sync.WaitGroup
 	for _, action := range actions {
+		if action.Conflict {
+			e.recordConflict(conn, fp, action)
+		}
+
+		var err error
 		switch action.Action {
 		case models.FileActionPush:
-			e.pushFile(conn, fp, action.LocalFile)
+			if action.LocalFile.IsDir {
+				e.pushDirectory(conn, fp, action.LocalFile)
+				continue
+			}
+			if action.LocalFile.IsSymlink() {
+				e.pushSymlink(conn, fp, action.LocalFile)
+				continue
+			}
+			file := action.LocalFile
+			err = e.scheduleTransfer(conn, fp, file, "push", &transfers, func() error {
+				e.pushFile(conn, fp, file)
+				return nil
+			})
 		case models.FileActionPull:
-			e.pullFile(conn, fp, action.RemoteFile)
+			if action.RemoteFile.IsDir {
+				e.pullFile(conn, fp, action.RemoteFile)
+				continue
+			}
+			if action.RemoteFile.IsSymlink() {
+				e.pullSymlink(conn, fp, action.RemoteFile)
+				continue
+			}
+			file := action.RemoteFile
+			err = e.scheduleTransfer(conn, fp, file, "pull", &transfers, func() error {
+				return e.requestFile(conn, fp, file)
+			})
+		case models.FileActionDelete:
+			if action.LocalFile != nil {
+				e.deleteLocalFile(conn, fp, action.LocalFile)
+			} else {
+				e.deleteRemoteFile(conn, fp, action.RemoteFile)
+			}
+		case models.FileActionMove:
+			if action.LocalFile != nil {
+				e.moveRemoteFile(conn, fp, action)
+			} else {
+				e.moveLocalFile(conn, fp, action)
+			}
+		}
+		if err != nil {
+			log.Printf("Sync of %s stopped: %v", fp.ID, err)
+			break
 		}
 	}
+	transfers.Wait()
 
 	// Notify sync end
 	if totalFiles > 0 {
 		e.NotifySyncEnd()
 	}
+}
 
-	// Send our index back
-	indexPayload := &network.IndexExchangePayload{
+// scheduleTransfer queues the transfer of a file, which starts once its
+// turn comes. The transfer is tracked in wg and in the progress aggregator
+// until it finishes.
+func (e *Engine) scheduleTransfer(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo, direction string, wg *sync.WaitGroup, start func() error) error {
+	if e.progressAggregator != nil {
+		e.progressAggregator.QueueFile(fileInfo.Path, fileInfo.Size)
+	}
+
+	wg.Add(1)
+	onDone := func(err error) {
+		if err != nil {
+			log.Printf("Transfer of %s failed: %v", fileInfo.Path, err)
+			if e.progressAggregator != nil {
+				e.progressAggregator.FailFile(fileInfo.Path)
+			}
+		}
+		wg.Done()
+	}
+
+	priority := models.PriorityNormal
+	if isPinned(fp, fileInfo.Path) {
+		priority = models.PriorityHigh
+	}
+	return e.transfers.Schedule(conn, models.QueuedTransfer{
+		ID:           transferKey(fp.ID, fileInfo.Path),
 		FolderPairID: fp.ID,
-		Index:        localIndex.Files,
+		Path:         fileInfo.Path,
+		PeerName:     conn.PeerName,
+		Direction:    direction,
+		Size:         fileInfo.Size,
+		ModTime:      fileInfo.ModTime,
+		Priority:     priority,
+	}, onDone, start)
+}
+
+// isPinned reports whether a path is one of the pair's pinned paths or
+// inside one. Both are compared with forward slashes, as pinned paths may
+// be given with the platform's separator.
+func isPinned(fp *models.FolderPair, relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pinned := range fp.PinnedPaths {
+		pinned = strings.TrimSuffix(filepath.ToSlash(pinned), "/")
+		if relPath == pinned || strings.HasPrefix(relPath, pinned+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleIndexAck stores the base index agreed by the peer that ran the comparison
+func (e *Engine) handleIndexAck(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.IndexExchangePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		log.Printf("Failed to parse index ack: %v", err)
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		log.Printf("Folder pair not found: %s", payload.FolderPairID)
+		return
+	}
+
+	baseIndex := &models.FileIndex{
+		FolderPath: fp.LocalPath,
+		Files:      cleanPeerFiles(payload.Index),
+	}
+	if baseIndex.Files == nil {
+		baseIndex.Files = make(map[string]*models.FileInfo)
+	}
+	if err := e.indexManager.SaveIndex(fp.ID, baseIndex); err != nil {
+		log.Printf("Failed to save base index: %v", err)
+	}
+	// The agreed index is what the peer holds once this sync is done
+	if err := e.indexManager.SaveIndex(remoteIndexKey(fp.ID), baseIndex); err != nil {
+		log.Printf("Failed to save remote index: %v", err)
+	}
+	e.adoptBaseVersions(fp, baseIndex)
+
+	// Our versions of these files lost a conflict and are about to be
+	// overwritten by the peer's
+	for _, path := range payload.Conflicts {
+		e.keepConflictCopy(fp.ID, fp.LocalPath, path, conn.PeerName)
+	}
+}
+
+// recordConflict keeps the losing local version of a conflicting file, or
+// notes that the peer keeps its own losing version
+func (e *Engine) recordConflict(conn *network.PeerConnection, fp *models.FolderPair, action *models.SyncAction) {
+	if action.Action == models.FileActionPull {
+		e.keepConflictCopy(fp.ID, fp.LocalPath, action.LocalFile.Path, conn.PeerName)
+		return
+	}
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "conflict",
+		FolderPair:  fp.ID,
+		FilePath:    action.LocalFile.Path,
+		PeerName:    conn.PeerName,
+		Description: "Conflicting edit on peer kept as a conflict copy there",
+	})
+}
+
+// scanFolderPair scans a folder pair's local directory and assigns version
+// vectors against the previous scan, which is then persisted. When paths
+// are given and a previous scan exists, only those paths are rescanned.
+func (e *Engine) scanFolderPair(fp *models.FolderPair, paths []string) (*models.FileIndex, error) {
+	return e.scanFolderPairWith(e.scannerFor(fp), fp, paths)
+}
+
+// scanFolderPairWith is scanFolderPair using the given scanner
+func (e *Engine) scanFolderPairWith(scanner *Scanner, fp *models.FolderPair, paths []string) (*models.FileIndex, error) {
+	previous, err := e.indexManager.LoadIndex(localIndexKey(fp.ID))
+	if err != nil {
+		log.Printf("Failed to load previous scan: %v", err)
+	}
+
+	e.mu.Lock()
+	e.scans++
+	e.mu.Unlock()
+	defer e.endScan()
+
+	ctx := e.scanContext()
+	var index *models.FileIndex
+	if len(paths) > 0 && previous != nil {
+		index, err = scanner.ScanPaths(ctx, fp.LocalPath, previous, paths)
+	} else {
+		index, err = scanner.ScanDirectory(ctx, fp.LocalPath)
+	}
+
+	// Hashes computed before a cancellation are still worth keeping
+	if err := e.hashCache.Save(); err != nil {
+		log.Printf("Failed to save hash cache: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e.scanner.UpdateVersions(index, previous, e.config.Get().DeviceID)
+	if err := e.indexManager.SaveIndex(localIndexKey(fp.ID), index); err != nil {
+		log.Printf("Failed to save local index: %v", err)
+	}
+
+	// Chunks are indexed again from the new scan when needed
+	e.mu.Lock()
+	delete(e.chunkIndexes, fp.ID)
+	e.mu.Unlock()
+
+	return index, nil
+}
+
+// scannerFor returns a scanner with a folder pair's exclusions: the global
+// patterns, the pair's patterns and the folder's .syncdevignore
+func (e *Engine) scannerFor(fp *models.FolderPair) *Scanner {
+	scanner := NewFolderScanner(fp.LocalPath, e.config.Get().GlobalExclusions, fp.Exclusions)
+	if fp.GitIgnore {
+		scanner.SetGitIgnore(fp.LocalPath)
+	}
+	scanner.SetChunking(fp.ChunkDedup)
+	scanner.SetSymlinks(fp.Symlinks)
+	scanner.SetXattrs(fp.Xattrs)
+	scanner.SetHashCache(e.hashCache)
+	scanner.SetProgressCallback(e.reportScanProgress)
+	return scanner
+}
+
+// scanContext returns the context for scans, which is cancelled by Stop and
+// by CancelScan
+func (e *Engine) scanContext() context.Context {
+	e.scanMu.Lock()
+	defer e.scanMu.Unlock()
+
+	if e.scanCtx == nil || e.scanCtx.Err() != nil {
+		e.scanCtx, e.scanCancel = context.WithCancel(e.ctx)
+	}
+	return e.scanCtx
+}
+
+// CancelScan aborts the scans in progress. Later scans start normally.
+func (e *Engine) CancelScan() {
+	e.scanMu.Lock()
+	defer e.scanMu.Unlock()
+
+	if e.scanCancel != nil {
+		e.scanCancel()
+	}
+}
+
+// reportScanProgress shows scan progress through the status callback,
+// unless the status tells of something else under way
+func (e *Engine) reportScanProgress(p *models.ScanProgress) {
+	if p.Done {
+		return
+	}
+	e.mu.Lock()
+	shown := e.status == StatusIdle || e.status == StatusScanning
+	if e.status == StatusIdle {
+		e.scanShown = true
+	}
+	e.mu.Unlock()
+	if shown {
+		e.setStatus(StatusScanning, fmt.Sprintf("Scanning %s: %d files (%.1f MB)",
+			p.RootPath, p.Files, float64(p.Bytes)/(1024*1024)))
+	}
+}
+
+// endScan returns the status to idle once the last scan under way is done,
+// if scan progress replaced it and nothing changed it since
+func (e *Engine) endScan() {
+	e.mu.Lock()
+	e.scans--
+	idle := e.scans == 0 && e.scanShown && e.status == StatusScanning
+	if e.scans == 0 {
+		e.scanShown = false
+	}
+	e.mu.Unlock()
+	if idle {
+		e.setStatus(StatusIdle, "")
+	}
+}
+
+// localVersion returns the version vector of a local file, bumped if the
+// file changed since the last scan
+func (e *Engine) localVersion(fp *models.FolderPair, fileInfo *models.FileInfo) models.VersionVector {
+	var prev *models.FileInfo
+	if previous, _ := e.indexManager.LoadIndex(localIndexKey(fp.ID)); previous != nil {
+		prev = previous.Files[fileInfo.Path]
+	}
+	return nextVersion(fileInfo, prev, e.config.Get().DeviceID)
+}
+
+// adoptBaseVersions takes over the merged version vectors of an agreed base
+// index for local files whose content matches it
+func (e *Engine) adoptBaseVersions(fp *models.FolderPair, base *models.FileIndex) {
+	local, err := e.indexManager.LoadIndex(localIndexKey(fp.ID))
+	if err != nil || local == nil {
+		return
+	}
+
+	updates := make(map[string]*models.FileInfo)
+	for path, agreed := range base.Files {
+		current, ok := local.Files[path]
+		if !ok || !sameContent(current, agreed) || current.Version.Compare(agreed.Version) == models.VersionEqual {
+			continue
+		}
+		updated := *current
+		updated.Version = agreed.Version.Merge(current.Version)
+		updates[path] = &updated
+	}
+
+	if len(updates) == 0 {
+		return
+	}
+	if err := e.indexManager.UpdateIndex(localIndexKey(fp.ID), updates); err != nil {
+		log.Printf("Failed to update local index: %v", err)
+	}
+}
+
+// reportProgress publishes per-file transfer progress
+func (e *Engine) reportProgress(p *models.TransferProgress) {
+	e.mu.Lock()
+	e.progress = p
+	e.mu.Unlock()
+
+	// Legacy callback for backward compatibility
+	if e.onProgress != nil {
+		e.onProgress(p)
 	}
-	e.client.SendIndexExchange(conn, indexPayload)
 
-	// Save updated index
-	e.indexManager.SaveIndex(fp.ID, localIndex)
+	// Feed progress to aggregator
+	if e.progressAggregator != nil {
+		e.progressAggregator.UpdateFile(p.FileName, p.TotalBytes, p.TransferBytes)
+		if p.CompressionRatio > 0 {
+			e.progressAggregator.SetCompressionRatio(p.FileName, p.CompressionRatio)
+		}
+	}
 }
 
-// pushFile sends a file to the peer
+// pushFile sends a file to the peer. Large files are offered instead, so
+// the peer can request them from where an earlier download stopped or as
+// a delta against its copy.
 func (e *Engine) pushFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
 	if fileInfo.IsDir {
-		// Just notify about directory
+		e.pushDirectory(conn, fp, fileInfo)
 		return
 	}
 
-	tm := NewTransferManager(fp.LocalPath, e.scanner)
-
-	progressCb := func(p *models.TransferProgress) {
+	if fileInfo.Size >= offerSize {
+		key := transferKey(fp.ID, fileInfo.Path)
 		e.mu.Lock()
-		e.progress = p
+		e.offers[key] = conn
+		delete(e.withdrawn, key)
 		e.mu.Unlock()
 
-		// Legacy callback for backward compatibility
-		if e.onProgress != nil {
-			e.onProgress(p)
-		}
-
-		// Feed progress to aggregator
-		if e.progressAggregator != nil {
-			e.progressAggregator.UpdateFile(p.FileName, p.TotalBytes, p.TransferBytes)
+		err := e.client.SendFileOffer(conn, &network.FileResponsePayload{
+			FolderPairID: fp.ID,
+			FilePath:     fileInfo.Path,
+			Size:         fileInfo.Size,
+			Hash:         fileInfo.Hash,
+			Version:      fileInfo.Version,
+			ModTime:      fileInfo.ModTime,
+			Permission:   fileInfo.Permission,
+			Chunks:       fileInfo.Chunks,
+			Xattrs:       fileInfo.Xattrs,
+		})
+		if err == nil {
+			return
 		}
+		log.Printf("Failed to offer %s, sending it instead: %v", fileInfo.Path, err)
+		e.mu.Lock()
+		delete(e.offers, key)
+		e.mu.Unlock()
 	}
 
-	if err := tm.SendFile(conn, fp.ID, fileInfo.Path, progressCb); err != nil {
+	e.sendFile(conn, fp, fileInfo, nil)
+}
+
+// sendFile sends a file to the peer the way req asks for it, or in full
+// if req is nil, reporting progress and the outcome
+func (e *Engine) sendFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo, req *TransferRequest) {
+	tm := e.transferManager(conn, fp)
+	tm.ctx = e.transfers.Context(conn, transferKey(fp.ID, fileInfo.Path))
+
+	if err := tm.Send(conn, fp.ID, fileInfo, req, e.reportProgress); err != nil {
+		if errors.Is(err, context.Canceled) {
+			// Canceled or ended by the scheduler, which reported it
+			log.Printf("Push of %s stopped", fileInfo.Path)
+			return
+		}
 		log.Printf("Failed to push file %s: %v", fileInfo.Path, err)
+		e.transfers.Done(conn, transferKey(fp.ID, fileInfo.Path), err)
 		e.addEvent(&SyncEvent{
 			Time:        time.Now(),
 			Type:        "error",
@@ -904,141 +1572,1208 @@ func (e *Engine) pushFile(conn *network.PeerConnection, fp *models.FolderPair, f
 	})
 }
 
+// transferManager returns a TransferManager for a folder pair whose sends
+// to conn stay within the connection's chunk window and bandwidth limits
+// and are compressed with the codec negotiated with the peer
+func (e *Engine) transferManager(conn *network.PeerConnection, fp *models.FolderPair) *TransferManager {
+	tm := NewTransferManager(fp.LocalPath, e.scanner)
+	tm.window = e.transfers.window(conn)
+	tm.compression = conn.Compression()
+	tm.upload = e.bandwidth.uploadTo(conn.PeerID)
+	tm.xattrs = newXattrFilter(fp.Xattrs)
+	return tm
+}
+
 // pullFile requests a file from the peer
 func (e *Engine) pullFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
 	if fileInfo.IsDir {
-		// Create directory locally
-		dirPath := filepath.Join(fp.LocalPath, fileInfo.Path)
-		os.MkdirAll(dirPath, os.FileMode(fileInfo.Permission))
+		e.createDirectory(conn, fp, fileInfo.Path, fileInfo.Permission, fileInfo.Version)
 		return
 	}
 
-	if err := e.client.SendFileRequest(conn, fp.ID, fileInfo.Path, 0); err != nil {
+	if err := e.requestFile(conn, fp, fileInfo); err != nil {
 		log.Printf("Failed to request file %s: %v", fileInfo.Path, err)
 	}
 }
 
-// handleFileRequest handles a file request from a peer
-func (e *Engine) handleFileRequest(conn *network.PeerConnection, msg *network.Message) {
-	var payload network.FileRequestPayload
+// requestFile asks the peer for a file, resuming an earlier download of it
+// if possible. Otherwise a pair that dedups chunks builds what it can from
+// local chunks first, and the file is requested as a delta against our
+// copy if both are large enough.
+func (e *Engine) requestFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) error {
+	if err := checkLocalPath(fp.LocalPath, fileInfo.Path); err != nil {
+		e.refuseOutsidePath(conn, fp, fileInfo.Path)
+		return err
+	}
+	if existing := e.caseCollision(fp, fileInfo.Path); existing != "" {
+		e.refuseCaseCollision(conn, fp, fileInfo.Path, existing)
+		return errCaseCollision
+	}
+
+	e.mu.Lock()
+	delete(e.canceled, transferKey(fp.ID, fileInfo.Path))
+	e.mu.Unlock()
+
+	if offset := e.resumeOffset(fp, fileInfo); offset > 0 {
+		return e.client.SendFileRequest(conn, fp.ID, fileInfo.Path, offset)
+	}
+
+	if fp.ChunkDedup {
+		if requested, err := e.requestChunks(conn, fp, fileInfo); requested || err != nil {
+			return err
+		}
+	}
+
+	localPath := diskPath(fp.LocalPath, fileInfo.Path)
+	if info, err := os.Lstat(localPath); err == nil && info.Mode().IsRegular() && info.Size() >= deltaMinSize && fileInfo.Size >= deltaMinSize {
+		sigs, err := fileSignatures(localPath)
+		if err == nil {
+			return e.client.SendDeltaRequest(conn, fp.ID, fileInfo.Path, sigs.BlockSize, sigs.Blocks)
+		}
+		log.Printf("Failed to sign %s, requesting the whole file: %v", fileInfo.Path, err)
+	}
+
+	return e.client.SendFileRequest(conn, fp.ID, fileInfo.Path, 0)
+}
+
+// requestChunks builds a file from the chunks of it that local files have
+// and asks the peer only for the rest. It reports false, without error, if
+// no chunk was found locally and the file has to be requested otherwise.
+func (e *Engine) requestChunks(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) (bool, error) {
+	if len(fileChunks(fileInfo)) == 0 {
+		return false, nil
+	}
+
+	key := transferKey(fp.ID, fileInfo.Path)
+	e.mu.Lock()
+	previous := e.fileReceivers[key]
+	delete(e.fileReceivers, key)
+	e.mu.Unlock()
+	if previous != nil {
+		e.suspendReceiver(key, previous)
+	}
+
+	receiver, missing, err := NewChunkReceiver(fp.LocalPath, fileInfo, e.chunkIndexFor(fp), e.reportProgress)
+	if err != nil {
+		log.Printf("Failed to build %s from local chunks: %v", fileInfo.Path, err)
+		return false, nil
+	}
+	receiver.conn = conn
+
+	if len(missing) == 0 {
+		e.finishReceiver(conn, fp.ID, key, receiver)
+		return true, nil
+	}
+	if len(missing) == 1 && missing[0].Size == fileInfo.Size {
+		receiver.Abort()
+		return false, nil
+	}
+
+	e.mu.Lock()
+	e.fileReceivers[key] = receiver
+	e.mu.Unlock()
+	return true, e.client.SendRangeRequest(conn, fp.ID, fileInfo.Path, fileInfo.Hash, missing)
+}
+
+// chunkIndexFor returns the index of the chunks in a folder pair's local
+// files, building it from the last scan
+func (e *Engine) chunkIndexFor(fp *models.FolderPair) *chunkIndex {
+	e.mu.RLock()
+	ci := e.chunkIndexes[fp.ID]
+	e.mu.RUnlock()
+	if ci != nil {
+		return ci
+	}
+
+	local, err := e.indexManager.LoadIndex(localIndexKey(fp.ID))
+	if err != nil {
+		log.Printf("Failed to load local index: %v", err)
+	}
+	ci = newChunkIndex(local)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if existing := e.chunkIndexes[fp.ID]; existing != nil {
+		return existing
+	}
+	e.chunkIndexes[fp.ID] = ci
+	return ci
+}
+
+// resumeOffset returns where a download of fileInfo can resume, dropping
+// the saved state of an earlier download if the file changed since
+func (e *Engine) resumeOffset(fp *models.FolderPair, fileInfo *models.FileInfo) int64 {
+	key := transferKey(fp.ID, fileInfo.Path)
+	partial := e.partials.Get(key)
+	if partial == nil {
+		return 0
+	}
+	if partial.Hash != fileInfo.Hash || partial.Size != fileInfo.Size {
+		e.partials.Remove(key)
+		return 0
+	}
+	return partial.Received
+}
+
+// deleteLocalFile removes a local file that was deleted on the peer
+func (e *Engine) deleteLocalFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
+	if err := e.deleteLocal(fp, fileInfo.Path); err != nil {
+		log.Printf("Failed to delete file %s: %v", fileInfo.Path, err)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    fileInfo.Path,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Delete failed: %v", err),
+		})
+		return
+	}
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "delete",
+		FolderPair:  fp.ID,
+		FilePath:    fileInfo.Path,
+		PeerName:    conn.PeerName,
+		Description: "File deleted (removed on peer)",
+	})
+}
+
+// deleteLocal removes a file or directory of a folder pair. Directories
+// are only removed once nothing the pair syncs is left in them.
+func (e *Engine) deleteLocal(fp *models.FolderPair, relPath string) error {
+	if err := checkLocalPath(fp.LocalPath, relPath); err != nil {
+		return err
+	}
+	fullPath := diskPath(fp.LocalPath, relPath)
+	if info, err := os.Lstat(fullPath); err == nil && info.IsDir() {
+		return DeleteDirectory(e.scannerFor(fp), fp.LocalPath, relPath)
+	}
+	return DeleteFile(fullPath)
+}
+
+// deleteRemoteFile asks the peer to remove a file that was deleted locally
+func (e *Engine) deleteRemoteFile(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
+	if err := e.client.SendDeleteFile(conn, fp.ID, fileInfo.Path); err != nil {
+		log.Printf("Failed to request deletion of %s: %v", fileInfo.Path, err)
+	}
+}
+
+// moveLocalFile renames a local file that was moved on the peer, falling
+// back to requesting the content if the rename is not possible
+func (e *Engine) moveLocalFile(conn *network.PeerConnection, fp *models.FolderPair, action *models.SyncAction) {
+	remote := action.RemoteFile
+	if err := e.renameLocal(fp, action.FromPath, remote.Path, remote.Hash); err != nil {
+		log.Printf("Failed to move %s to %s, requesting it instead: %v", action.FromPath, remote.Path, err)
+		e.pullFile(conn, fp, remote)
+		return
+	}
+
+	e.confirmReceivedFile(conn, fp.ID, remote)
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "move",
+		FolderPair:  fp.ID,
+		FilePath:    remote.Path,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("File moved from %s (moved on peer)", action.FromPath),
+	})
+}
+
+// moveRemoteFile asks the peer to rename a file that was moved locally
+func (e *Engine) moveRemoteFile(conn *network.PeerConnection, fp *models.FolderPair, action *models.SyncAction) {
+	local := action.LocalFile
+	err := e.client.SendMoveFile(conn, &network.MoveFilePayload{
+		FolderPairID: fp.ID,
+		FromPath:     action.FromPath,
+		ToPath:       local.Path,
+		Hash:         local.Hash,
+		Version:      local.Version,
+	})
+	if err != nil {
+		log.Printf("Failed to request move of %s, sending it instead: %v", action.FromPath, err)
+		e.pushFile(conn, fp, local)
+	}
+}
+
+// renameLocal moves fromPath to toPath inside a folder pair if it still
+// has the expected content, and drops the old path from the indices
+func (e *Engine) renameLocal(fp *models.FolderPair, fromPath, toPath, hash string) error {
+	for _, relPath := range []string{fromPath, toPath} {
+		if err := checkLocalPath(fp.LocalPath, relPath); err != nil {
+			return err
+		}
+	}
+	hashed, err := e.scanner.HashFile(diskPath(fp.LocalPath, fromPath))
+	if err != nil {
+		return err
+	}
+	if hashed != hash {
+		return fmt.Errorf("%s changed since it was scanned", fromPath)
+	}
+
+	if err := MoveFile(fp.LocalPath, fromPath, toPath); err != nil {
+		return err
+	}
+
+	removed := map[string]*models.FileInfo{fromPath: nil}
+	if err := e.indexManager.UpdateIndex(fp.ID, removed); err != nil {
+		log.Printf("Failed to update base index: %v", err)
+	}
+	if err := e.indexManager.UpdateIndex(localIndexKey(fp.ID), removed); err != nil {
+		log.Printf("Failed to update local index: %v", err)
+	}
+	return nil
+}
+
+// pushDirectory asks the peer to create a directory that is new locally,
+// or to take over its changed permissions
+func (e *Engine) pushDirectory(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
+	err := e.client.SendDirectory(conn, &network.DirectoryPayload{
+		FolderPairID: fp.ID,
+		FilePath:     fileInfo.Path,
+		Permission:   fileInfo.Permission,
+		Version:      fileInfo.Version,
+	})
+	if err != nil {
+		log.Printf("Failed to send directory %s: %v", fileInfo.Path, err)
+	}
+}
+
+// handleDirectory creates a directory the peer sent, or updates its
+// permissions
+func (e *Engine) handleDirectory(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.DirectoryPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		return
+	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FilePath, "directory")
+		return
+	}
+	if checkRelPath(payload.FilePath) != nil {
+		e.refuseOutsidePath(conn, fp, payload.FilePath)
+		return
+	}
+
+	e.createDirectory(conn, fp, payload.FilePath, payload.Permission, payload.Version)
+}
+
+// createDirectory creates a directory of a folder pair with the given
+// permissions, or updates the permissions of the existing one, and
+// confirms it to the peer
+func (e *Engine) createDirectory(conn *network.PeerConnection, fp *models.FolderPair, relPath string, permission uint32, version models.VersionVector) {
+	fullPath := diskPath(fp.LocalPath, relPath)
+	_, statErr := os.Stat(fullPath)
+	err := checkLocalPath(fp.LocalPath, relPath)
+	if err == nil {
+		err = CreateDirectory(fullPath, os.FileMode(permission))
+	}
+	if err != nil {
+		log.Printf("Failed to create directory %s: %v", relPath, err)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    relPath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Folder not created: %v", err),
+		})
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: fp.ID,
+			FilePath:     relPath,
+			Error:        err.Error(),
+		})
+		return
+	}
+
+	e.confirmReceivedFile(conn, fp.ID, &models.FileInfo{
+		Path:    relPath,
+		IsDir:   true,
+		Version: version,
+	})
+
+	description := "Folder created"
+	if statErr == nil {
+		description = "Folder permissions updated"
+	}
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "pull",
+		FolderPair:  fp.ID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: description,
+	})
+}
+
+// localFileInfo returns the entry of a local file of a folder pair as the
+// pair's scans see it
+func (e *Engine) localFileInfo(fp *models.FolderPair, relPath string) (*models.FileInfo, error) {
+	fullPath := diskPath(fp.LocalPath, relPath)
+	if fp.Symlinks == models.SymlinkPreserve {
+		info, err := os.Lstat(fullPath)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return symlinkInfo(fp.LocalPath, relPath, info)
+		}
+	}
+
+	// The pair's scanner records chunks if the pair dedups them
+	fileInfo, err := e.scannerFor(fp).GetFileInfo(fp.LocalPath, relPath)
+	if err == nil && !fileInfo.IsDir {
+		newXattrFilter(fp.Xattrs).apply(fileInfo, fullPath)
+	}
+	return fileInfo, err
+}
+
+// pushSymlink asks the peer to create a symlink that is new or changed
+// locally
+func (e *Engine) pushSymlink(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
+	err := e.client.SendSymlink(conn, &network.SymlinkPayload{
+		FolderPairID: fp.ID,
+		FilePath:     fileInfo.Path,
+		Target:       fileInfo.LinkTarget,
+		Version:      fileInfo.Version,
+	})
+	if err != nil {
+		log.Printf("Failed to send symlink %s: %v", fileInfo.Path, err)
+		return
+	}
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "push",
+		FolderPair:  fp.ID,
+		FilePath:    fileInfo.Path,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("Symlink to %s sent", fileInfo.LinkTarget),
+	})
+}
+
+// pullSymlink creates a symlink that is new or changed on the peer
+func (e *Engine) pullSymlink(conn *network.PeerConnection, fp *models.FolderPair, fileInfo *models.FileInfo) {
+	e.createSymlink(conn, fp, fileInfo.Path, fileInfo.LinkTarget, fileInfo.Version)
+}
+
+// handleSymlink creates a symlink the peer sent
+func (e *Engine) handleSymlink(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.SymlinkPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	// The peer holds a transfer slot until the link is answered
+	refuse := func(err error) {
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: payload.FolderPairID,
+			FilePath:     payload.FilePath,
+			Error:        err.Error(),
+		})
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		refuse(fmt.Errorf("folder pair not found: %s", payload.FolderPairID))
+		return
+	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FilePath, "symlink")
+		refuse(fmt.Errorf("folder is %s", fp.Mode))
+		return
+	}
+	if fp.Symlinks != models.SymlinkPreserve {
+		log.Printf("Refused incoming symlink %s: folder doesn't keep symlinks", payload.FilePath)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    payload.FilePath,
+			PeerName:    conn.PeerName,
+			Description: "Incoming symlink refused: folder doesn't keep symlinks",
+		})
+		refuse(errors.New("folder doesn't keep symlinks"))
+		return
+	}
+	if err := checkRelPath(payload.FilePath); err != nil {
+		e.refuseOutsidePath(conn, fp, payload.FilePath)
+		refuse(err)
+		return
+	}
+
+	e.createSymlink(conn, fp, payload.FilePath, payload.Target, payload.Version)
+}
+
+// createSymlink makes relPath a symlink to target and confirms it to the
+// peer. Targets outside the folder are refused.
+func (e *Engine) createSymlink(conn *network.PeerConnection, fp *models.FolderPair, relPath, target string, version models.VersionVector) {
+	if existing := e.caseCollision(fp, relPath); existing != "" {
+		e.refuseCaseCollision(conn, fp, relPath, existing)
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: fp.ID,
+			FilePath:     relPath,
+			Error:        errCaseCollision.Error(),
+		})
+		return
+	}
+	err := checkLocalPath(fp.LocalPath, relPath)
+	if err == nil {
+		err = CreateSymlink(fp.LocalPath, relPath, target)
+	}
+	if err != nil {
+		log.Printf("Failed to create symlink %s: %v", relPath, err)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    relPath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Symlink to %s refused: %v", target, err),
+		})
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: fp.ID,
+			FilePath:     relPath,
+			Error:        err.Error(),
+		})
+		return
+	}
+
+	e.confirmReceivedFile(conn, fp.ID, &models.FileInfo{
+		Path:       relPath,
+		Hash:       linkHash(target),
+		Version:    version,
+		LinkTarget: target,
+	})
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "pull",
+		FolderPair:  fp.ID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("Symlink to %s created", target),
+	})
+}
+
+// handleFileRequest handles a file request from a peer. The file is sent
+// in the background so the connection keeps reading the acknowledgements
+// its chunk window waits for.
+func (e *Engine) handleFileRequest(conn *network.PeerConnection, msg *network.Message) {
+	go e.serveFileRequest(conn, msg)
+}
+
+// serveFileRequest sends the file a peer requested, or why it can't
+func (e *Engine) serveFileRequest(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.FileRequestPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		e.refuseFileRequest(conn, payload.FolderPairID, payload.FilePath, fmt.Errorf("folder pair not found: %s", payload.FolderPairID))
+		return
+	}
+	if err := checkRelPath(payload.FilePath); err != nil {
+		e.refuseFileRequest(conn, fp.ID, payload.FilePath, err)
+		return
+	}
+
+	fileInfo, err := e.servedFileInfo(fp, payload.FilePath)
+	if err != nil {
+		e.refuseFileRequest(conn, fp.ID, payload.FilePath, err)
+		return
+	}
+
+	fileInfo.Version = e.localVersion(fp, fileInfo)
+
+	req := &TransferRequest{
+		Offset: payload.Offset,
+		Ranges: payload.Ranges,
+		Hash:   payload.Hash,
+	}
+	// A request with block signatures asks for a delta
+	if payload.BlockSize > 0 {
+		blocks, err := network.DecodeSignatures(msg.Data)
+		if err != nil {
+			log.Printf("Invalid signatures for %s, sending the whole file: %v", payload.FilePath, err)
+		} else {
+			req.Signatures = &Signatures{BlockSize: payload.BlockSize, Blocks: blocks}
+		}
+	}
+
+	// Files we offered are pushes, reported like any other
+	key := transferKey(fp.ID, payload.FilePath)
+	e.mu.Lock()
+	offered := e.offers[key] == conn
+	delete(e.offers, key)
+	withdrawn := e.withdrawn[key] == conn
+	delete(e.withdrawn, key)
+	e.mu.Unlock()
+	if withdrawn {
+		e.refuseFileRequest(conn, fp.ID, payload.FilePath, errTransferCanceled)
+		return
+	}
+	if offered {
+		e.sendFile(conn, fp, fileInfo, req)
+		return
+	}
+
+	// Send file response and chunks
+	tm := e.transferManager(conn, fp)
+	if err := tm.Send(conn, fp.ID, fileInfo, req, nil); err != nil {
+		log.Printf("Failed to send file %s: %v", payload.FilePath, err)
+	}
+}
+
+// refuseFileRequest answers a file request with why the file isn't sent
+func (e *Engine) refuseFileRequest(conn *network.PeerConnection, folderPairID, relPath string, err error) {
+	respPayload := &network.FileResponsePayload{
+		FolderPairID: folderPairID,
+		FilePath:     relPath,
+		Error:        err.Error(),
+	}
+	respMsg, _ := network.NewMessage(network.MsgTypeFileResponse, respPayload)
+	conn.QueueMessage(respMsg)
+}
+
+// servedFileInfo returns the entry of the local file relPath for a peer
+// that asked for it, refusing files the folder pair doesn't sync to it
+func (e *Engine) servedFileInfo(fp *models.FolderPair, relPath string) (*models.FileInfo, error) {
+	if !fp.Mode.CanSend() {
+		return nil, fmt.Errorf("folder is %s", fp.Mode)
+	}
+
+	fullPath := diskPath(fp.LocalPath, relPath)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		// Only followed links sync as what they point to
+		if fp.Symlinks != models.SymlinkFollow {
+			return nil, errors.New("path is a symlink")
+		}
+		if info, err = os.Stat(fullPath); err != nil {
+			return nil, err
+		}
+	}
+	if resolved, err := filepath.EvalSymlinks(fullPath); err != nil || !insideRoot(fp.LocalPath, resolved) {
+		return nil, errPathOutsideRoot
+	}
+
+	scanner := e.scannerFor(fp)
+	if scanner.isExcludedPath(relPath, info.IsDir()) {
+		return nil, errors.New("path is excluded from the folder pair")
+	}
+	return scanner.GetFileInfo(fp.LocalPath, relPath)
+}
+
+// handleFileOffer requests a file the peer offers, from where an earlier
+// download of the same content stopped. Offers that aren't requested are
+// answered with a failed file_complete, which ends the peer's push.
+func (e *Engine) handleFileOffer(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.FileResponsePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	refuse := func(err error) {
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: payload.FolderPairID,
+			FilePath:     payload.FilePath,
+			Error:        err.Error(),
+		})
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		refuse(fmt.Errorf("folder pair not found: %s", payload.FolderPairID))
+		return
+	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FilePath, "file")
+		refuse(fmt.Errorf("folder is %s", fp.Mode))
+		return
+	}
+	if err := checkRelPath(payload.FilePath); err != nil {
+		refuse(err)
+		return
+	}
+
+	info := &models.FileInfo{
+		Path:       payload.FilePath,
+		Size:       payload.Size,
+		ModTime:    payload.ModTime,
+		Hash:       payload.Hash,
+		Permission: payload.Permission,
+		Version:    payload.Version,
+		Chunks:     payload.Chunks,
+		Xattrs:     newXattrFilter(fp.Xattrs).only(payload.Xattrs),
+	}
+	if err := e.requestFile(conn, fp, info); err != nil {
+		log.Printf("Failed to request file %s: %v", payload.FilePath, err)
+		refuse(err)
+	}
+}
+
+// handleFileResponse prepares a receiver for the file announced by the peer
+func (e *Engine) handleFileResponse(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.FileResponsePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	if payload.Error != "" {
+		log.Printf("Peer could not send %s: %s", payload.FilePath, payload.Error)
+		e.transfers.Done(conn, transferKey(payload.FolderPairID, payload.FilePath), errors.New(payload.Error))
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  payload.FolderPairID,
+			FilePath:    payload.FilePath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Pull failed: %s", payload.Error),
+		})
+		return
+	}
+	if e.pullCanceled(conn, transferKey(payload.FolderPairID, payload.FilePath)) {
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		return
+	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FilePath, "file")
+		e.transfers.Done(conn, transferKey(fp.ID, payload.FilePath), fmt.Errorf("folder is %s", fp.Mode))
+		return
+	}
+
+	if payload.Ranges {
+		e.continueChunkReceiver(conn, fp, &payload)
+		return
+	}
+
+	info := &models.FileInfo{
+		Path:       payload.FilePath,
+		Size:       payload.Size,
+		ModTime:    payload.ModTime,
+		Hash:       payload.Hash,
+		Permission: payload.Permission,
+		Version:    payload.Version,
+		Xattrs:     newXattrFilter(fp.Xattrs).only(payload.Xattrs),
+	}
+	e.startReceiver(conn, fp, info, payload.Offset, payload.BlockSize, payload.Holes)
+}
+
+// continueChunkReceiver lets the file built from local chunks receive the
+// ranges the peer announces. If that file is gone or was built for another
+// version, the whole file is requested instead and the ranges are dropped.
+func (e *Engine) continueChunkReceiver(conn *network.PeerConnection, fp *models.FolderPair, payload *network.FileResponsePayload) {
+	key := transferKey(fp.ID, payload.FilePath)
+
+	e.mu.Lock()
+	receiver := e.fileReceivers[key]
+	if receiver != nil && receiver.Chunked() && receiver.conn == conn && receiver.Info().Hash == payload.Hash {
+		receiver.Info().Xattrs = newXattrFilter(fp.Xattrs).only(payload.Xattrs)
+		e.mu.Unlock()
+		return
+	}
+	delete(e.fileReceivers, key)
+	e.mu.Unlock()
+
+	if receiver != nil {
+		e.suspendReceiver(key, receiver)
+	}
+	if err := e.client.SendFileRequest(conn, fp.ID, payload.FilePath, 0); err != nil {
+		log.Printf("Failed to request file %s: %v", payload.FilePath, err)
+	}
+}
+
+// startReceiver creates the receiver for an incoming file whose chunks
+// start at offset, or that arrives as a delta against blocks of blockSize,
+// replacing any unfinished transfer of the same file. A resumed download
+// that no longer lines up with what the peer sends is requested again from
+// the start. The holes the peer leaves out of the chunks stay holes.
+func (e *Engine) startReceiver(conn *network.PeerConnection, fp *models.FolderPair, info *models.FileInfo, offset int64, blockSize int, holes []network.ByteRange) *FileReceiver {
+	key := transferKey(fp.ID, info.Path)
+	if err := checkLocalPath(fp.LocalPath, info.Path); err != nil {
+		e.refuseOutsidePath(conn, fp, info.Path)
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: fp.ID,
+			FilePath:     info.Path,
+			Error:        err.Error(),
+		})
+		e.transfers.Done(conn, key, err)
+		return nil
+	}
+
+	e.mu.Lock()
+	previous := e.fileReceivers[key]
+	delete(e.fileReceivers, key)
+	e.mu.Unlock()
+	if previous != nil {
+		e.suspendReceiver(key, previous)
+	}
+
+	if existing := e.caseCollision(fp, info.Path); existing != "" {
+		e.refuseCaseCollision(conn, fp, info.Path, existing)
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: fp.ID,
+			FilePath:     info.Path,
+			Error:        errCaseCollision.Error(),
+		})
+		e.transfers.Done(conn, key, errCaseCollision)
+		return nil
+	}
+
+	var receiver *FileReceiver
+	var err error
+	if blockSize > 0 {
+		e.partials.Remove(key)
+		receiver, err = NewDeltaReceiver(fp.LocalPath, info, blockSize, e.reportProgress)
+		if err != nil {
+			// Our copy is gone; the deltas of this stream are dropped
+			log.Printf("Can't apply delta for %s, requesting the whole file: %v", info.Path, err)
+			if err := e.client.SendFileRequest(conn, fp.ID, info.Path, 0); err != nil {
+				log.Printf("Failed to request file %s: %v", info.Path, err)
+			}
+			return nil
+		}
+	} else if offset > 0 {
+		var resumed int64
+		receiver, resumed, err = ResumeFileReceiver(fp.LocalPath, info, e.partials.Get(key), e.reportProgress)
+		if err == nil && resumed != offset {
+			// The file changed since the download started, or the data on
+			// disk didn't verify; chunks of this stream are dropped
+			receiver.Abort()
+			e.partials.Remove(key)
+			if err := e.client.SendFileRequest(conn, fp.ID, info.Path, 0); err != nil {
+				log.Printf("Failed to request file %s: %v", info.Path, err)
+			}
+			return nil
+		}
+	} else {
+		e.partials.Remove(key)
+		receiver, err = NewFileReceiver(fp.LocalPath, info, e.reportProgress)
+	}
+	if err == nil && len(holes) > 0 {
+		if err = receiver.SetHoles(holes); err != nil {
+			receiver.Abort()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to create file receiver: %v", err)
+		e.transfers.Done(conn, key, err)
+		return nil
+	}
+	receiver.conn = conn
+
+	e.mu.Lock()
+	e.fileReceivers[key] = receiver
+	e.mu.Unlock()
+	return receiver
+}
+
+// suspendReceivers stops the downloads arriving over conn, or over every
+// connection if conn is nil, keeping large ones to resume later
+func (e *Engine) suspendReceivers(conn *network.PeerConnection) {
+	suspended := make(map[string]*FileReceiver)
+	e.mu.Lock()
+	for key, receiver := range e.fileReceivers {
+		if conn == nil || receiver.conn == conn {
+			suspended[key] = receiver
+			delete(e.fileReceivers, key)
+		}
+	}
+	for key, offeredTo := range e.offers {
+		if conn == nil || offeredTo == conn {
+			delete(e.offers, key)
+		}
+	}
+	for key, offeredTo := range e.withdrawn {
+		if conn == nil || offeredTo == conn {
+			delete(e.withdrawn, key)
+		}
+	}
+	for key, pulledFrom := range e.canceled {
+		if conn == nil || pulledFrom == conn {
+			delete(e.canceled, key)
+		}
+	}
+	e.mu.Unlock()
+
+	for key, receiver := range suspended {
+		e.suspendReceiver(key, receiver)
+	}
+}
+
+// suspendReceiver stops a download and saves its state if it is kept
+func (e *Engine) suspendReceiver(key string, receiver *FileReceiver) {
+	partial, err := receiver.Suspend()
+	if err != nil {
+		log.Printf("Failed to keep partial download of %s: %v", receiver.Info().Path, err)
+	}
+	if partial == nil {
+		e.partials.Remove(key)
+		return
+	}
+	if err := e.partials.Put(key, partial); err != nil {
+		log.Printf("Failed to save partial download of %s: %v", receiver.Info().Path, err)
+	}
+}
+
+// pullCanceled reports whether the data of the file identified by key,
+// arriving over conn, belongs to a pull canceled since it was requested.
+// Such data is dropped until the file is requested again.
+func (e *Engine) pullCanceled(conn *network.PeerConnection, key string) bool {
+	e.mu.RLock()
+	canceled := e.canceled[key] == conn
+	e.mu.RUnlock()
+	return canceled && !e.transfers.Active(conn, key)
+}
+
+// transferKey identifies the transfer of a file of a folder pair
+func transferKey(folderPairID, relPath string) string {
+	return fmt.Sprintf("%s:%s", folderPairID, relPath)
+}
+
+// handleFileChunk handles an incoming file chunk
+func (e *Engine) handleFileChunk(conn *network.PeerConnection, msg *network.Message) {
+	payload, err := msg.ParseChunk()
+	if err != nil {
+		// Acknowledge it anyway so it doesn't hold a slot of the peer's
+		// chunk window; the file fails verification
+		var header network.FileChunkPayload
+		if msg.ParsePayload(&header) == nil {
+			log.Printf("Invalid chunk of %s: %v", header.FilePath, err)
+			e.ackChunk(conn, header.FolderPairID, header.FilePath)
+			return
+		}
+
+		// Without a header the file it belongs to is unknown; the window
+		// is shared by the peer's files, so an ack for no file frees it
+		log.Printf("Dropped an unreadable chunk from %s: %v", conn.PeerName, err)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Unreadable chunk dropped, its file won't verify: %v", err),
+		})
+		e.ackChunk(conn, "", "")
+		return
+	}
+
+	key := transferKey(payload.FolderPairID, payload.FilePath)
+	e.throttledAck(conn, payload.FolderPairID, payload.FilePath, len(msg.Data))
+
+	if e.pullCanceled(conn, key) {
+		return
+	}
+
+	e.mu.Lock()
+	receiver, exists := e.fileReceivers[key]
+	e.mu.Unlock()
+
+	if !exists {
+		// Chunks of a dropped stream have no receiver and are ignored
+		return
+	}
+
+	receiver.CountWire(len(payload.Data), len(msg.Data))
+	if err := receiver.WriteChunk(payload.Data, payload.Offset); err != nil {
+		log.Printf("Failed to write chunk of %s: %v", payload.FilePath, err)
+		receiver.Abort()
+		e.mu.Lock()
+		delete(e.fileReceivers, key)
+		e.mu.Unlock()
+		e.partials.Remove(key)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  payload.FolderPairID,
+			FilePath:    payload.FilePath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Download failed: %v", err),
+		})
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: payload.FolderPairID,
+			FilePath:     payload.FilePath,
+			Error:        err.Error(),
+		})
+		e.transfers.Done(conn, key, err)
+		return
+	}
+
+	// Save the state now and then so a crash doesn't lose the download
+	if receiver.CheckpointDue() {
+		if partial, err := receiver.Checkpoint(); err == nil {
+			if err := e.partials.Put(key, partial); err != nil {
+				log.Printf("Failed to save partial download of %s: %v", payload.FilePath, err)
+			}
+		}
+	}
+
+	if payload.IsLast {
+		e.finishReceiver(conn, payload.FolderPairID, key, receiver)
+	}
+}
+
+// handleFileDelta applies delta instructions to the file being rebuilt.
+// If they can't be applied, the whole file is requested instead.
+func (e *Engine) handleFileDelta(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.FileDeltaPayload
 	if err := msg.ParsePayload(&payload); err != nil {
 		return
 	}
 
-	cfg := e.config.Get()
-	fp := cfg.GetFolderPair(payload.FolderPairID)
-	if fp == nil {
+	key := transferKey(payload.FolderPairID, payload.FilePath)
+	e.throttledAck(conn, payload.FolderPairID, payload.FilePath, len(msg.Data))
+	if e.pullCanceled(conn, key) {
+		return
+	}
+	e.mu.Lock()
+	receiver, exists := e.fileReceivers[key]
+	e.mu.Unlock()
+	if !exists {
 		return
 	}
 
-	fileInfo, err := e.scanner.GetFileInfo(fp.LocalPath, payload.FilePath)
+	data, err := network.Decompress(payload.Compression, msg.Data)
+	var ops []network.DeltaOp
+	if err == nil {
+		receiver.CountWire(len(data), len(msg.Data))
+		ops, err = network.DecodeDeltaOps(data)
+	}
+	if err == nil {
+		err = receiver.ApplyDelta(ops)
+	}
 	if err != nil {
-		respPayload := &network.FileResponsePayload{
-			FolderPairID: payload.FolderPairID,
-			FilePath:     payload.FilePath,
-			Error:        err.Error(),
+		log.Printf("Delta transfer of %s failed, requesting the whole file: %v", payload.FilePath, err)
+		receiver.Abort()
+		e.mu.Lock()
+		delete(e.fileReceivers, key)
+		e.mu.Unlock()
+		if err := e.client.SendFileRequest(conn, payload.FolderPairID, payload.FilePath, 0); err != nil {
+			log.Printf("Failed to request file %s: %v", payload.FilePath, err)
 		}
-		respMsg, _ := network.NewMessage(network.MsgTypeFileResponse, respPayload)
-		conn.WriteMessage(respMsg)
 		return
 	}
 
-	// Send file response
-	respPayload := &network.FileResponsePayload{
-		FolderPairID: payload.FolderPairID,
-		FilePath:     payload.FilePath,
-		Size:         fileInfo.Size,
-		Hash:         fileInfo.Hash,
+	if payload.IsLast {
+		e.finishReceiver(conn, payload.FolderPairID, key, receiver)
 	}
-	respMsg, _ := network.NewMessage(network.MsgTypeFileResponse, respPayload)
-	conn.WriteMessage(respMsg)
+}
 
-	// Send file chunks
-	tm := NewTransferManager(fp.LocalPath, e.scanner)
-	tm.SendFile(conn, fp.ID, payload.FilePath, nil)
+// ackChunk acknowledges a chunk or delta message to its sender, whatever
+// becomes of it, so the sender's window moves on
+func (e *Engine) ackChunk(conn *network.PeerConnection, folderPairID, relPath string) {
+	e.transfers.Touch(conn, transferKey(folderPairID, relPath))
+	if err := e.client.SendChunkAck(conn, folderPairID, relPath); err != nil {
+		log.Printf("Failed to acknowledge chunk of %s: %v", relPath, err)
+	}
 }
 
-// handleFileChunk handles an incoming file chunk
-func (e *Engine) handleFileChunk(conn *network.PeerConnection, msg *network.Message) {
-	var payload network.FileChunkPayload
+// throttledAck acknowledges n bytes of a file received from the peer once
+// the download limit lets them pass. Until then they hold a slot of the
+// peer's chunk window, which keeps the peer to the limit without holding
+// up the read loop.
+func (e *Engine) throttledAck(conn *network.PeerConnection, folderPairID, relPath string, n int) {
+	delay, changed := e.bandwidth.downloadFrom(conn.PeerID).reserve(n)
+	if delay <= 0 {
+		e.ackChunk(conn, folderPairID, relPath)
+		return
+	}
+
+	e.transfers.Touch(conn, transferKey(folderPairID, relPath))
+	go func() {
+		pause(delay, changed)
+		e.ackChunk(conn, folderPairID, relPath)
+	}()
+}
+
+// handleChunkAck lets another chunk be sent to the peer
+func (e *Engine) handleChunkAck(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.ChunkAckPayload
 	if err := msg.ParsePayload(&payload); err != nil {
 		return
 	}
+	e.transfers.Ack(conn, transferKey(payload.FolderPairID, payload.FilePath))
+}
 
-	key := fmt.Sprintf("%s:%s", payload.FolderPairID, payload.FilePath)
+// finishReceiver verifies a received file against the hash the sender
+// announced, finalizes it and confirms it to the peer
+func (e *Engine) finishReceiver(conn *network.PeerConnection, folderPairID, key string, receiver *FileReceiver) {
+	relPath := receiver.Info().Path
 
+	if receiver.Info().Hash != "" {
+		if err := receiver.Verify(); err != nil {
+			e.rejectReceiver(conn, folderPairID, key, receiver, err)
+			return
+		}
+	}
 	e.mu.Lock()
-	receiver, exists := e.fileReceivers[key]
+	delete(e.verifyErrors, key)
 	e.mu.Unlock()
 
-	if !exists {
-		// Create new receiver
-		cfg := e.config.Get()
-		fp := cfg.GetFolderPair(payload.FolderPairID)
-		if fp == nil {
-			return
-		}
+	// Mark file complete in aggregator before finalize
+	if e.progressAggregator != nil {
+		e.progressAggregator.CompleteFile(relPath, receiver.Info().Size)
+	}
 
-		var err error
-		receiver, err = NewFileReceiver(fp.LocalPath, payload.FilePath, 0, func(p *models.TransferProgress) {
-			e.mu.Lock()
-			e.progress = p
-			e.mu.Unlock()
-
-			// Legacy callback for backward compatibility
-			if e.onProgress != nil {
-				e.onProgress(p)
-			}
+	err := receiver.Finalize()
+	e.mu.Lock()
+	delete(e.fileReceivers, key)
+	e.mu.Unlock()
+	e.partials.Remove(key)
 
-			// Feed progress to aggregator
-			if e.progressAggregator != nil {
-				e.progressAggregator.UpdateFile(p.FileName, p.TotalBytes, p.TransferBytes)
-			}
+	if err != nil {
+		log.Printf("Failed to finalize file: %v", err)
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: folderPairID,
+			FilePath:     relPath,
+			Error:        err.Error(),
 		})
-		if err != nil {
-			log.Printf("Failed to create file receiver: %v", err)
-			return
-		}
+		e.transfers.Done(conn, key, err)
+		return
+	}
 
-		e.mu.Lock()
-		e.fileReceivers[key] = receiver
-		e.mu.Unlock()
+	e.confirmReceivedFile(conn, folderPairID, receiver.Info())
+	e.transfers.Done(conn, key, nil)
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "pull",
+		FolderPair:  folderPairID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: "File received",
+	})
+}
+
+// maxVerifyRetries is how many times a file that doesn't verify is
+// requested again before it is quarantined
+const maxVerifyRetries = 2
+
+// rejectReceiver handles a received file that doesn't match the hash the
+// sender announced. It is requested again in full up to maxVerifyRetries
+// times; after that the data is quarantined, an error event is raised and
+// the sender is told.
+func (e *Engine) rejectReceiver(conn *network.PeerConnection, folderPairID, key string, receiver *FileReceiver, verifyErr error) {
+	relPath := receiver.Info().Path
+
+	e.mu.Lock()
+	delete(e.fileReceivers, key)
+	e.verifyErrors[key]++
+	attempt := e.verifyErrors[key]
+	if attempt > maxVerifyRetries {
+		delete(e.verifyErrors, key)
 	}
+	e.mu.Unlock()
+	e.partials.Remove(key)
 
-	if err := receiver.WriteChunk(payload.Data, payload.Offset); err != nil {
-		log.Printf("Failed to write chunk: %v", err)
+	if attempt <= maxVerifyRetries {
+		log.Printf("Received %s doesn't verify, requesting it again (%d/%d): %v", relPath, attempt, maxVerifyRetries, verifyErr)
 		receiver.Abort()
-		e.mu.Lock()
-		delete(e.fileReceivers, key)
-		e.mu.Unlock()
+		if err := e.client.SendFileRequest(conn, folderPairID, relPath, 0); err != nil {
+			log.Printf("Failed to request file %s: %v", relPath, err)
+		}
 		return
 	}
 
-	if payload.IsLast {
-		// Mark file complete in aggregator before finalize
-		if e.progressAggregator != nil {
-			// Get file size from receiver progress
-			if e.progress != nil {
-				e.progressAggregator.CompleteFile(payload.FilePath, e.progress.TotalBytes)
-			}
-		}
+	dest := filepath.Join(e.config.GetDataDir(), "quarantine", folderPairID,
+		relPath+"."+time.Now().Format("20060102-150405"))
+	description := fmt.Sprintf("File failed verification and was quarantined at %s: %v", dest, verifyErr)
+	quarantined := true
+	if err := receiver.Quarantine(dest); err != nil {
+		log.Printf("Failed to quarantine %s: %v", relPath, err)
+		description = fmt.Sprintf("File failed verification and was discarded: %v", verifyErr)
+		quarantined = false
+	}
+	log.Printf("Received %s doesn't verify after %d retries: %v", relPath, maxVerifyRetries, verifyErr)
 
-		if err := receiver.Finalize(); err != nil {
-			log.Printf("Failed to finalize file: %v", err)
-		}
-		e.mu.Lock()
-		delete(e.fileReceivers, key)
-		e.mu.Unlock()
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "error",
+		FolderPair:  folderPairID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: description,
+	})
+	e.client.SendFileComplete(conn, &network.FileCompletePayload{
+		FolderPairID: folderPairID,
+		FilePath:     relPath,
+		Error:        verifyErr.Error(),
+		Quarantined:  quarantined,
+	})
+	e.transfers.Done(conn, key, verifyErr)
+}
 
-		e.addEvent(&SyncEvent{
-			Time:        time.Now(),
-			Type:        "pull",
-			FolderPair:  payload.FolderPairID,
-			FilePath:    payload.FilePath,
-			PeerName:    conn.PeerName,
-			Description: "File received",
+// confirmReceivedFile records a finalized file, with the sender's version,
+// in the base and local indices and reports it back so the sender can do
+// the same
+func (e *Engine) confirmReceivedFile(conn *network.PeerConnection, folderPairID string, remote *models.FileInfo) {
+	relPath := remote.Path
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(folderPairID)
+	if fp == nil {
+		return
+	}
+
+	fileInfo, err := e.localFileInfo(fp, relPath)
+	if err != nil {
+		log.Printf("Failed to read received file %s: %v", relPath, err)
+		e.client.SendFileComplete(conn, &network.FileCompletePayload{
+			FolderPairID: folderPairID,
+			FilePath:     relPath,
+			Error:        err.Error(),
 		})
+		return
+	}
+	fileInfo.Version = remote.Version
+	if fileInfo.Hash == remote.Hash && len(fileInfo.Chunks) == 0 {
+		fileInfo.Chunks = remote.Chunks
+	}
+
+	update := map[string]*models.FileInfo{relPath: fileInfo}
+	if err := e.indexManager.UpdateIndex(folderPairID, update); err != nil {
+		log.Printf("Failed to update base index: %v", err)
+	}
+	if err := e.indexManager.UpdateIndex(localIndexKey(folderPairID), update); err != nil {
+		log.Printf("Failed to update local index: %v", err)
+	}
+	if err := e.indexManager.UpdateIndex(remoteIndexKey(folderPairID), map[string]*models.FileInfo{relPath: remote}); err != nil {
+		log.Printf("Failed to update remote index: %v", err)
+	}
+
+	// Later files of the sync can reuse its chunks
+	e.mu.RLock()
+	ci := e.chunkIndexes[folderPairID]
+	e.mu.RUnlock()
+	if ci != nil {
+		ci.add(fileInfo)
 	}
+
+	e.client.SendFileComplete(conn, &network.FileCompletePayload{
+		FolderPairID: folderPairID,
+		FilePath:     relPath,
+		Hash:         fileInfo.Hash,
+		Version:      fileInfo.Version,
+		Success:      true,
+	})
 }
 
 // handleFileComplete handles a file complete notification
@@ -1048,8 +2783,58 @@ func (e *Engine) handleFileComplete(conn *network.PeerConnection, msg *network.M
 		return
 	}
 
+	// A file offered to the peer may have been built without requesting it
+	key := transferKey(payload.FolderPairID, payload.FilePath)
+	e.mu.Lock()
+	if e.offers[key] == conn {
+		delete(e.offers, key)
+	}
+	if e.withdrawn[key] == conn {
+		delete(e.withdrawn, key)
+	}
+	e.mu.Unlock()
+
+	// Pushes stay in flight until the peer has the file
+	var transferErr error
+	if !payload.Success {
+		transferErr = errors.New(payload.Error)
+	}
+	e.transfers.Done(conn, key, transferErr)
+
 	if !payload.Success {
 		log.Printf("File transfer failed for %s: %s", payload.FilePath, payload.Error)
+		if payload.Quarantined {
+			e.addEvent(&SyncEvent{
+				Time:        time.Now(),
+				Type:        "error",
+				FolderPair:  payload.FolderPairID,
+				FilePath:    payload.FilePath,
+				PeerName:    conn.PeerName,
+				Description: fmt.Sprintf("Peer quarantined the file: %s", payload.Error),
+			})
+		}
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		return
+	}
+
+	// Only record the file as synced if it hasn't changed since it was sent
+	fileInfo, err := e.localFileInfo(fp, payload.FilePath)
+	if err != nil || fileInfo.Hash != payload.Hash {
+		return
+	}
+	fileInfo.Version = payload.Version
+
+	update := map[string]*models.FileInfo{payload.FilePath: fileInfo}
+	if err := e.indexManager.UpdateIndex(fp.ID, update); err != nil {
+		log.Printf("Failed to update base index: %v", err)
+	}
+	if err := e.indexManager.UpdateIndex(remoteIndexKey(fp.ID), update); err != nil {
+		log.Printf("Failed to update remote index: %v", err)
 	}
 }
 
@@ -1065,16 +2850,35 @@ func (e *Engine) handleDeleteFile(conn *network.PeerConnection, msg *network.Mes
 	if fp == nil {
 		return
 	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FilePath, "deletion")
+		return
+	}
+	if checkRelPath(payload.FilePath) != nil {
+		e.refuseOutsidePath(conn, fp, payload.FilePath)
+		return
+	}
 
-	fullPath := filepath.Join(fp.LocalPath, payload.FilePath)
-	if err := DeleteFile(fullPath); err != nil {
+	if err := e.deleteLocal(fp, payload.FilePath); err != nil {
 		log.Printf("Failed to delete file %s: %v", payload.FilePath, err)
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    payload.FilePath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Delete failed: %v", err),
+		})
 		return
 	}
 
+	if err := e.indexManager.UpdateIndex(fp.ID, map[string]*models.FileInfo{payload.FilePath: nil}); err != nil {
+		log.Printf("Failed to update base index: %v", err)
+	}
+
 	// Send ack
 	ackMsg, _ := network.NewMessage(network.MsgTypeDeleteAck, payload)
-	conn.WriteMessage(ackMsg)
+	conn.QueueMessage(ackMsg)
 
 	e.addEvent(&SyncEvent{
 		Time:        time.Now(),
@@ -1086,6 +2890,128 @@ func (e *Engine) handleDeleteFile(conn *network.PeerConnection, msg *network.Mes
 	})
 }
 
+// handleDeleteAck handles the peer's confirmation of a deletion
+func (e *Engine) handleDeleteAck(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.DeleteFilePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "delete",
+		FolderPair:  payload.FolderPairID,
+		FilePath:    payload.FilePath,
+		PeerName:    conn.PeerName,
+		Description: "File deleted on peer",
+	})
+}
+
+// handleMoveFile renames a file the peer moved, or requests its content if
+// the local copy can't be renamed
+func (e *Engine) handleMoveFile(conn *network.PeerConnection, msg *network.Message) {
+	var payload network.MoveFilePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return
+	}
+
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(payload.FolderPairID)
+	if fp == nil {
+		return
+	}
+	if !fp.Mode.CanReceive() {
+		e.refuseIncoming(conn, fp, payload.FromPath, "move")
+		return
+	}
+	for _, relPath := range []string{payload.FromPath, payload.ToPath} {
+		if err := checkRelPath(relPath); err != nil {
+			e.refuseOutsidePath(conn, fp, relPath)
+			e.client.SendFileComplete(conn, &network.FileCompletePayload{
+				FolderPairID: fp.ID,
+				FilePath:     payload.ToPath,
+				Error:        err.Error(),
+			})
+			return
+		}
+	}
+
+	if err := e.renameLocal(fp, payload.FromPath, payload.ToPath, payload.Hash); err != nil {
+		log.Printf("Failed to move %s to %s, requesting it instead: %v", payload.FromPath, payload.ToPath, err)
+		if err := e.client.SendFileRequest(conn, fp.ID, payload.ToPath, 0); err != nil {
+			log.Printf("Failed to request file %s: %v", payload.ToPath, err)
+		}
+		return
+	}
+
+	e.confirmReceivedFile(conn, fp.ID, &models.FileInfo{
+		Path:    payload.ToPath,
+		Hash:    payload.Hash,
+		Version: payload.Version,
+	})
+
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "move",
+		FolderPair:  fp.ID,
+		FilePath:    payload.ToPath,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("File moved from %s", payload.FromPath),
+	})
+}
+
+// caseCollision returns the path of the local file that writing relPath
+// would overwrite because the folder is on a case-insensitive volume and
+// their names differ only by case, or "" if there is none
+func (e *Engine) caseCollision(fp *models.FolderPair, relPath string) string {
+	if !caseInsensitive(fp.LocalPath) {
+		return ""
+	}
+	return caseCollision(fp.LocalPath, relPath)
+}
+
+// refuseCaseCollision records, as a conflict, that a change to relPath was
+// not applied because it would overwrite existing
+func (e *Engine) refuseCaseCollision(conn *network.PeerConnection, fp *models.FolderPair, relPath, existing string) {
+	log.Printf("Refused %s: it differs only by case from %s", relPath, existing)
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "conflict",
+		FolderPair:  fp.ID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("Not applied: the name differs only by case from %s, which it would overwrite", existing),
+	})
+}
+
+// refuseIncoming records that a change sent by the peer was not applied
+// because the folder pair doesn't accept incoming changes
+func (e *Engine) refuseIncoming(conn *network.PeerConnection, fp *models.FolderPair, relPath, what string) {
+	log.Printf("Refused incoming %s for %s: folder is %s", what, relPath, fp.Mode)
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "error",
+		FolderPair:  fp.ID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: fmt.Sprintf("Incoming %s refused: folder is %s", what, fp.Mode),
+	})
+}
+
+// refuseOutsidePath records that a change sent by the peer was not applied
+// because its path leads out of the folder
+func (e *Engine) refuseOutsidePath(conn *network.PeerConnection, fp *models.FolderPair, relPath string) {
+	log.Printf("Refused %s: %v", relPath, errPathOutsideRoot)
+	e.addEvent(&SyncEvent{
+		Time:        time.Now(),
+		Type:        "error",
+		FolderPair:  fp.ID,
+		FilePath:    relPath,
+		PeerName:    conn.PeerName,
+		Description: "Not applied: the path is outside the folder",
+	})
+}
+
 // handleFolderPairSync handles receiving a folder pair configuration from a peer
 func (e *Engine) handleFolderPairSync(conn *network.PeerConnection, msg *network.Message) {
 	var payload network.FolderPairSyncPayload
@@ -1114,16 +3040,25 @@ func (e *Engine) handleFolderPairSync(conn *network.PeerConnection, msg *network
 				LocalPath:  payload.RemotePath, // Their remote is our local
 				RemotePath: payload.LocalPath,  // Their local is our remote
 				Enabled:    true,
+				Mode:       payload.Mode,
 			}
 			c.AddFolderPair(fp)
 			log.Printf("Created mirrored folder pair: local=%s, remote=%s", fp.LocalPath, fp.RemotePath)
 		})
+	} else if payload.Action == "update" {
+		e.config.Update(func(c *config.Config) {
+			if fp := c.GetFolderPair(payload.FolderPairID); fp != nil && payload.Mode.Valid() {
+				fp.Mode = payload.Mode
+				log.Printf("Folder pair %s mode set to %s", fp.ID, fp.Mode)
+			}
+		})
 	} else if payload.Action == "remove" {
 		e.config.Update(func(c *config.Config) {
 			c.RemoveFolderPair(payload.FolderPairID)
 			log.Printf("Removed folder pair %s", payload.FolderPairID)
 		})
 	}
+	e.RefreshWatchers()
 
 	// Notify UI about the change
 	if e.onPeerChange != nil {
@@ -1153,6 +3088,7 @@ func (e *Engine) SendFolderPairSync(peerID string, fp *models.FolderPair, action
 		LocalPath:    fp.LocalPath,
 		RemotePath:   fp.RemotePath,
 		Action:       action,
+		Mode:         fp.Mode.Complement(),
 	}
 
 	msg, err := network.NewMessage(network.MsgTypeFolderPairSync, payload)
@@ -1253,6 +3189,7 @@ func (e *Engine) UnpairPeer(peerID string) error {
 	}
 	e.mu.Unlock()
 
+	e.RefreshWatchers()
 	return nil
 }
 
@@ -1281,20 +3218,25 @@ func (e *Engine) ClearPairingCode() {
 }
 
 // SyncPreview represents a preview of sync changes
+
 type SyncPreview struct {
-	FolderPairID string              `json:"folderPairId"`
-	PeerName     string              `json:"peerName"`
-	LocalPath    string              `json:"localPath"`
-	RemotePath   string              `json:"remotePath"`
-	ToPush       []*models.FileInfo  `json:"toPush"`
-	ToPull       []*models.FileInfo  `json:"toPull"`
-	ToDelete     []*models.FileInfo  `json:"toDelete"`
-	PushCount    int                 `json:"pushCount"`
-	PullCount    int                 `json:"pullCount"`
-	DeleteCount  int                 `json:"deleteCount"`
-	PushSize     int64               `json:"pushSize"`
-	PullSize     int64               `json:"pullSize"`
-	Error        string              `json:"error,omitempty"`
+	FolderPairID      string               `json:"folderPairId"`
+	PeerName          string               `json:"peerName"`
+	LocalPath         string               `json:"localPath"`
+	RemotePath        string               `json:"remotePath"`
+	ToPush            []*models.FileInfo   `json:"toPush"`
+	ToPull            []*models.FileInfo   `json:"toPull"`
+	ToDelete          []*models.FileInfo   `json:"toDelete"`       // Local files deleted because the peer deleted them
+	ToDeleteRemote    []*models.FileInfo   `json:"toDeleteRemote"` // Files of the peer deleted because they were deleted here
+	ToMove            []*models.SyncAction `json:"toMove"`
+	PushCount         int                  `json:"pushCount"`
+	PullCount         int                  `json:"pullCount"`
+	DeleteCount       int                  `json:"deleteCount"`
+	DeleteRemoteCount int                  `json:"deleteRemoteCount"`
+	MoveCount         int                  `json:"moveCount"`
+	PushSize          int64                `json:"pushSize"`
+	PullSize          int64                `json:"pullSize"`
+	Error             string               `json:"error,omitempty"`
 }
 
 // AnalyzeFolderPair analyzes a folder pair and returns what would be synced
@@ -1311,13 +3253,15 @@ func (e *Engine) AnalyzeFolderPair(folderPairID string) (*SyncPreview, error) {
 	}
 
 	preview := &SyncPreview{
-		FolderPairID: fp.ID,
-		PeerName:     peer.Name,
-		LocalPath:    fp.LocalPath,
-		RemotePath:   fp.RemotePath,
-		ToPush:       make([]*models.FileInfo, 0),
-		ToPull:       make([]*models.FileInfo, 0),
-		ToDelete:     make([]*models.FileInfo, 0),
+		FolderPairID:   fp.ID,
+		PeerName:       peer.Name,
+		LocalPath:      fp.LocalPath,
+		RemotePath:     fp.RemotePath,
+		ToPush:         make([]*models.FileInfo, 0),
+		ToPull:         make([]*models.FileInfo, 0),
+		ToDelete:       make([]*models.FileInfo, 0),
+		ToDeleteRemote: make([]*models.FileInfo, 0),
+		ToMove:         make([]*models.SyncAction, 0),
 	}
 
 	// Check if peer is online
@@ -1328,16 +3272,21 @@ func (e *Engine) AnalyzeFolderPair(folderPairID string) (*SyncPreview, error) {
 	}
 
 	// Scan local directory
-	localIndex, err := e.scanner.ScanDirectory(fp.LocalPath)
+	localIndex, err := e.scanFolderPair(fp, nil)
 	if err != nil {
 		preview.Error = fmt.Sprintf("Failed to scan local directory: %v", err)
 		return preview, nil
 	}
 
 	// Try to load last known remote index
-	remoteIndex, err := e.indexManager.LoadIndex(fp.ID + "_remote")
+	remoteIndex, err := e.indexManager.LoadIndex(remoteIndexKey(fp.ID))
 	if err != nil {
-		// No previous remote index, everything is new
+		log.Printf("Failed to load remote index: %v", err)
+	}
+	if remoteIndex == nil {
+		// The peer's files are unknown until a sync has exchanged them.
+		// Comparing against the base alone would report every file as
+		// deleted, so everything local is listed as new instead.
 		for _, f := range localIndex.Files {
 			if !f.IsDir {
 				preview.ToPush = append(preview.ToPush, f)
@@ -1348,8 +3297,13 @@ func (e *Engine) AnalyzeFolderPair(folderPairID string) (*SyncPreview, error) {
 		return preview, nil
 	}
 
+	baseIndex, err := e.indexManager.LoadIndex(fp.ID)
+	if err != nil {
+		log.Printf("Failed to load base index: %v", err)
+	}
+
 	// Compare indices
-	actions := CompareIndices(localIndex, remoteIndex)
+	actions := CompareIndicesWithModes(localIndex, remoteIndex, baseIndex, fp.Mode, fp.Mode.Complement())
 
 	for _, action := range actions {
 		switch action.Action {
@@ -1366,13 +3320,19 @@ func (e *Engine) AnalyzeFolderPair(folderPairID string) (*SyncPreview, error) {
 		case models.FileActionDelete:
 			if action.LocalFile != nil {
 				preview.ToDelete = append(preview.ToDelete, action.LocalFile)
+			} else if action.RemoteFile != nil {
+				preview.ToDeleteRemote = append(preview.ToDeleteRemote, action.RemoteFile)
 			}
+		case models.FileActionMove:
+			preview.ToMove = append(preview.ToMove, action)
 		}
 	}
 
 	preview.PushCount = len(preview.ToPush)
 	preview.PullCount = len(preview.ToPull)
 	preview.DeleteCount = len(preview.ToDelete)
+	preview.DeleteRemoteCount = len(preview.ToDeleteRemote)
+	preview.MoveCount = len(preview.ToMove)
 
 	return preview, nil
 }
@@ -0,0 +1,730 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"SyncDev/internal/config"
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+)
+
+// testPeer is an engine syncing one folder pair with another engine
+type testPeer struct {
+	engine *Engine
+	pair   *models.FolderPair
+	id     string
+	conn   *network.PeerConnection // Connection to the other engine
+}
+
+// newTestPeer creates an engine whose configuration and indices live in a
+// temporary directory, with one folder pair synced with the peer peerID
+func newTestPeer(t *testing.T, id, peerID string, mode models.SyncMode) *testPeer {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := config.NewStoreWithPath(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatalf("Failed to create config store: %v", err)
+	}
+	pair := &models.FolderPair{
+		ID:         "pair",
+		PeerID:     peerID,
+		LocalPath:  filepath.Join(dir, "folder"),
+		RemotePath: "remote",
+		Enabled:    true,
+		Mode:       mode,
+	}
+	if err := os.MkdirAll(pair.LocalPath, 0755); err != nil {
+		t.Fatalf("Failed to create folder: %v", err)
+	}
+	store.Update(func(c *config.Config) {
+		c.DeviceID = id
+		c.DeviceName = id
+		c.AddPeer(&models.Peer{ID: peerID, Name: peerID, Paired: true})
+		c.AddFolderPair(pair)
+	})
+
+	engine, err := NewEngine(store)
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+	engine.discovery.UpdatePeer(&models.Peer{ID: peerID, Name: peerID, Status: models.PeerStatusOnline})
+	t.Cleanup(engine.cancel)
+	return &testPeer{engine: engine, pair: pair, id: id}
+}
+
+// loopback returns both ends of a loopback TCP connection
+func loopback(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// attach makes conn the engine's connection to the peer peerID and reads
+// its messages the way outgoing connections are read
+func (p *testPeer) attach(netConn net.Conn, peerID string) *network.PeerConnection {
+	conn := network.NewPeerConnection(netConn)
+	conn.PeerID = peerID
+	conn.PeerName = peerID
+	conn.Paired = true
+	p.engine.mu.Lock()
+	p.engine.connections[conn.PeerID] = conn
+	p.engine.mu.Unlock()
+	go p.engine.readConnectionLoop(conn)
+	return conn
+}
+
+// connectTestPeers links two engines over a loopback connection
+func connectTestPeers(t *testing.T, a, b *testPeer) {
+	dialed, accepted := loopback(t)
+	a.conn = a.attach(dialed, b.id)
+	b.conn = b.attach(accepted, a.id)
+}
+
+// connectRawPeer links an engine to a connection the test reads and writes
+// itself, in place of the peer the engine's folder pair syncs with
+func connectRawPeer(t *testing.T, p *testPeer) *network.PeerConnection {
+	dialed, accepted := loopback(t)
+	p.conn = p.attach(dialed, p.pair.PeerID)
+	return network.NewPeerConnection(accepted)
+}
+
+// exchange sends a message on conn and returns the first reply of the
+// given type
+func exchange(t *testing.T, conn *network.PeerConnection, msgType network.MessageType, payload interface{}, reply network.MessageType) *network.Message {
+	t.Helper()
+	msg, err := network.NewMessage(msgType, payload)
+	if err != nil {
+		t.Fatalf("NewMessage failed: %v", err)
+	}
+	return exchangeMessage(t, conn, msg, reply)
+}
+
+// exchangeMessage sends msg on conn and returns the first reply of the
+// given type
+func exchangeMessage(t *testing.T, conn *network.PeerConnection, msg *network.Message, reply network.MessageType) *network.Message {
+	t.Helper()
+	if err := conn.WriteMessage(msg); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	conn.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Expected a %s reply: %v", reply, err)
+		}
+		if msg.Type == reply {
+			return msg
+		}
+	}
+}
+
+// newTestPeers creates two connected engines syncing a folder pair in the
+// given modes
+func newTestPeers(t *testing.T, modeA, modeB models.SyncMode) (*testPeer, *testPeer) {
+	a := newTestPeer(t, "device-a", "device-b", modeA)
+	b := newTestPeer(t, "device-b", "device-a", modeB)
+	connectTestPeers(t, a, b)
+	return a, b
+}
+
+// path returns the full path of relPath in the peer's folder
+func (p *testPeer) path(relPath string) string {
+	return filepath.Join(p.pair.LocalPath, relPath)
+}
+
+// sync syncs the folder pair with the other engine and waits until the
+// other engine's answer arrived
+func (p *testPeer) sync(t *testing.T) {
+	t.Helper()
+	started := time.Now()
+	if err := p.engine.SyncFolderPair(p.pair.ID); err != nil {
+		t.Fatalf("SyncFolderPair failed: %v", err)
+	}
+	waitFor(t, "the index ack", func() bool {
+		base, _ := p.engine.indexManager.LoadIndex(p.pair.ID)
+		return base != nil && !base.UpdatedAt.Before(started)
+	})
+}
+
+// waitFor polls done until it reports true, failing the test after a while
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForContent waits until the file at path holds content
+func waitForContent(t *testing.T, path, content string) {
+	t.Helper()
+	waitFor(t, filepath.Base(path)+" to hold "+content, func() bool {
+		data, err := os.ReadFile(path)
+		return err == nil && string(data) == content
+	})
+}
+
+func TestRevertLocalChangesRestoresModifiedFile(t *testing.T) {
+	a, b := newTestPeers(t, models.SyncModeReceiveOnly, models.SyncModeSendOnly)
+	if err := os.WriteFile(b.path("doc.txt"), []byte("original"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	a.sync(t)
+	waitForContent(t, a.path("doc.txt"), "original")
+	waitFor(t, "the received file in the base index", func() bool {
+		base, _ := a.engine.indexManager.LoadIndex(a.pair.ID)
+		return base != nil && base.Files["doc.txt"] != nil
+	})
+
+	// The receive-only side edits the file; the sync doesn't send it
+	edited := time.Now().Add(time.Minute)
+	if err := os.WriteFile(a.path("doc.txt"), []byte("local edit"), 0644); err != nil {
+		t.Fatalf("Failed to edit file: %v", err)
+	}
+	os.Chtimes(a.path("doc.txt"), edited, edited)
+	a.sync(t)
+
+	changes, err := a.engine.GetLocalChanges(a.pair.ID)
+	if err != nil {
+		t.Fatalf("GetLocalChanges failed: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != "doc.txt" || changes[0].Change != "modified" {
+		t.Fatalf("Expected doc.txt reported as modified, got %+v", changes)
+	}
+
+	if err := a.engine.RevertLocalChanges(a.pair.ID); err != nil {
+		t.Fatalf("RevertLocalChanges failed: %v", err)
+	}
+	waitForContent(t, a.path("doc.txt"), "original")
+}
+
+func TestRevertLocalChangesReportsFailedPulls(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeReceiveOnly)
+	connectRawPeer(t, a)
+	base := &models.FileIndex{Files: map[string]*models.FileInfo{
+		"out/doc.txt": {Path: "out/doc.txt", Size: 7, Hash: "hash"},
+	}}
+	if err := a.engine.indexManager.SaveIndex(a.pair.ID, base); err != nil {
+		t.Fatalf("SaveIndex failed: %v", err)
+	}
+
+	// The deleted file's folder now leads out of the folder pair
+	if err := os.Symlink(t.TempDir(), a.path("out")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := a.engine.RevertLocalChanges(a.pair.ID); err == nil {
+		t.Error("Expected the refused pull reported")
+	}
+	if events := a.engine.GetRecentEvents(); len(events) == 0 || events[0].Type != "error" || events[0].FilePath != "out/doc.txt" {
+		t.Errorf("Expected an error event for out/doc.txt, got %+v", events)
+	}
+}
+
+func TestReceivedFilesSettle(t *testing.T) {
+	a, b := newTestPeers(t, models.SyncModeTwoWay, models.SyncModeTwoWay)
+	edited := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	files := map[string]os.FileMode{"script.sh": 0755, "notes/private.txt": 0600}
+	for path, mode := range files {
+		full := b.path(path)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		os.WriteFile(full, []byte("content of "+path), mode)
+		os.Chmod(full, mode)
+		os.Chtimes(full, edited, edited)
+	}
+
+	a.sync(t)
+	for path, mode := range files {
+		waitForContent(t, a.path(path), "content of "+path)
+		waitFor(t, path+" to be finalized", func() bool {
+			stat, err := os.Stat(a.path(path))
+			return err == nil && stat.ModTime().Equal(edited) && stat.Mode().Perm() == mode
+		})
+	}
+
+	// Without hashes the files only match by size and time
+	scan := func(root string) *models.FileIndex {
+		index, err := NewScanner(nil).ScanDirectory(context.Background(), root)
+		if err != nil {
+			t.Fatalf("ScanDirectory failed: %v", err)
+		}
+		for _, info := range index.Files {
+			info.Hash = ""
+		}
+		return index
+	}
+	if actions := CompareIndices(scan(a.pair.LocalPath), scan(b.pair.LocalPath), nil); len(actions) != 0 {
+		t.Errorf("Expected the received files to match the originals, got %d actions", len(actions))
+	}
+
+	// Syncing again in both directions finds nothing to do
+	settled := func(p *testPeer) map[string]*models.FileInfo {
+		// Wait for the actions of the last round to finish
+		p.engine.transfers.LockPair(p.pair.ID)()
+		base, _ := p.engine.indexManager.LoadIndex(p.pair.ID)
+		if base == nil {
+			t.Fatalf("Expected a base index on %s", p.id)
+		}
+		return base.Files
+	}
+	baseA, baseB := settled(a), settled(b)
+	eventsA, eventsB := len(a.engine.GetRecentEvents()), len(b.engine.GetRecentEvents())
+	a.sync(t)
+	b.sync(t)
+
+	for _, side := range []struct {
+		peer   *testPeer
+		base   map[string]*models.FileInfo
+		events int
+	}{{a, baseA, eventsA}, {b, baseB, eventsB}} {
+		p := side.peer
+		files := settled(p)
+		if queue := p.engine.GetTransferQueue(); len(queue) != 0 {
+			t.Errorf("Expected no transfers on %s, got %d", p.id, len(queue))
+		}
+		events := p.engine.GetRecentEvents()
+		for _, event := range events[:len(events)-side.events] {
+			switch event.Type {
+			case "push", "pull", "delete", "move", "conflict":
+				t.Errorf("Expected no %s of %s on %s after settling", event.Type, event.FilePath, p.id)
+			}
+		}
+		if len(files) != len(side.base) {
+			t.Errorf("Expected the base index of %s unchanged, got %d files instead of %d", p.id, len(files), len(side.base))
+		}
+		for path, before := range side.base {
+			after := files[path]
+			if after == nil || after.Hash != before.Hash || after.Size != before.Size ||
+				after.Version.Compare(before.Version) != models.VersionEqual {
+				t.Errorf("Expected %s unchanged in the base index of %s, got %+v instead of %+v", path, p.id, after, before)
+			}
+		}
+	}
+}
+
+func TestReceivedFilesRecordChunks(t *testing.T) {
+	a, b := newTestPeers(t, models.SyncModeTwoWay, models.SyncModeTwoWay)
+	a.engine.config.Update(func(c *config.Config) { c.GetFolderPair(a.pair.ID).ChunkDedup = true })
+	content := bytes.Repeat([]byte("chunked content "), minChunkSize)
+	if err := os.WriteFile(b.path("big.bin"), content, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	a.sync(t)
+	waitForContent(t, a.path("big.bin"), string(content))
+
+	// Later pulls can reuse the chunks of the received file
+	waitFor(t, "the chunks of the received file", func() bool {
+		base, _ := a.engine.indexManager.LoadIndex(a.pair.ID)
+		return base != nil && base.Files["big.bin"] != nil && len(base.Files["big.bin"].Chunks) > 0
+	})
+}
+
+func TestConcurrentPushesInBothDirections(t *testing.T) {
+	a, b := newTestPeers(t, models.SyncModeTwoWay, models.SyncModeTwoWay)
+
+	// Each file is larger than the chunk window, so both sides keep
+	// writing chunks while the other acknowledges them
+	size := (config.DefaultChunkWindow + 4) * network.ChunkSize
+	contentA := make([]byte, size)
+	contentB := make([]byte, size)
+	for i := range contentA {
+		contentA[i] = byte(i * 7)
+		contentB[i] = byte(i * 13)
+	}
+	if err := os.WriteFile(a.path("from-a.bin"), contentA, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(b.path("from-b.bin"), contentB, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	go a.engine.SyncFolderPair(a.pair.ID)
+	go b.engine.SyncFolderPair(b.pair.ID)
+	waitForContent(t, b.path("from-a.bin"), string(contentA))
+	waitForContent(t, a.path("from-b.bin"), string(contentB))
+}
+
+func TestRefusedTransfersAreAnswered(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	peer := connectRawPeer(t, a)
+
+	a.engine.config.Update(func(c *config.Config) { c.GetFolderPair(a.pair.ID).Exclusions = []string{"*.secret"} })
+	os.WriteFile(a.path("doc.txt"), []byte("content"), 0644)
+	os.WriteFile(a.path("key.secret"), []byte("excluded"), 0600)
+	os.Symlink("doc.txt", a.path("link.txt"))
+
+	for _, request := range []network.FileRequestPayload{
+		{FolderPairID: "missing", FilePath: "doc.txt"},
+		{FolderPairID: a.pair.ID, FilePath: "../config.json"},
+		{FolderPairID: a.pair.ID, FilePath: "key.secret"},
+		{FolderPairID: a.pair.ID, FilePath: "link.txt"},
+	} {
+		var response network.FileResponsePayload
+		msg := exchange(t, peer, network.MsgTypeFileRequest, &request, network.MsgTypeFileResponse)
+		if err := msg.ParsePayload(&response); err != nil || response.Error == "" {
+			t.Errorf("Expected an error response to the request for %s, got %+v", request.FilePath, response)
+		}
+	}
+
+	var complete network.FileCompletePayload
+	for _, offer := range []network.FileResponsePayload{
+		{FolderPairID: "missing", FilePath: "doc.txt"},
+		{FolderPairID: a.pair.ID, FilePath: "../config.json"},
+	} {
+		msg := exchange(t, peer, network.MsgTypeFileOffer, &offer, network.MsgTypeFileComplete)
+		if err := msg.ParsePayload(&complete); err != nil || complete.Success || complete.Error == "" {
+			t.Errorf("Expected the offer of %s refused, got %+v", offer.FilePath, complete)
+		}
+	}
+
+	// The folder doesn't keep symlinks
+	msg := exchange(t, peer, network.MsgTypeSymlink, &network.SymlinkPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "link",
+		Target:       "doc.txt",
+	}, network.MsgTypeFileComplete)
+	if err := msg.ParsePayload(&complete); err != nil || complete.Success || complete.Error == "" {
+		t.Errorf("Expected the symlink refused, got %+v", complete)
+	}
+
+	// A chunk that can't be decoded still frees its window slot
+	chunk, err := network.NewChunkMessage(&network.FileChunkPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "doc.txt",
+		Data:         []byte("not zstd"),
+		Compression:  network.CompressionZstd,
+	})
+	if err != nil {
+		t.Fatalf("NewChunkMessage failed: %v", err)
+	}
+	exchangeMessage(t, peer, chunk, network.MsgTypeChunkAck)
+
+	// So does one without a readable header
+	garbled := &network.Message{Type: network.MsgTypeFileChunk, Payload: json.RawMessage(`"not a chunk"`)}
+	exchangeMessage(t, peer, garbled, network.MsgTypeChunkAck)
+}
+
+func TestCanceledOfferIsNotSent(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	peer := connectRawPeer(t, a)
+	if err := os.WriteFile(a.path("big.bin"), bytes.Repeat([]byte("x"), offerSize), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	info, err := a.engine.scanner.GetFileInfo(a.pair.LocalPath, "big.bin")
+	if err != nil {
+		t.Fatalf("GetFileInfo failed: %v", err)
+	}
+
+	var transfers sync.WaitGroup
+	err = a.engine.scheduleTransfer(a.conn, a.pair, info, "push", &transfers, func() error {
+		a.engine.pushFile(a.conn, a.pair, info)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scheduleTransfer failed: %v", err)
+	}
+	peer.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if msg, err := peer.ReadMessage(); err != nil || msg.Type != network.MsgTypeFileOffer {
+		t.Fatalf("Expected the file offered, got %v (%v)", msg, err)
+	}
+
+	// The peer requests the file after the push was canceled
+	if err := a.engine.CancelTransfer(transferKey(a.pair.ID, "big.bin")); err != nil {
+		t.Fatalf("CancelTransfer failed: %v", err)
+	}
+	msg := exchange(t, peer, network.MsgTypeFileRequest, &network.FileRequestPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "big.bin",
+	}, network.MsgTypeFileResponse)
+	var response network.FileResponsePayload
+	if err := msg.ParsePayload(&response); err != nil || response.Error == "" {
+		t.Errorf("Expected the request refused, got %+v", response)
+	}
+	transfers.Wait()
+}
+
+func TestCanceledPullIsNotReceived(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	peer := connectRawPeer(t, a)
+	info := &models.FileInfo{Path: "doc.txt", Size: 7, ModTime: time.Now()}
+
+	var transfers sync.WaitGroup
+	err := a.engine.scheduleTransfer(a.conn, a.pair, info, "pull", &transfers, func() error {
+		a.engine.pullFile(a.conn, a.pair, info)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("scheduleTransfer failed: %v", err)
+	}
+	peer.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if msg, err := peer.ReadMessage(); err != nil || msg.Type != network.MsgTypeFileRequest {
+		t.Fatalf("Expected the file requested, got %v (%v)", msg, err)
+	}
+
+	// The pull is canceled before the peer's response arrives
+	if err := a.engine.CancelTransfer(transferKey(a.pair.ID, "doc.txt")); err != nil {
+		t.Fatalf("CancelTransfer failed: %v", err)
+	}
+	transfers.Wait()
+	response, err := network.NewMessage(network.MsgTypeFileResponse, &network.FileResponsePayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "doc.txt",
+		Size:         7,
+	})
+	if err != nil {
+		t.Fatalf("NewMessage failed: %v", err)
+	}
+	if err := peer.WriteMessage(response); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	chunk, err := network.NewChunkMessage(&network.FileChunkPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "doc.txt",
+		Data:         []byte("content"),
+		IsLast:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewChunkMessage failed: %v", err)
+	}
+	if err := peer.WriteMessage(chunk); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	// Messages are handled in order, so the chunk was handled by the pong
+	exchange(t, peer, network.MsgTypePing, nil, network.MsgTypePong)
+	if _, err := os.Stat(a.path("doc.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected the canceled file not written, got %v", err)
+	}
+}
+
+func TestDownloadLimitDelaysAcks(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	peer := connectRawPeer(t, a)
+	a.engine.bandwidth.Apply(&config.Config{
+		PeerBandwidth: map[string]config.BandwidthLimit{"device-b": {DownloadKBps: 1}},
+	}, time.Now())
+
+	chunk, err := network.NewChunkMessage(&network.FileChunkPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "big.bin",
+		Offset:       network.ChunkSize,
+		Data:         make([]byte, 64*1024),
+	})
+	if err != nil {
+		t.Fatalf("NewChunkMessage failed: %v", err)
+	}
+	if err := peer.WriteMessage(chunk); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+
+	// The chunk over the limit waits for its ack, not the messages after it
+	if msg := exchange(t, peer, network.MsgTypePing, nil, network.MsgTypePong); msg == nil {
+		t.Fatal("Expected a pong")
+	}
+
+	// Lifting the limit lets the ack through
+	a.engine.bandwidth.Apply(&config.Config{}, time.Now())
+	peer.Conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if msg, err := peer.ReadMessage(); err != nil || msg.Type != network.MsgTypeChunkAck {
+		t.Fatalf("Expected the chunk acknowledged, got %v (%v)", msg, err)
+	}
+}
+
+func TestScanKeepsStatusSetMeanwhile(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	if err := os.WriteFile(a.path("doc.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// A scan from idle goes back to idle
+	if _, err := a.engine.scanFolderPair(a.pair, nil); err != nil {
+		t.Fatalf("scanFolderPair failed: %v", err)
+	}
+	if status, _ := a.engine.GetStatus(); status != StatusIdle {
+		t.Errorf("Expected idle after the scan, got %s", status)
+	}
+
+	// A sync starting during the scan keeps its status
+	started := false
+	a.engine.SetStatusCallback(func(status SyncStatus, _ string) {
+		if status == StatusScanning && !started {
+			started = true
+			a.engine.setStatus(StatusSyncing, "Syncing with device-b")
+		}
+	})
+	if _, err := a.engine.scanFolderPair(a.pair, nil); err != nil {
+		t.Fatalf("scanFolderPair failed: %v", err)
+	}
+	if !started {
+		t.Fatal("Expected the scan to report progress")
+	}
+	if status, _ := a.engine.GetStatus(); status != StatusSyncing {
+		t.Errorf("Expected the sync's status kept, got %s", status)
+	}
+}
+
+func TestPathsOutsideFolderRefused(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeTwoWay)
+	peer := connectRawPeer(t, a)
+	if err := os.WriteFile(a.path("doc.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	outside := filepath.Join(filepath.Dir(a.pair.LocalPath), "config.json")
+	if _, err := os.Stat(outside); err != nil {
+		t.Fatalf("Expected the configuration next to the folder: %v", err)
+	}
+
+	msg := exchange(t, peer, network.MsgTypeMoveFile, &network.MoveFilePayload{
+		FolderPairID: a.pair.ID,
+		FromPath:     "doc.txt",
+		ToPath:       "../moved.txt",
+	}, network.MsgTypeFileComplete)
+	var complete network.FileCompletePayload
+	if err := msg.ParsePayload(&complete); err != nil || complete.Success || complete.Error == "" {
+		t.Errorf("Expected the move refused, got %+v", complete)
+	}
+	if _, err := os.Stat(a.path("doc.txt")); err != nil {
+		t.Errorf("Expected the file to stay in place: %v", err)
+	}
+
+	// The pong answers after the deletion was handled
+	deletion, err := network.NewMessage(network.MsgTypeDeleteFile, &network.DeleteFilePayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "../config.json",
+	})
+	if err != nil {
+		t.Fatalf("NewMessage failed: %v", err)
+	}
+	if err := peer.WriteMessage(deletion); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	exchange(t, peer, network.MsgTypePing, nil, network.MsgTypePong)
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("Expected the file outside the folder kept: %v", err)
+	}
+
+	// A link in the folder doesn't lead the peer's changes out of it
+	elsewhere := t.TempDir()
+	os.WriteFile(filepath.Join(elsewhere, "victim.txt"), []byte("kept"), 0644)
+	if err := os.Symlink(elsewhere, a.path("out")); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	deletion, err = network.NewMessage(network.MsgTypeDeleteFile, &network.DeleteFilePayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "out/victim.txt",
+	})
+	if err != nil {
+		t.Fatalf("NewMessage failed: %v", err)
+	}
+	if err := peer.WriteMessage(deletion); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	exchange(t, peer, network.MsgTypePing, nil, network.MsgTypePong)
+	if _, err := os.Stat(filepath.Join(elsewhere, "victim.txt")); err != nil {
+		t.Errorf("Expected the file behind the link kept: %v", err)
+	}
+
+	msg = exchange(t, peer, network.MsgTypeDirectory, &network.DirectoryPayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "out/made",
+	}, network.MsgTypeFileComplete)
+	complete = network.FileCompletePayload{}
+	if err := msg.ParsePayload(&complete); err != nil || complete.Success || complete.Error == "" {
+		t.Errorf("Expected the folder behind the link refused, got %+v", complete)
+	}
+	if _, err := os.Stat(filepath.Join(elsewhere, "made")); !os.IsNotExist(err) {
+		t.Errorf("Expected no folder made behind the link, got %v", err)
+	}
+
+	msg = exchange(t, peer, network.MsgTypeMoveFile, &network.MoveFilePayload{
+		FolderPairID: a.pair.ID,
+		FromPath:     "doc.txt",
+		ToPath:       "out/moved.txt",
+	}, network.MsgTypeFileRequest)
+	if _, err := os.Stat(filepath.Join(elsewhere, "moved.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing moved behind the link, got %v", err)
+	}
+	msg = exchange(t, peer, network.MsgTypeFileResponse, &network.FileResponsePayload{
+		FolderPairID: a.pair.ID,
+		FilePath:     "out/moved.txt",
+		Size:         7,
+	}, network.MsgTypeFileComplete)
+	complete = network.FileCompletePayload{}
+	if err := msg.ParsePayload(&complete); err != nil || complete.Success || complete.Error == "" {
+		t.Errorf("Expected the file behind the link refused, got %+v", complete)
+	}
+}
+
+func TestAnalyzeFolderPairAfterSync(t *testing.T) {
+	a, b := newTestPeers(t, models.SyncModeTwoWay, models.SyncModeTwoWay)
+	os.WriteFile(a.path("pushed.txt"), []byte("from a"), 0644)
+	os.WriteFile(b.path("pulled.txt"), []byte("from b"), 0644)
+
+	// Before any sync the peer's files are unknown
+	preview, err := a.engine.AnalyzeFolderPair(a.pair.ID)
+	if err != nil {
+		t.Fatalf("AnalyzeFolderPair failed: %v", err)
+	}
+	if preview.PushCount != 1 || len(preview.ToDelete) != 0 {
+		t.Errorf("Expected pushed.txt to push and nothing to delete, got %d pushes and %d deletions", preview.PushCount, len(preview.ToDelete))
+	}
+
+	a.sync(t)
+	waitForContent(t, a.path("pulled.txt"), "from b")
+	waitForContent(t, b.path("pushed.txt"), "from a")
+	waitFor(t, "both files in the base index", func() bool {
+		base, _ := a.engine.indexManager.LoadIndex(a.pair.ID)
+		return base != nil && base.Files["pushed.txt"] != nil && base.Files["pulled.txt"] != nil &&
+			base.Files["pushed.txt"].Hash != "" && base.Files["pulled.txt"].Hash != ""
+	})
+
+	for _, p := range []*testPeer{a, b} {
+		preview, err := p.engine.AnalyzeFolderPair(p.pair.ID)
+		if err != nil {
+			t.Fatalf("AnalyzeFolderPair failed: %v", err)
+		}
+		if len(preview.ToPush) != 0 || len(preview.ToPull) != 0 || len(preview.ToDelete) != 0 || len(preview.ToDeleteRemote) != 0 {
+			t.Errorf("Expected %s in sync, got %d pushes, %d pulls and %d deletions",
+				p.id, len(preview.ToPush), len(preview.ToPull), len(preview.ToDelete)+len(preview.ToDeleteRemote))
+		}
+	}
+
+	// A synced file deleted here is deleted on the peer by the next sync
+	if err := os.Remove(a.path("pulled.txt")); err != nil {
+		t.Fatalf("Failed to delete file: %v", err)
+	}
+	preview, err = a.engine.AnalyzeFolderPair(a.pair.ID)
+	if err != nil {
+		t.Fatalf("AnalyzeFolderPair failed: %v", err)
+	}
+	if preview.DeleteRemoteCount != 1 || preview.ToDeleteRemote[0].Path != "pulled.txt" || preview.DeleteCount != 0 {
+		t.Errorf("Expected pulled.txt to be deleted on the peer, got %d remote and %d local deletions",
+			preview.DeleteRemoteCount, preview.DeleteCount)
+	}
+}
@@ -0,0 +1,176 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// racyWindow is how recent a modification must be for its hash not to be
+// cached. A file written again within the same mtime tick would otherwise
+// keep a stale hash.
+const racyWindow = 2 * time.Second
+
+// hashCacheEntry is the cached hash of a file along with the metadata it
+// was computed for
+type hashCacheEntry struct {
+	Size    int64              `json:"size"`
+	ModTime int64              `json:"modTime"` // Unix nanoseconds
+	Inode   uint64             `json:"inode,omitempty"`
+	Hash    string             `json:"hash"`
+	Chunked bool               `json:"chunked,omitempty"` // Whether the file's chunks were recorded
+	Chunks  []models.FileChunk `json:"chunks,omitempty"`
+}
+
+// HashCache persists file hashes keyed by absolute path so unchanged files
+// are not hashed again. An entry is only used while the file's size, mtime
+// and inode still match.
+type HashCache struct {
+	path    string
+	entries map[string]*hashCacheEntry
+	dirty   bool
+	mu      sync.Mutex
+}
+
+// NewHashCache loads the hash cache stored at path, starting empty if the
+// file doesn't exist or can't be parsed
+func NewHashCache(path string) (*HashCache, error) {
+	c := &HashCache{
+		path:    path,
+		entries: make(map[string]*hashCacheEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		// A corrupt cache only costs a rehash
+		c.entries = make(map[string]*hashCacheEntry)
+	}
+	return c, nil
+}
+
+// Lookup returns the cached hash of a file if its metadata is unchanged
+func (c *HashCache) Lookup(path string, info os.FileInfo) (string, bool) {
+	entry := c.lookup(path, info)
+	if entry == nil {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// LookupChunks returns the cached hash and chunks of a file if its
+// metadata is unchanged and its chunks were recorded
+func (c *HashCache) LookupChunks(path string, info os.FileInfo) (string, []models.FileChunk, bool) {
+	entry := c.lookup(path, info)
+	if entry == nil || !entry.Chunked {
+		return "", nil, false
+	}
+	return entry.Hash, entry.Chunks, true
+}
+
+func (c *HashCache) lookup(path string, info os.FileInfo) *hashCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[path]
+	if !ok || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.Inode != fileInode(info) {
+		return nil
+	}
+	return entry
+}
+
+// Store records the hash of a file with its current metadata
+func (c *HashCache) Store(path string, info os.FileInfo, hash string) {
+	c.store(path, info, &hashCacheEntry{Hash: hash})
+}
+
+// StoreChunks records the hash and chunks of a file with its current
+// metadata
+func (c *HashCache) StoreChunks(path string, info os.FileInfo, hash string, chunks []models.FileChunk) {
+	c.store(path, info, &hashCacheEntry{Hash: hash, Chunked: true, Chunks: chunks})
+}
+
+func (c *HashCache) store(path string, info os.FileInfo, entry *hashCacheEntry) {
+	if time.Since(info.ModTime()) < racyWindow {
+		return
+	}
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime().UnixNano()
+	entry.Inode = fileInode(info)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[path] = entry
+	c.dirty = true
+}
+
+// Invalidate drops the cached hashes of every file below rootPath, forcing
+// them to be read and hashed again
+func (c *HashCache) Invalidate(rootPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.entries {
+		if underRoot(path, rootPath) {
+			delete(c.entries, path)
+			c.dirty = true
+		}
+	}
+}
+
+// Prune drops the entries below rootPath for which keep returns false
+func (c *HashCache) Prune(rootPath string, keep func(path string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for path := range c.entries {
+		if underRoot(path, rootPath) && !keep(path) {
+			delete(c.entries, path)
+			c.dirty = true
+		}
+	}
+}
+
+// Save writes the cache to disk if it changed since it was last saved
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hash cache: %w", err)
+	}
+
+	// Write to a temp file first so a crash never leaves a truncated cache
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write hash cache: %w", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return fmt.Errorf("failed to write hash cache: %w", err)
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// underRoot reports whether path is rootPath or lies below it
+func underRoot(path, rootPath string) bool {
+	rootPath = filepath.Clean(rootPath)
+	return path == rootPath || strings.HasPrefix(path, rootPath+string(filepath.Separator))
+}
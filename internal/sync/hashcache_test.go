@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeOldFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// Outside the racy window so the hash can be cached
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(path, old, old)
+}
+
+func TestHashCacheReusesHashes(t *testing.T) {
+	root := t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "hashcache.json")
+	filePath := filepath.Join(root, "a.txt")
+	writeOldFile(t, filePath, "original")
+
+	cache, err := NewHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("NewHashCache failed: %v", err)
+	}
+	scanner := NewScanner(nil)
+	scanner.SetHashCache(cache)
+
+	first, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// Reload from disk and plant a different hash for unchanged metadata
+	cache, err = NewHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("NewHashCache failed: %v", err)
+	}
+	info, _ := os.Stat(filePath)
+	if hash, ok := cache.Lookup(filePath, info); !ok || hash != first.Files["a.txt"].Hash {
+		t.Fatalf("Expected persisted hash %s, got %s (found %v)", first.Files["a.txt"].Hash, hash, ok)
+	}
+	cache.Store(filePath, info, "cached")
+	scanner.SetHashCache(cache)
+
+	second, _ := scanner.ScanDirectory(context.Background(), root)
+	if second.Files["a.txt"].Hash != "cached" {
+		t.Errorf("Expected cached hash to be reused, got %s", second.Files["a.txt"].Hash)
+	}
+
+	// Changing the metadata invalidates the entry
+	writeOldFile(t, filePath, "modified content")
+	third, _ := scanner.ScanDirectory(context.Background(), root)
+	if third.Files["a.txt"].Hash == "cached" {
+		t.Error("Expected a modified file to be rehashed")
+	}
+}
+
+func TestHashCacheInvalidate(t *testing.T) {
+	root := t.TempDir()
+	filePath := filepath.Join(root, "a.txt")
+	writeOldFile(t, filePath, "data")
+
+	cache, _ := NewHashCache(filepath.Join(t.TempDir(), "hashcache.json"))
+	info, _ := os.Stat(filePath)
+	cache.Store(filePath, info, "cached")
+
+	cache.Invalidate(root)
+	if _, ok := cache.Lookup(filePath, info); ok {
+		t.Error("Expected invalidated entry to be gone")
+	}
+}
+
+func TestHashCacheSkipsRecentFiles(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(filePath, []byte("fresh"), 0644)
+
+	cache, _ := NewHashCache(filepath.Join(t.TempDir(), "hashcache.json"))
+	info, _ := os.Stat(filePath)
+	cache.Store(filePath, info, "cached")
+
+	if _, ok := cache.Lookup(filePath, info); ok {
+		t.Error("Files modified within the racy window should not be cached")
+	}
+}
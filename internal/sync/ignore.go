@@ -0,0 +1,232 @@
+package sync
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// IgnoreFileName is the ignore file read from the root of a folder pair.
+// It syncs like any other file so both sides share the same rules.
+const IgnoreFileName = ".syncdevignore"
+
+// gitIgnoreFileName is the per-directory ignore file of Git
+const gitIgnoreFileName = ".gitignore"
+
+// ignoreRule is a single ignore pattern using .gitignore syntax
+type ignoreRule struct {
+	pattern string
+	negate  bool // "!pattern" re-includes what earlier rules excluded
+	dirOnly bool // "pattern/" only matches directories
+	re      *regexp.Regexp
+}
+
+// ignoreRules is an ordered list of ignore rules where the last matching
+// rule decides
+type ignoreRules []*ignoreRule
+
+// parseIgnoreRules parses .gitignore style lines. base is the directory,
+// relative to the scanned root with forward slashes, that anchored
+// patterns are relative to ("" for the root).
+func parseIgnoreRules(lines []string, base string) ignoreRules {
+	var rules ignoreRules
+	for _, line := range lines {
+		if rule := parseIgnoreRule(line, base); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// readIgnoreFile reads the lines of an ignore file
+func readIgnoreFile(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// parseIgnoreRule parses one line, returning nil for blanks and comments
+func parseIgnoreRule(line, base string) *ignoreRule {
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	rule := &ignoreRule{pattern: line}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	// A slash anywhere but the end anchors the pattern to its directory;
+	// otherwise it matches a name at any depth
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+	if base != "" {
+		line = base + "/" + line
+	}
+
+	re, err := regexp.Compile("^" + ignoreRegexp(line) + "$")
+	if err != nil {
+		return nil
+	}
+	rule.re = re
+	return rule
+}
+
+// ignoreRegexp translates an anchored .gitignore pattern to a regexp
+func ignoreRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// Zero or more directories
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			// Everything inside
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// match returns whether the rules decide about relPath, a path relative to
+// the scanned root with forward slashes, and whether it is ignored
+func (rules ignoreRules) match(relPath string, isDir bool) (matched, ignored bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(relPath) {
+			return true, !rule.negate
+		}
+	}
+	return false, false
+}
+
+// gitIgnores matches paths against the ignore files of a Git working tree.
+// Each directory's .gitignore is read the first time a path below it is
+// matched.
+type gitIgnores struct {
+	rootPath string
+	exclude  ignoreRules // .git/info/exclude
+	dirs     map[string]ignoreRules
+	mu       sync.Mutex
+}
+
+func newGitIgnores(rootPath string) *gitIgnores {
+	g := &gitIgnores{
+		rootPath: rootPath,
+		dirs:     make(map[string]ignoreRules),
+	}
+	if lines, err := readIgnoreFile(filepath.Join(rootPath, ".git", "info", "exclude")); err == nil {
+		g.exclude = parseIgnoreRules(lines, "")
+	}
+	return g
+}
+
+// rules returns the rules of the .gitignore in dir, a path relative to the
+// root with forward slashes ("" for the root)
+func (g *gitIgnores) rules(dir string) ignoreRules {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	rules, ok := g.dirs[dir]
+	if !ok {
+		if lines, err := readIgnoreFile(filepath.Join(g.rootPath, filepath.FromSlash(dir), gitIgnoreFileName)); err == nil {
+			rules = parseIgnoreRules(lines, dir)
+		}
+		g.dirs[dir] = rules
+	}
+	return rules
+}
+
+// ignored applies Git's precedence: the .gitignore closest to relPath
+// decides, then those of its parent directories, then .git/info/exclude.
+// Callers check parent directories first, as Git never looks inside an
+// ignored directory.
+func (g *gitIgnores) ignored(relPath string, isDir bool) bool {
+	dir := relPath
+	for dir != "" {
+		if dir = path.Dir(dir); dir == "." {
+			dir = ""
+		}
+		if matched, ignored := g.rules(dir).match(relPath, isDir); matched {
+			return ignored
+		}
+	}
+	_, ignored := g.exclude.match(relPath, isDir)
+	return ignored
+}
+
+// ignoreFileDir reports whether relPath is an ignore file the scanner
+// reads, and the directory whose exclusions it affects
+func (s *Scanner) ignoreFileDir(relPath string) (string, bool) {
+	relPath = filepath.ToSlash(relPath)
+	switch {
+	case relPath == IgnoreFileName:
+		return ".", true
+	case s.git != nil && relPath == ".git/info/exclude":
+		return ".", true
+	case s.git != nil && path.Base(relPath) == gitIgnoreFileName:
+		return filepath.FromSlash(path.Dir(relPath)), true
+	}
+	return "", false
+}
@@ -0,0 +1,136 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules := parseIgnoreRules([]string{
+		"# comment",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"cache/",
+		"docs/**/*.tmp",
+	}, "")
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"app.log", false, true},
+		{"sub/dir/app.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"build", true, true},
+		{"sub/build", true, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"sub/cache", true, true},
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"other/a.tmp", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, tt := range tests {
+		if _, ignored := rules.match(tt.path, tt.isDir); ignored != tt.ignored {
+			t.Errorf("Expected ignored=%v for %s (dir=%v), got %v", tt.ignored, tt.path, tt.isDir, ignored)
+		}
+	}
+}
+
+func TestFolderScannerMergesIgnoreFile(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "vendor", "lib"), 0755)
+	os.WriteFile(filepath.Join(root, "vendor", "lib", "a.go"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "notes.bak"), []byte("bak"), 0644)
+	os.WriteFile(filepath.Join(root, "keep.bak"), []byte("keep"), 0644)
+	os.WriteFile(filepath.Join(root, "secret.env"), []byte("env"), 0644)
+	os.WriteFile(filepath.Join(root, "main.go"), []byte("main"), 0644)
+	os.WriteFile(filepath.Join(root, IgnoreFileName), []byte("vendor/\n!keep.bak\n"), 0644)
+
+	scanner := NewFolderScanner(root, []string{"*.bak"}, []string{"*.env"})
+	index, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	for _, path := range []string{"vendor", filepath.Join("vendor", "lib", "a.go"), "notes.bak", "secret.env"} {
+		if index.Files[path] != nil {
+			t.Errorf("Expected %s to be excluded", path)
+		}
+	}
+	for _, path := range []string{"main.go", "keep.bak", IgnoreFileName} {
+		if index.Files[path] == nil {
+			t.Errorf("Expected %s to be scanned", path)
+		}
+	}
+}
+
+func TestGitIgnoreScanning(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		full := filepath.Join(root, filepath.FromSlash(path))
+		os.MkdirAll(filepath.Dir(full), 0755)
+		os.WriteFile(full, []byte(content), 0644)
+	}
+	write(".git/info/exclude", "local.txt\n")
+	write(".gitignore", "*.log\nbuild/\n")
+	write("app/.gitignore", "!important.log\n/dist\n")
+	write("app/lib/.gitignore", "*.gen.go\n")
+
+	write("main.go", "main")
+	write("local.txt", "local")
+	write("debug.log", "log")
+	write("build/out.bin", "bin")
+	write("app/important.log", "keep")
+	write("app/other.log", "log")
+	write("app/dist/bundle.js", "js")
+	write("app/src/dist/file.txt", "nested dist")
+	write("app/lib/types.gen.go", "gen")
+	write("app/lib/types.go", "types")
+	write("other/types.gen.go", "not ignored here")
+
+	scanner := NewScanner(nil)
+	scanner.SetGitIgnore(root)
+	index, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	excluded := []string{"local.txt", "debug.log", "build", "build/out.bin", "app/other.log", "app/dist", "app/lib/types.gen.go"}
+	for _, path := range excluded {
+		if index.Files[filepath.FromSlash(path)] != nil {
+			t.Errorf("Expected %s to be excluded", path)
+		}
+	}
+	included := []string{"main.go", ".gitignore", "app/.gitignore", "app/important.log", "app/src/dist/file.txt", "app/lib/types.go", "other/types.gen.go"}
+	for _, path := range included {
+		if index.Files[filepath.FromSlash(path)] == nil {
+			t.Errorf("Expected %s to be scanned", path)
+		}
+	}
+}
+
+func TestGitIgnoreOverriddenByScannerPatterns(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, ".gitignore"), []byte(".env\n"), 0644)
+	os.WriteFile(filepath.Join(root, ".env"), []byte("env"), 0644)
+
+	scanner := NewScanner([]string{"!.env"})
+	scanner.SetGitIgnore(root)
+	if scanner.isExcludedPath(".env", false) {
+		t.Error("Expected a re-include in the scanner's patterns to override .gitignore")
+	}
+
+	scanner = NewScanner(nil)
+	scanner.SetGitIgnore(root)
+	if !scanner.isExcludedPath(".env", false) {
+		t.Error("Expected .env to be excluded by .gitignore")
+	}
+}
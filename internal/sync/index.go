@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -33,7 +35,11 @@ func NewIndexManager(indexDir string) (*IndexManager, error) {
 func (im *IndexManager) LoadIndex(folderPairID string) (*models.FileIndex, error) {
 	im.mu.Lock()
 	defer im.mu.Unlock()
+	return im.loadUnlocked(folderPairID)
+}
 
+// loadUnlocked loads an index without locking (caller must hold lock)
+func (im *IndexManager) loadUnlocked(folderPairID string) (*models.FileIndex, error) {
 	// Check cache first
 	if idx, ok := im.indices[folderPairID]; ok {
 		return idx, nil
@@ -62,7 +68,11 @@ func (im *IndexManager) LoadIndex(folderPairID string) (*models.FileIndex, error
 func (im *IndexManager) SaveIndex(folderPairID string, index *models.FileIndex) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
+	return im.saveUnlocked(folderPairID, index)
+}
 
+// saveUnlocked saves an index without locking (caller must hold lock)
+func (im *IndexManager) saveUnlocked(folderPairID string, index *models.FileIndex) error {
 	index.UpdatedAt = time.Now()
 	im.indices[folderPairID] = index
 
@@ -79,6 +89,32 @@ func (im *IndexManager) SaveIndex(folderPairID string, index *models.FileIndex)
 	return nil
 }
 
+// UpdateIndex applies updates to a stored index and persists it.
+// A nil entry in updates removes that path.
+func (im *IndexManager) UpdateIndex(folderPairID string, updates map[string]*models.FileInfo) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	index, err := im.loadUnlocked(folderPairID)
+	if err != nil {
+		return err
+	}
+
+	// Copy before merging so readers of the cached index never see a
+	// partially updated map
+	updated := &models.FileIndex{
+		Files: make(map[string]*models.FileInfo),
+	}
+	if index != nil {
+		updated.FolderPath = index.FolderPath
+		for path, info := range index.Files {
+			updated.Files[path] = info
+		}
+	}
+
+	return im.saveUnlocked(folderPairID, MergeIndex(updated, updates))
+}
+
 // DeleteIndex deletes an index from disk and cache
 func (im *IndexManager) DeleteIndex(folderPairID string) error {
 	im.mu.Lock()
@@ -92,13 +128,35 @@ func (im *IndexManager) DeleteIndex(folderPairID string) error {
 	return nil
 }
 
+// localIndexKey returns the index key of a folder pair's last local scan,
+// which carries the version vectors between scans
+func localIndexKey(folderPairID string) string {
+	return folderPairID + "_local"
+}
+
+// remoteIndexKey returns the index key of the peer's index as last
+// received for a folder pair, used to preview the next sync
+func remoteIndexKey(folderPairID string) string {
+	return folderPairID + "_remote"
+}
+
 // getIndexPath returns the path for an index file
 func (im *IndexManager) getIndexPath(folderPairID string) string {
 	return filepath.Join(im.indexDir, folderPairID+".json")
 }
 
-// CompareIndices compares local and remote indices to determine sync actions
-func CompareIndices(local, remote *models.FileIndex) []*models.SyncAction {
+// CompareIndices compares local and remote indices to determine sync actions.
+// base is the last index both sides agreed on (may be nil on the first sync);
+// it lets a missing file be told apart as "deleted here" or "created there".
+func CompareIndices(local, remote, base *models.FileIndex) []*models.SyncAction {
+	return CompareIndicesWithModes(local, remote, base, models.SyncModeTwoWay, models.SyncModeTwoWay)
+}
+
+// CompareIndicesWithModes is CompareIndices for a folder pair whose sides
+// use the given sync modes. Actions that would move changes in a direction
+// either side refuses are dropped, and a mirror side overrides every
+// difference on the other side.
+func CompareIndicesWithModes(local, remote, base *models.FileIndex, localMode, remoteMode models.SyncMode) []*models.SyncAction {
 	var actions []*models.SyncAction
 
 	// Build a set of all paths
@@ -116,48 +174,176 @@ func CompareIndices(local, remote *models.FileIndex) []*models.SyncAction {
 
 	// Compare each path
 	for path := range allPaths {
-		var localFile, remoteFile *models.FileInfo
+		var localFile, remoteFile, baseFile *models.FileInfo
 		if local != nil {
 			localFile = local.Files[path]
 		}
 		if remote != nil {
 			remoteFile = remote.Files[path]
 		}
+		if base != nil {
+			baseFile = base.Files[path]
+		}
 
-		action := compareFiles(path, localFile, remoteFile)
+		action := compareFiles(path, localFile, remoteFile, baseFile)
 		if action != nil {
 			actions = append(actions, action)
 		}
 	}
 
+	actions = detectMoves(actions)
+	actions = applySyncModes(actions, local, remote, localMode, remoteMode)
+	actions = dropUnsafeDirDeletes(actions, local, remote)
+	sortActions(actions)
 	return actions
 }
 
-// compareFiles compares two file infos and returns the appropriate action
-func compareFiles(path string, local, remote *models.FileInfo) *models.SyncAction {
-	// Only exists locally -> push to remote
+// applySyncModes restricts actions to the directions both sync modes allow
+func applySyncModes(actions []*models.SyncAction, local, remote *models.FileIndex, localMode, remoteMode models.SyncMode) []*models.SyncAction {
+	switch {
+	case localMode == models.SyncModeMirror && remoteMode.CanReceive():
+		return mirrorActions(actions, local, remote, true)
+	case remoteMode == models.SyncModeMirror && localMode.CanReceive():
+		return mirrorActions(actions, local, remote, false)
+	}
+
+	canSend := localMode.CanSend() && remoteMode.CanReceive()
+	canReceive := localMode.CanReceive() && remoteMode.CanSend()
+	if canSend && canReceive {
+		return actions
+	}
+
+	filtered := actions[:0]
+	for _, action := range actions {
+		if (sends(action) && !canSend) || (!sends(action) && !canReceive) {
+			continue
+		}
+		filtered = append(filtered, action)
+	}
+	return filtered
+}
+
+// sends reports whether an action changes the peer's copy rather than the
+// local one
+func sends(action *models.SyncAction) bool {
+	switch action.Action {
+	case models.FileActionPush:
+		return true
+	case models.FileActionDelete:
+		return action.LocalFile == nil
+	case models.FileActionMove:
+		return action.LocalFile != nil
+	default:
+		return false
+	}
+}
+
+// mirrorActions makes the target side match the source side: changes made
+// on the source are kept and changes made on the target are undone.
+// localIsSource tells which side is the mirror source.
+func mirrorActions(actions []*models.SyncAction, local, remote *models.FileIndex, localIsSource bool) []*models.SyncAction {
+	source, target := remote, local
+	if localIsSource {
+		source, target = local, remote
+	}
+
+	// setFile places an entry on the local or remote side of an action
+	setFile := func(action *models.SyncAction, onSource bool, file *models.FileInfo) {
+		if onSource == localIsSource {
+			action.LocalFile = file
+		} else {
+			action.RemoteFile = file
+		}
+	}
+
+	mirrored := make([]*models.SyncAction, 0, len(actions))
+	for _, action := range actions {
+		action.Conflict = false
+		if sends(action) == localIsSource {
+			mirrored = append(mirrored, action)
+			continue
+		}
+
+		path := actionPath(action)
+		undo := &models.SyncAction{}
+
+		if action.Action == models.FileActionMove {
+			// Rename the target's copy back to where the source has it
+			original := source.Files[action.FromPath]
+			if original == nil {
+				continue
+			}
+			undo.Action = models.FileActionMove
+			undo.FromPath = path
+			undo.Reason = "Move reverted to match mirror source"
+			setFile(undo, true, original)
+		} else if file := source.Files[path]; file != nil {
+			// Overwrite or restore the target's copy
+			undo.Action = models.FileActionPull
+			if localIsSource {
+				undo.Action = models.FileActionPush
+			}
+			undo.Reason = "Restored from mirror source"
+			setFile(undo, true, file)
+		} else if file := target.Files[path]; file != nil {
+			undo.Action = models.FileActionDelete
+			undo.Reason = "Not in mirror source"
+			setFile(undo, false, file)
+		} else {
+			continue
+		}
+		mirrored = append(mirrored, undo)
+	}
+	return mirrored
+}
+
+// compareFiles compares two file infos against their common ancestor and
+// returns the appropriate action
+func compareFiles(path string, local, remote, base *models.FileInfo) *models.SyncAction {
+	// Only exists locally -> either created here or deleted on remote
 	if local != nil && remote == nil {
+		if base != nil && unchangedSince(local, base) {
+			return &models.SyncAction{
+				Action:    models.FileActionDelete,
+				LocalFile: local,
+				Reason:    "File was deleted on remote",
+			}
+		}
+		reason := "File only exists locally"
+		if base != nil {
+			reason = "File changed locally after remote deletion"
+		}
 		return &models.SyncAction{
 			Action:    models.FileActionPush,
 			LocalFile: local,
-			Reason:    "File only exists locally",
+			Reason:    reason,
 		}
 	}
 
-	// Only exists remotely -> pull from remote
+	// Only exists remotely -> either created there or deleted locally
 	if local == nil && remote != nil {
+		if base != nil && unchangedSince(remote, base) {
+			return &models.SyncAction{
+				Action:     models.FileActionDelete,
+				RemoteFile: remote,
+				Reason:     "File was deleted locally",
+			}
+		}
+		reason := "File only exists on remote"
+		if base != nil {
+			reason = "File changed on remote after local deletion"
+		}
 		return &models.SyncAction{
 			Action:     models.FileActionPull,
 			RemoteFile: remote,
-			Reason:     "File only exists on remote",
+			Reason:     reason,
 		}
 	}
 
 	// Both exist - compare
 	if local != nil && remote != nil {
-		// Directories don't need content comparison
-		if local.IsDir && remote.IsDir {
-			return nil
+		if sameContent(local, remote) {
+			return nil // Files are identical
 		}
 
 		// If one is a dir and one is a file, that's a conflict
@@ -179,43 +365,376 @@ func compareFiles(path string, local, remote *models.FileInfo) *models.SyncActio
 			}
 		}
 
-		// Compare by hash if available
-		if local.Hash != "" && remote.Hash != "" {
-			if local.Hash == remote.Hash {
-				return nil // Files are identical
-			}
-		} else {
-			// Fallback to size and modtime
-			if local.Size == remote.Size && local.ModTime.Equal(remote.ModTime) {
-				return nil // Probably identical
-			}
-		}
-
-		// Files differ - use last-write-wins
-		if local.ModTime.After(remote.ModTime) {
+		// Version vectors order the edits without relying on clocks
+		switch local.Version.Compare(remote.Version) {
+		case models.VersionDominates:
 			return &models.SyncAction{
 				Action:     models.FileActionPush,
 				LocalFile:  local,
 				RemoteFile: remote,
-				Reason:     "Local file is newer",
+				Reason:     "Local version dominates",
 			}
-		} else if remote.ModTime.After(local.ModTime) {
+		case models.VersionDominated:
 			return &models.SyncAction{
 				Action:     models.FileActionPull,
 				LocalFile:  local,
 				RemoteFile: remote,
-				Reason:     "Remote file is newer",
+				Reason:     "Remote version dominates",
 			}
 		}
 
-		// Same modtime but different content - this shouldn't happen
-		// but if it does, don't do anything to avoid data loss
-		return nil
+		// Concurrent (or missing) histories: with a common ancestor, the
+		// side whose content still matches it is stale
+		if base != nil {
+			if sameContent(local, base) {
+				return &models.SyncAction{
+					Action:     models.FileActionPull,
+					LocalFile:  local,
+					RemoteFile: remote,
+					Reason:     "File changed on remote",
+				}
+			}
+			if sameContent(remote, base) {
+				return &models.SyncAction{
+					Action:     models.FileActionPush,
+					LocalFile:  local,
+					RemoteFile: remote,
+					Reason:     "File changed locally",
+				}
+			}
+		}
+
+		// Directories have nothing to keep a conflict copy of; the newer
+		// permissions win
+		if local.IsDir {
+			if local.ModTime.After(remote.ModTime) {
+				return &models.SyncAction{
+					Action:     models.FileActionPush,
+					LocalFile:  local,
+					RemoteFile: remote,
+					Reason:     "Folder changed on both sides, local is newer",
+				}
+			}
+			return &models.SyncAction{
+				Action:     models.FileActionPull,
+				LocalFile:  local,
+				RemoteFile: remote,
+				Reason:     "Folder changed on both sides, remote is newer",
+			}
+		}
+
+		// Both sides changed since the last common version
+		return conflictAction(local, remote)
 	}
 
 	return nil
 }
 
+// conflictAction resolves concurrent edits: the newer edit wins and the
+// other one is kept as a conflict copy
+func conflictAction(local, remote *models.FileInfo) *models.SyncAction {
+	if localWinsConflict(local, remote) {
+		return &models.SyncAction{
+			Action:     models.FileActionPush,
+			LocalFile:  local,
+			RemoteFile: remote,
+			Conflict:   true,
+			Reason:     "Conflicting edits, local is newer",
+		}
+	}
+	return &models.SyncAction{
+		Action:     models.FileActionPull,
+		LocalFile:  local,
+		RemoteFile: remote,
+		Conflict:   true,
+		Reason:     "Conflicting edits, remote is newer",
+	}
+}
+
+// localWinsConflict picks the winner of a conflict: the newer modification
+// time, falling back to the hash so the choice is always deterministic
+func localWinsConflict(local, remote *models.FileInfo) bool {
+	if !local.ModTime.Equal(remote.ModTime) {
+		return local.ModTime.After(remote.ModTime)
+	}
+	return local.Hash > remote.Hash
+}
+
+// sameContent reports whether two entries describe the same content
+func sameContent(a, b *models.FileInfo) bool {
+	if a.IsDir || b.IsDir {
+		// Directories have no content; only their permissions change.
+		// Entries without permissions don't know them.
+		return a.IsDir == b.IsDir && (a.Permission == b.Permission || a.Permission == 0 || b.Permission == 0)
+	}
+	if a.IsSymlink() != b.IsSymlink() {
+		return false
+	}
+
+	// Extended attributes count when both sides read them
+	if a.XattrHash != "" && b.XattrHash != "" && a.XattrHash != b.XattrHash {
+		return false
+	}
+
+	// Compare by hash if available
+	if a.Hash != "" && b.Hash != "" {
+		return a.Hash == b.Hash
+	}
+
+	// Fallback to size and modtime
+	return a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+}
+
+// unchangedSince reports whether an entry has had no edits since base
+func unchangedSince(f, base *models.FileInfo) bool {
+	if sameContent(f, base) {
+		return true
+	}
+	if len(f.Version) > 0 && len(base.Version) > 0 {
+		ordering := f.Version.Compare(base.Version)
+		return ordering == models.VersionEqual || ordering == models.VersionDominated
+	}
+	return false
+}
+
+// detectMoves pairs a deletion with a creation of the same content on the
+// same side and replaces both with a move, so the peer renames its copy
+// instead of receiving the content again
+func detectMoves(actions []*models.SyncAction) []*models.SyncAction {
+	// Candidate sources: files deleted on one side, keyed by side and hash
+	type source struct {
+		local bool
+		hash  string
+	}
+	sources := make(map[source][]*models.SyncAction)
+	for _, action := range actions {
+		if action.Action != models.FileActionDelete {
+			continue
+		}
+		// Deleted locally shows up as a remote deletion and vice versa
+		if f := action.RemoteFile; f != nil && isMovable(f) {
+			key := source{local: true, hash: f.Hash}
+			sources[key] = append(sources[key], action)
+		} else if f := action.LocalFile; f != nil && isMovable(f) {
+			key := source{local: false, hash: f.Hash}
+			sources[key] = append(sources[key], action)
+		}
+	}
+	if len(sources) == 0 {
+		return actions
+	}
+
+	moved := make(map[*models.SyncAction]bool)
+	for _, action := range actions {
+		var key source
+		switch {
+		case action.Action == models.FileActionPush && action.RemoteFile == nil && isMovable(action.LocalFile):
+			key = source{local: true, hash: action.LocalFile.Hash}
+		case action.Action == models.FileActionPull && action.LocalFile == nil && isMovable(action.RemoteFile):
+			key = source{local: false, hash: action.RemoteFile.Hash}
+		default:
+			continue
+		}
+
+		candidates := sources[key]
+		if len(candidates) == 0 {
+			continue
+		}
+		from := candidates[0]
+		sources[key] = candidates[1:]
+
+		moved[from] = true
+		action.Action = models.FileActionMove
+		action.FromPath = actionPath(from)
+		if key.local {
+			action.Reason = "File was moved locally"
+		} else {
+			action.Reason = "File was moved on remote"
+		}
+	}
+
+	if len(moved) == 0 {
+		return actions
+	}
+	filtered := actions[:0]
+	for _, action := range actions {
+		if !moved[action] {
+			filtered = append(filtered, action)
+		}
+	}
+	return filtered
+}
+
+// isMovable reports whether an entry can be matched by content for a move
+func isMovable(f *models.FileInfo) bool {
+	return !f.IsDir && f.Hash != "" && f.Size > 0
+}
+
+// dropUnsafeDirDeletes removes directory deletions for directories that
+// still contain entries which are not being deleted or moved away
+func dropUnsafeDirDeletes(actions []*models.SyncAction, local, remote *models.FileIndex) []*models.SyncAction {
+	deleted := make(map[string]bool)
+	for _, action := range actions {
+		switch action.Action {
+		case models.FileActionDelete:
+			deleted[actionPath(action)] = true
+		case models.FileActionMove:
+			deleted[action.FromPath] = true
+		}
+	}
+
+	filtered := actions[:0]
+	for _, action := range actions {
+		if action.Action == models.FileActionDelete {
+			var file *models.FileInfo
+			var index *models.FileIndex
+			if action.LocalFile != nil {
+				file, index = action.LocalFile, local
+			} else {
+				file, index = action.RemoteFile, remote
+			}
+			if file.IsDir && hasSurvivingChildren(file.Path, index, deleted) {
+				continue
+			}
+		}
+		filtered = append(filtered, action)
+	}
+	return filtered
+}
+
+// hasSurvivingChildren checks whether any entry below dir is kept
+func hasSurvivingChildren(dir string, index *models.FileIndex, deleted map[string]bool) bool {
+	prefix := dir + string(filepath.Separator)
+	for path := range index.Files {
+		if strings.HasPrefix(path, prefix) && !deleted[path] {
+			return true
+		}
+	}
+	return false
+}
+
+// sortActions orders transfers by path and runs deletions last, deepest
+// paths first, so files are removed before their parent directories
+func sortActions(actions []*models.SyncAction) {
+	sort.SliceStable(actions, func(i, j int) bool {
+		di := actions[i].Action == models.FileActionDelete
+		dj := actions[j].Action == models.FileActionDelete
+		if di != dj {
+			return dj
+		}
+		if di {
+			return actionPath(actions[i]) > actionPath(actions[j])
+		}
+		return actionPath(actions[i]) < actionPath(actions[j])
+	})
+}
+
+// actionPath returns the relative path an action applies to
+func actionPath(action *models.SyncAction) string {
+	if action.LocalFile != nil {
+		return action.LocalFile.Path
+	}
+	if action.RemoteFile != nil {
+		return action.RemoteFile.Path
+	}
+	return ""
+}
+
+// BuildBaseIndex returns the entries that are identical on both sides.
+// It is the common ancestor saved for the next three-way comparison; files
+// still being transferred are added once the transfer is confirmed.
+func BuildBaseIndex(local, remote *models.FileIndex) *models.FileIndex {
+	base := &models.FileIndex{
+		Files: make(map[string]*models.FileInfo),
+	}
+	if local == nil || remote == nil {
+		return base
+	}
+
+	base.FolderPath = local.FolderPath
+	for path, localFile := range local.Files {
+		if remoteFile, ok := remote.Files[path]; ok && sameContent(localFile, remoteFile) {
+			// Identical content settles any divergent history
+			agreed := *localFile
+			agreed.Version = localFile.Version.Merge(remoteFile.Version)
+			base.Files[path] = &agreed
+		}
+	}
+	return base
+}
+
+// keepRefusedBase adds back to agreed the entries of base that a side whose
+// mode can't send changed, while the other side still has the base
+// content. The change is never sent, so it stays a local change of that
+// side, measured from base, rather than becoming a new file.
+func keepRefusedBase(agreed, base, local, remote *models.FileIndex, localMode, remoteMode models.SyncMode) {
+	if base == nil || agreed == nil {
+		return
+	}
+	for path, info := range base.Files {
+		if _, ok := agreed.Files[path]; ok {
+			continue
+		}
+		var kept *models.FileInfo
+		if local != nil && remote != nil {
+			if !localMode.CanSend() {
+				kept = remote.Files[path]
+			} else if !remoteMode.CanSend() {
+				kept = local.Files[path]
+			}
+		}
+		if kept != nil && sameContent(kept, info) {
+			agreed.Files[path] = info
+		}
+	}
+}
+
+// scopeIndex returns the entries of index that lie within paths
+func scopeIndex(index *models.FileIndex, paths []string) *models.FileIndex {
+	return filterIndex(index, func(path string, _ *models.FileInfo) bool {
+		return inScope(path, paths)
+	})
+}
+
+// filterIndex returns the entries of index for which keep returns true
+func filterIndex(index *models.FileIndex, keep func(path string, info *models.FileInfo) bool) *models.FileIndex {
+	if index == nil {
+		return nil
+	}
+
+	filtered := &models.FileIndex{
+		FolderPath: index.FolderPath,
+		Files:      make(map[string]*models.FileInfo),
+		UpdatedAt:  index.UpdatedAt,
+	}
+	for path, info := range index.Files {
+		if keep(path, info) {
+			filtered.Files[path] = info
+		}
+	}
+	return filtered
+}
+
+// rebaseIndex replaces the entries of base that were compared with the
+// newly agreed entries, keeping the rest of base as it was
+func rebaseIndex(base, agreed *models.FileIndex, compared func(path string, info *models.FileInfo) bool) *models.FileIndex {
+	rebased := &models.FileIndex{
+		FolderPath: agreed.FolderPath,
+		Files:      make(map[string]*models.FileInfo),
+	}
+	if base != nil {
+		for path, info := range base.Files {
+			if !compared(path, info) {
+				rebased.Files[path] = info
+			}
+		}
+	}
+	for path, info := range agreed.Files {
+		rebased.Files[path] = info
+	}
+	return rebased
+}
+
 // MergeIndex merges updates into an existing index
 func MergeIndex(existing *models.FileIndex, updates map[string]*models.FileInfo) *models.FileIndex {
 	if existing == nil {
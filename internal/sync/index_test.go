@@ -0,0 +1,387 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"SyncDev/internal/models"
+)
+
+func newIndex(files ...*models.FileInfo) *models.FileIndex {
+	index := &models.FileIndex{Files: make(map[string]*models.FileInfo)}
+	for _, f := range files {
+		index.Files[f.Path] = f
+	}
+	return index
+}
+
+func file(path, hash string) *models.FileInfo {
+	return &models.FileInfo{Path: path, Hash: hash, Size: int64(len(hash)), ModTime: time.Unix(1700000000, 0)}
+}
+
+func dir(path string) *models.FileInfo {
+	return &models.FileInfo{Path: path, IsDir: true}
+}
+
+func findAction(actions []*models.SyncAction, path string) *models.SyncAction {
+	for _, a := range actions {
+		if actionPath(a) == path {
+			return a
+		}
+	}
+	return nil
+}
+
+func TestCompareIndicesPropagatesDeletions(t *testing.T) {
+	base := newIndex(file("a.txt", "h1"), file("b.txt", "h2"))
+	local := newIndex(file("b.txt", "h2"))  // a.txt deleted locally
+	remote := newIndex(file("a.txt", "h1")) // b.txt deleted on remote
+
+	actions := CompareIndices(local, remote, base)
+	if len(actions) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(actions))
+	}
+
+	a := findAction(actions, "a.txt")
+	if a == nil || a.Action != models.FileActionDelete || a.RemoteFile == nil || a.LocalFile != nil {
+		t.Errorf("Expected remote delete for a.txt, got %+v", a)
+	}
+
+	b := findAction(actions, "b.txt")
+	if b == nil || b.Action != models.FileActionDelete || b.LocalFile == nil || b.RemoteFile != nil {
+		t.Errorf("Expected local delete for b.txt, got %+v", b)
+	}
+}
+
+func TestCompareIndicesWithoutBaseKeepsFiles(t *testing.T) {
+	local := newIndex(file("a.txt", "h1"))
+	remote := newIndex(file("b.txt", "h2"))
+
+	actions := CompareIndices(local, remote, nil)
+
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected push for a.txt, got %+v", a)
+	}
+	if b := findAction(actions, "b.txt"); b == nil || b.Action != models.FileActionPull {
+		t.Errorf("Expected pull for b.txt, got %+v", b)
+	}
+}
+
+func TestCompareIndicesModifiedBeatsDeleted(t *testing.T) {
+	base := newIndex(file("a.txt", "h1"))
+	local := newIndex(file("a.txt", "h1-edited"))
+	remote := newIndex()
+
+	actions := CompareIndices(local, remote, base)
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected edited file to be pushed back, got %+v", a)
+	}
+}
+
+func TestCompareIndicesUsesBaseForEdits(t *testing.T) {
+	base := newIndex(file("a.txt", "h1"))
+	local := newIndex(file("a.txt", "h1"))
+	remote := newIndex(file("a.txt", "h2"))
+	// Local mtime is newer but its content is the ancestor's
+	local.Files["a.txt"].ModTime = time.Now()
+
+	actions := CompareIndices(local, remote, base)
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPull {
+		t.Errorf("Expected pull of remote edit, got %+v", a)
+	}
+}
+
+func TestCompareIndicesKeepsNonEmptyDirectories(t *testing.T) {
+	base := newIndex(dir("docs"), file("docs/old.txt", "h1"))
+	local := newIndex(dir("docs"), file("docs/old.txt", "h1"), file("docs/new.txt", "h2"))
+	remote := newIndex()
+
+	actions := CompareIndices(local, remote, base)
+
+	if a := findAction(actions, "docs"); a != nil {
+		t.Errorf("Directory with new content should not be deleted, got %+v", a)
+	}
+	if a := findAction(actions, "docs/old.txt"); a == nil || a.Action != models.FileActionDelete {
+		t.Errorf("Expected delete for docs/old.txt, got %+v", a)
+	}
+	if a := findAction(actions, "docs/new.txt"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected push for docs/new.txt, got %+v", a)
+	}
+}
+
+func TestCompareIndicesDeletesChildrenBeforeDirectory(t *testing.T) {
+	base := newIndex(dir("docs"), file("docs/a.txt", "h1"))
+	local := newIndex(dir("docs"), file("docs/a.txt", "h1"))
+	remote := newIndex()
+
+	actions := CompareIndices(local, remote, base)
+	if len(actions) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(actions))
+	}
+	if actionPath(actions[0]) != "docs/a.txt" || actionPath(actions[1]) != "docs" {
+		t.Errorf("Expected file deletion before directory, got %s then %s",
+			actionPath(actions[0]), actionPath(actions[1]))
+	}
+}
+
+func TestCompareIndicesDirectories(t *testing.T) {
+	withMode := func(path string, perm uint32, modTime int64) *models.FileInfo {
+		d := dir(path)
+		d.Permission = perm
+		d.ModTime = time.Unix(modTime, 0)
+		return d
+	}
+	base := newIndex(withMode("shared", 0755, 1), withMode("private", 0755, 1))
+	local := newIndex(withMode("shared", 0755, 1), withMode("private", 0700, 2), withMode("empty", 0755, 2))
+	remote := newIndex(withMode("shared", 0755, 1), withMode("private", 0755, 1))
+
+	actions := CompareIndices(local, remote, base)
+	if len(actions) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(actions))
+	}
+	if a := findAction(actions, "empty"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected a new empty directory to be pushed, got %+v", a)
+	}
+	if a := findAction(actions, "private"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected changed permissions to be pushed, got %+v", a)
+	}
+
+	// Permissions changed on both sides go the newer way, without a
+	// conflict copy
+	remote.Files["private"] = withMode("private", 0750, 3)
+	actions = CompareIndices(local, remote, base)
+	if a := findAction(actions, "private"); a == nil || a.Action != models.FileActionPull || a.Conflict {
+		t.Errorf("Expected the newer permissions to be pulled, got %+v", a)
+	}
+}
+
+func TestBuildBaseIndex(t *testing.T) {
+	local := newIndex(file("same.txt", "h1"), file("diff.txt", "h2"), file("local.txt", "h3"))
+	remote := newIndex(file("same.txt", "h1"), file("diff.txt", "h4"), file("remote.txt", "h5"))
+
+	base := BuildBaseIndex(local, remote)
+	if len(base.Files) != 1 || base.Files["same.txt"] == nil {
+		t.Errorf("Expected only same.txt in base, got %v", base.Files)
+	}
+}
+
+func TestIndexManagerUpdateIndex(t *testing.T) {
+	im, err := NewIndexManager(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create index manager: %v", err)
+	}
+
+	if err := im.SaveIndex("pair", newIndex(file("a.txt", "h1"))); err != nil {
+		t.Fatalf("SaveIndex failed: %v", err)
+	}
+	before, _ := im.LoadIndex("pair")
+
+	err = im.UpdateIndex("pair", map[string]*models.FileInfo{
+		"a.txt": nil,
+		"b.txt": file("b.txt", "h2"),
+	})
+	if err != nil {
+		t.Fatalf("UpdateIndex failed: %v", err)
+	}
+
+	after, _ := im.LoadIndex("pair")
+	if after.Files["a.txt"] != nil || after.Files["b.txt"] == nil {
+		t.Errorf("Unexpected index after update: %v", after.Files)
+	}
+	if before.Files["a.txt"] == nil {
+		t.Error("Previously loaded index should not be modified in place")
+	}
+}
+
+func TestCompareIndicesDetectsConflicts(t *testing.T) {
+	base := newIndex(file("a.txt", "h1"))
+	local := newIndex(file("a.txt", "h2"))
+	remote := newIndex(file("a.txt", "h3"))
+	remote.Files["a.txt"].ModTime = local.Files["a.txt"].ModTime.Add(time.Minute)
+
+	actions := CompareIndices(local, remote, base)
+	a := findAction(actions, "a.txt")
+	if a == nil || a.Action != models.FileActionPull || !a.Conflict {
+		t.Errorf("Expected conflicting pull for a.txt, got %+v", a)
+	}
+}
+
+func TestCompareIndicesConflictWithSameModTime(t *testing.T) {
+	local := newIndex(file("a.txt", "h2"))
+	remote := newIndex(file("a.txt", "h3"))
+
+	actions := CompareIndices(local, remote, nil)
+	a := findAction(actions, "a.txt")
+	if a == nil || !a.Conflict {
+		t.Fatalf("Expected a conflict for a.txt, got %+v", a)
+	}
+	if a.Action != models.FileActionPull {
+		t.Errorf("Expected higher hash to win deterministically, got %s", a.Action)
+	}
+}
+
+func TestCompareIndicesUsesVersionVectors(t *testing.T) {
+	local := newIndex(file("a.txt", "h1"))
+	remote := newIndex(file("a.txt", "h2"))
+	local.Files["a.txt"].Version = models.VersionVector{"A": 2, "B": 1}
+	remote.Files["a.txt"].Version = models.VersionVector{"A": 1, "B": 1}
+	// A reset mtime must not decide the winner
+	local.Files["a.txt"].ModTime = time.Unix(0, 0)
+
+	actions := CompareIndices(local, remote, nil)
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPush || a.Conflict {
+		t.Errorf("Expected push of dominating version, got %+v", a)
+	}
+
+	remote.Files["a.txt"].Version = models.VersionVector{"A": 1, "B": 2}
+	actions = CompareIndices(local, remote, nil)
+	if a := findAction(actions, "a.txt"); a == nil || !a.Conflict {
+		t.Errorf("Expected conflict for concurrent versions, got %+v", a)
+	}
+}
+
+func TestCompareIndicesTypeConflictBeforeVersions(t *testing.T) {
+	local := newIndex(dir("a"))
+	remote := newIndex(file("a", "h1"))
+	local.Files["a"].Version = models.VersionVector{"A": 2}
+	remote.Files["a"].Version = models.VersionVector{"A": 1}
+	remote.Files["a"].ModTime = time.Unix(1800000000, 0)
+
+	// A directory replaced by a file is resolved by time, whatever the
+	// versions say
+	actions := CompareIndices(local, remote, nil)
+	if a := findAction(actions, "a"); a == nil || a.Action != models.FileActionPull || a.Reason != "Type conflict, remote is newer" {
+		t.Errorf("Expected the newer file to replace the directory, got %+v", a)
+	}
+}
+
+func TestUpdateVersions(t *testing.T) {
+	scanner := NewScanner(nil)
+	previous := newIndex(file("same.txt", "h1"), file("edited.txt", "h2"))
+	previous.Files["same.txt"].Version = models.VersionVector{"B": 3}
+	previous.Files["edited.txt"].Version = models.VersionVector{"B": 3}
+
+	current := newIndex(file("same.txt", "h1"), file("edited.txt", "h2-new"), file("new.txt", "h3"))
+	scanner.UpdateVersions(current, previous, "A")
+
+	if v := current.Files["same.txt"].Version; v.Compare(models.VersionVector{"B": 3}) != models.VersionEqual {
+		t.Errorf("Unchanged file should keep its version, got %v", v)
+	}
+	if v := current.Files["edited.txt"].Version; v.Compare(models.VersionVector{"A": 1, "B": 3}) != models.VersionEqual {
+		t.Errorf("Edited file should bump the local counter, got %v", v)
+	}
+	if v := current.Files["new.txt"].Version; v.Compare(models.VersionVector{"A": 1}) != models.VersionEqual {
+		t.Errorf("New file should start at the local counter, got %v", v)
+	}
+}
+
+func TestCompareIndicesDetectsMoves(t *testing.T) {
+	base := newIndex(file("old.txt", "h1"), file("theirs.txt", "h2"))
+	local := newIndex(file("new.txt", "h1"), file("theirs.txt", "h2"))        // old.txt moved locally
+	remote := newIndex(file("old.txt", "h1"), file("moved/theirs.txt", "h2")) // theirs.txt moved on remote
+
+	actions := CompareIndices(local, remote, base)
+	if len(actions) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(actions))
+	}
+
+	a := findAction(actions, "new.txt")
+	if a == nil || a.Action != models.FileActionMove || a.FromPath != "old.txt" || a.RemoteFile != nil {
+		t.Errorf("Expected remote move from old.txt to new.txt, got %+v", a)
+	}
+
+	b := findAction(actions, "moved/theirs.txt")
+	if b == nil || b.Action != models.FileActionMove || b.FromPath != "theirs.txt" || b.LocalFile != nil {
+		t.Errorf("Expected local move from theirs.txt to moved/theirs.txt, got %+v", b)
+	}
+}
+
+func TestCompareIndicesMoveRequiresSameContent(t *testing.T) {
+	base := newIndex(file("old.txt", "h1"))
+	local := newIndex(file("new.txt", "h1-edited"))
+	remote := newIndex(file("old.txt", "h1"))
+
+	actions := CompareIndices(local, remote, base)
+	if a := findAction(actions, "new.txt"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected push for edited file, got %+v", a)
+	}
+	if a := findAction(actions, "old.txt"); a == nil || a.Action != models.FileActionDelete {
+		t.Errorf("Expected delete for old.txt, got %+v", a)
+	}
+}
+
+func TestCompareIndicesMovedOutOfDirectory(t *testing.T) {
+	base := newIndex(dir("docs"), file("docs/a.txt", "h1"))
+	local := newIndex(file("a.txt", "h1"))
+	remote := newIndex(dir("docs"), file("docs/a.txt", "h1"))
+
+	actions := CompareIndices(local, remote, base)
+	if len(actions) != 2 {
+		t.Fatalf("Expected 2 actions, got %d", len(actions))
+	}
+	if actions[0].Action != models.FileActionMove || actionPath(actions[1]) != "docs" {
+		t.Errorf("Expected move before directory deletion, got %s then %s",
+			actions[0].Action, actionPath(actions[1]))
+	}
+}
+
+func TestCompareIndicesSendOnly(t *testing.T) {
+	base := newIndex(file("a.txt", "h1"), file("b.txt", "h2"))
+	local := newIndex(file("a.txt", "h1-edited"), file("b.txt", "h2"))
+	remote := newIndex(file("a.txt", "h1"), file("b.txt", "h2-edited"), file("c.txt", "h3"))
+
+	actions := CompareIndicesWithModes(local, remote, base, models.SyncModeSendOnly, models.SyncModeReceiveOnly)
+	if len(actions) != 1 {
+		t.Fatalf("Expected only the local edit to be sent, got %d actions", len(actions))
+	}
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPush {
+		t.Errorf("Expected push for a.txt, got %+v", a)
+	}
+
+	// The receiving side never sends its own edits
+	actions = CompareIndicesWithModes(remote, local, base, models.SyncModeReceiveOnly, models.SyncModeSendOnly)
+	if len(actions) != 1 {
+		t.Fatalf("Expected only the incoming edit, got %d actions", len(actions))
+	}
+	if a := findAction(actions, "a.txt"); a == nil || a.Action != models.FileActionPull {
+		t.Errorf("Expected pull for a.txt, got %+v", a)
+	}
+}
+
+func TestCompareIndicesMirror(t *testing.T) {
+	base := newIndex(file("kept.txt", "h1"), file("edited.txt", "h2"), file("removed.txt", "h3"), file("old.txt", "h4"))
+	source := newIndex(file("kept.txt", "h1"), file("edited.txt", "h2"), file("removed.txt", "h3"), file("old.txt", "h4"))
+	target := newIndex(file("edited.txt", "h2-target"), file("removed.txt", "h3"), file("extra.txt", "h5"), file("new.txt", "h4"))
+	delete(target.Files, "removed.txt") // deleted on the target
+
+	// The source restores, overwrites and deletes on the target
+	actions := CompareIndicesWithModes(source, target, base, models.SyncModeMirror, models.SyncModeReceiveOnly)
+	expected := map[string]models.FileAction{
+		"kept.txt":    models.FileActionPush,
+		"edited.txt":  models.FileActionPush,
+		"removed.txt": models.FileActionPush,
+		"extra.txt":   models.FileActionDelete,
+		"old.txt":     models.FileActionMove,
+	}
+	if len(actions) != len(expected) {
+		t.Fatalf("Expected %d actions, got %d", len(expected), len(actions))
+	}
+	for path, action := range expected {
+		a := findAction(actions, path)
+		if a == nil || a.Action != action || a.Conflict {
+			t.Errorf("Expected %s for %s, got %+v", action, path, a)
+		}
+	}
+	if a := findAction(actions, "old.txt"); a != nil && a.FromPath != "new.txt" {
+		t.Errorf("Expected move back from new.txt, got %+v", a)
+	}
+
+	// The target comes to the same conclusion from its side
+	actions = CompareIndicesWithModes(target, source, base, models.SyncModeReceiveOnly, models.SyncModeMirror)
+	if a := findAction(actions, "extra.txt"); a == nil || a.Action != models.FileActionDelete || a.LocalFile == nil {
+		t.Errorf("Expected local delete for extra.txt, got %+v", a)
+	}
+	if a := findAction(actions, "edited.txt"); a == nil || a.Action != models.FileActionPull {
+		t.Errorf("Expected pull for edited.txt, got %+v", a)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package sync
+
+import "os"
+
+// fileInode returns 0: file IDs are not exposed through os.FileInfo here,
+// so cached hashes rely on path, size and mtime alone
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
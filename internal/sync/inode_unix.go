@@ -0,0 +1,16 @@
+//go:build unix
+
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file, or 0 if it is unknown
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
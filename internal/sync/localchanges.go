@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LocalChange is a local edit that a receive-only folder pair keeps to
+// itself instead of sending to the peer
+type LocalChange struct {
+	Path   string `json:"path"`
+	IsDir  bool   `json:"isDir"`
+	Change string `json:"change"` // "added", "modified", "deleted"
+}
+
+// GetLocalChanges lists the local edits of a folder pair since the last
+// agreed state. Nothing is listed before the first sync.
+func (e *Engine) GetLocalChanges(folderPairID string) ([]*LocalChange, error) {
+	fp := e.config.Get().GetFolderPair(folderPairID)
+	if fp == nil {
+		return nil, fmt.Errorf("folder pair not found: %s", folderPairID)
+	}
+
+	base, err := e.indexManager.LoadIndex(fp.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load base index: %w", err)
+	}
+	changes := make([]*LocalChange, 0)
+	if base == nil {
+		return changes, nil
+	}
+
+	local, err := e.scanFolderPair(fp, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan local directory: %w", err)
+	}
+
+	for path, f := range local.Files {
+		agreed, ok := base.Files[path]
+		switch {
+		case !ok:
+			changes = append(changes, &LocalChange{Path: path, IsDir: f.IsDir, Change: "added"})
+		case !sameContent(f, agreed):
+			changes = append(changes, &LocalChange{Path: path, IsDir: f.IsDir, Change: "modified"})
+		}
+	}
+	for path, f := range base.Files {
+		if _, ok := local.Files[path]; !ok {
+			changes = append(changes, &LocalChange{Path: path, IsDir: f.IsDir, Change: "deleted"})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// RevertLocalChanges undoes the local edits of a receive-only folder pair:
+// added entries are removed and modified or deleted files are fetched
+// again from the peer. Changes that can't be reverted, or whose files
+// can't be requested again, are reported in the returned error.
+func (e *Engine) RevertLocalChanges(folderPairID string) error {
+	cfg := e.config.Get()
+	fp := cfg.GetFolderPair(folderPairID)
+	if fp == nil {
+		return fmt.Errorf("folder pair not found: %s", folderPairID)
+	}
+	if fp.Mode != models.SyncModeReceiveOnly {
+		return fmt.Errorf("only receive-only folder pairs can revert local changes")
+	}
+
+	peer := cfg.GetPeer(fp.PeerID)
+	if peer == nil {
+		return fmt.Errorf("peer not found: %s", fp.PeerID)
+	}
+	discoveredPeer := e.discovery.GetPeer(fp.PeerID)
+	if discoveredPeer == nil || discoveredPeer.Status != models.PeerStatusOnline {
+		return fmt.Errorf("peer is offline: %s", peer.Name)
+	}
+	peer.Host = discoveredPeer.Host
+	peer.Port = discoveredPeer.Port
+
+	changes, err := e.GetLocalChanges(folderPairID)
+	if err != nil {
+		return err
+	}
+	base, err := e.indexManager.LoadIndex(fp.ID)
+	if err != nil || base == nil {
+		return fmt.Errorf("failed to load base index: %v", err)
+	}
+
+	conn, err := e.getOrCreateConnection(peer)
+	if err != nil {
+		return fmt.Errorf("failed to connect to peer: %w", err)
+	}
+
+	var failed []error
+	fail := func(relPath string, err error) {
+		failed = append(failed, fmt.Errorf("%s: %w", relPath, err))
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "error",
+			FolderPair:  fp.ID,
+			FilePath:    relPath,
+			PeerName:    conn.PeerName,
+			Description: fmt.Sprintf("Revert failed: %v", err),
+		})
+	}
+
+	// Deepest paths first so added directories are empty when removed
+	for i := len(changes) - 1; i >= 0; i-- {
+		change := changes[i]
+		if change.Change != "added" {
+			file := base.Files[change.Path]
+			switch {
+			case file.IsDir:
+				e.createDirectory(conn, fp, file.Path, file.Permission, file.Version)
+			case file.IsSymlink():
+				e.pullSymlink(conn, fp, file)
+			default:
+				if err := e.requestFile(conn, fp, file); err != nil {
+					fail(change.Path, err)
+				}
+			}
+			continue
+		}
+
+		err := checkLocalPath(fp.LocalPath, change.Path)
+		if err == nil {
+			err = DeleteFile(diskPath(fp.LocalPath, change.Path))
+		}
+		if err != nil {
+			fail(change.Path, err)
+			continue
+		}
+		e.addEvent(&SyncEvent{
+			Time:        time.Now(),
+			Type:        "delete",
+			FolderPair:  fp.ID,
+			FilePath:    change.Path,
+			PeerName:    conn.PeerName,
+			Description: "Local addition reverted",
+		})
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to revert %d of %d local changes: %w", len(failed), len(changes), errors.Join(failed...))
+	}
+	return nil
+}
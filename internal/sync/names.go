@@ -0,0 +1,210 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// errCaseCollision refuses changes that would overwrite a file whose name
+// differs only by case
+var errCaseCollision = errors.New("name differs only by case from an existing file")
+
+// errPathOutsideRoot refuses paths from a peer that lead out of the folder
+var errPathOutsideRoot = errors.New("path is outside the folder")
+
+// checkRelPath returns errPathOutsideRoot unless relPath, as sent by a peer,
+// names an entry inside its folder
+func checkRelPath(relPath string) error {
+	clean := filepath.Clean(filepath.FromSlash(relPath))
+	if clean == "." || filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || escapesRoot(clean) {
+		return errPathOutsideRoot
+	}
+	return nil
+}
+
+// checkLocalPath is checkRelPath for a path about to be written, moved or
+// deleted below rootPath. The folder holding it, with its links resolved,
+// must lie inside rootPath too; folders not created yet are checked by the
+// nearest one that exists.
+func checkLocalPath(rootPath, relPath string) error {
+	if err := checkRelPath(relPath); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(diskPath(rootPath, relPath))
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if !insideRoot(rootPath, resolved) {
+				return errPathOutsideRoot
+			}
+			return nil
+		}
+		parent := filepath.Dir(dir)
+		if !os.IsNotExist(err) || parent == dir {
+			return errPathOutsideRoot
+		}
+		dir = parent
+	}
+}
+
+// normalizePath returns relPath in the Unicode form index keys use. macOS
+// stores names decomposed (NFD) while most other tools compose them (NFC),
+// so the same name may arrive in either.
+func normalizePath(relPath string) string {
+	return norm.NFC.String(relPath)
+}
+
+// foldPath returns the key paths that a case-insensitive volume can't tell
+// apart have in common
+func foldPath(relPath string) string {
+	return cases.Fold().String(normalizePath(relPath))
+}
+
+// diskPath returns the full path of relPath below rootPath as the file is
+// named on disk, which may be decomposed while the index key is composed.
+// Each name is looked up on its own, as a path may mix both forms.
+func diskPath(rootPath, relPath string) string {
+	fullPath := filepath.Join(rootPath, relPath)
+	if _, err := os.Lstat(fullPath); !os.IsNotExist(err) {
+		return fullPath
+	}
+
+	resolved := rootPath
+	names := strings.Split(filepath.Clean(relPath), string(filepath.Separator))
+	for i, name := range names {
+		found := false
+		for _, form := range []norm.Form{norm.NFC, norm.NFD} {
+			candidate := filepath.Join(resolved, form.String(name))
+			if _, err := os.Lstat(candidate); err == nil {
+				resolved, found = candidate, true
+				break
+			}
+		}
+		if !found {
+			// The rest doesn't exist yet and is created as named
+			return filepath.Join(append([]string{resolved}, names[i:]...)...)
+		}
+	}
+	return resolved
+}
+
+// cleanPeerFiles keys the files of an index sent by a peer by their
+// normalized paths, as peers that don't normalize send names in the form
+// their filesystem stores, and drops paths that lead out of the folder.
+// Where both forms of a name exist, the composed one is kept.
+func cleanPeerFiles(files map[string]*models.FileInfo) map[string]*models.FileInfo {
+	clean := true
+	for path := range files {
+		if !norm.NFC.IsNormalString(path) || checkRelPath(path) != nil {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return files
+	}
+
+	result := make(map[string]*models.FileInfo, len(files))
+	for path, info := range files {
+		if norm.NFC.IsNormalString(path) && checkRelPath(path) == nil {
+			result[path] = info
+		}
+	}
+	for path, info := range files {
+		key := normalizePath(path)
+		if _, ok := result[key]; ok || checkRelPath(key) != nil {
+			continue
+		}
+		copied := *info
+		copied.Path = key
+		result[key] = &copied
+	}
+	return result
+}
+
+// caseInsensitive reports whether names under rootPath ignore case, going
+// by whether rootPath spelled in another case is the same directory
+func caseInsensitive(rootPath string) bool {
+	other := strings.ToUpper(rootPath)
+	if other == rootPath {
+		other = strings.ToLower(rootPath)
+	}
+	if other == rootPath {
+		return false
+	}
+
+	info, err := os.Stat(rootPath)
+	if err != nil {
+		return false
+	}
+	otherInfo, err := os.Stat(other)
+	return err == nil && os.SameFile(info, otherInfo)
+}
+
+// caseCollision returns the path of the entry that writing relPath below
+// rootPath would overwrite because its name differs only by case, or ""
+// if there is none
+func caseCollision(rootPath, relPath string) string {
+	fullPath := diskPath(rootPath, relPath)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return ""
+	}
+	entries, err := os.ReadDir(filepath.Dir(fullPath))
+	if err != nil {
+		return ""
+	}
+
+	name := normalizePath(filepath.Base(relPath))
+	for _, entry := range entries {
+		other := entry.Name()
+		if normalizePath(other) == name || foldPath(other) != foldPath(name) {
+			continue
+		}
+		if otherInfo, err := os.Lstat(filepath.Join(filepath.Dir(fullPath), other)); err == nil && os.SameFile(info, otherInfo) {
+			return filepath.ToSlash(filepath.Join(filepath.Dir(relPath), normalizePath(other)))
+		}
+	}
+	return ""
+}
+
+// caseCollisions splits off the pulls whose paths differ only by case from
+// another pull's path, as they would overwrite each other on a
+// case-insensitive volume. The first path in order is kept; the pulls split
+// off map to it.
+func caseCollisions(actions []*models.SyncAction) ([]*models.SyncAction, map[*models.SyncAction]string) {
+	var paths []string
+	for _, action := range actions {
+		if action.Action == models.FileActionPull {
+			paths = append(paths, action.RemoteFile.Path)
+		}
+	}
+	sort.Strings(paths)
+	first := make(map[string]string, len(paths))
+	for _, path := range paths {
+		if _, ok := first[foldPath(path)]; !ok {
+			first[foldPath(path)] = path
+		}
+	}
+
+	kept := make([]*models.SyncAction, 0, len(actions))
+	collided := make(map[*models.SyncAction]string)
+	for _, action := range actions {
+		if action.Action == models.FileActionPull {
+			if other := first[foldPath(action.RemoteFile.Path)]; other != action.RemoteFile.Path {
+				collided[action] = other
+				continue
+			}
+		}
+		kept = append(kept, action)
+	}
+	return kept, collided
+}
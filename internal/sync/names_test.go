@@ -0,0 +1,139 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+)
+
+func TestScanNormalizesNames(t *testing.T) {
+	root := t.TempDir()
+	composed := "caf\u00e9.txt"
+	decomposed := "cafe\u0301.txt"
+	if err := os.WriteFile(filepath.Join(root, decomposed), []byte("coffee"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	scanner := NewScanner(nil)
+	index, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	local := index.Files[composed]
+	if local == nil || len(index.Files) != 1 {
+		t.Fatalf("Expected the file indexed under its composed name, got %v", index.Files)
+	}
+
+	// The same file named the other way by a peer is not a difference
+	remote := &models.FileIndex{Files: cleanPeerFiles(map[string]*models.FileInfo{decomposed: {
+		Path:    decomposed,
+		Size:    local.Size,
+		ModTime: local.ModTime,
+		Hash:    local.Hash,
+	}})}
+	if actions := CompareIndices(index, remote, nil); len(actions) != 0 {
+		t.Errorf("Expected no actions for the same name in another form, got %d", len(actions))
+	}
+
+	// Files are found on disk under their index key
+	info, err := scanner.GetFileInfo(root, composed)
+	if err != nil {
+		t.Fatalf("Expected the file found by its composed name: %v", err)
+	}
+	if info.Hash != local.Hash {
+		t.Errorf("Expected hash %s, got %s", local.Hash, info.Hash)
+	}
+
+	// Each name in a path may be in either form
+	dir := filepath.Join(root, "cafe\u0301")
+	os.Mkdir(dir, 0755)
+	if err := os.WriteFile(filepath.Join(dir, "r\u00e9sum\u00e9.txt"), []byte("cv"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if data, err := os.ReadFile(diskPath(root, "caf\u00e9/r\u00e9sum\u00e9.txt")); err != nil || string(data) != "cv" {
+		t.Errorf("Expected the file in the decomposed directory found, got %q (%v)", data, err)
+	}
+	if path := diskPath(root, "caf\u00e9/new.txt"); path != filepath.Join(dir, "new.txt") {
+		t.Errorf("Expected a new file to go in the existing directory, got %s", path)
+	}
+
+	if err := MoveFile(root, composed, "moved.txt"); err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "moved.txt")); err != nil {
+		t.Errorf("Expected the decomposed file moved: %v", err)
+	}
+
+	// A move into a directory named the other way reuses the directory
+	if err := MoveFile(root, "moved.txt", "caf\u00e9/moved.txt"); err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "moved.txt")); err != nil {
+		t.Errorf("Expected the file moved into the decomposed directory: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "caf\u00e9")); !os.IsNotExist(err) {
+		t.Errorf("Expected no composed sibling of the directory, got %v", err)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	pull := func(path string) *models.SyncAction {
+		return &models.SyncAction{Action: models.FileActionPull, RemoteFile: &models.FileInfo{Path: path}}
+	}
+	readme, upper, other := pull("docs/Readme.md"), pull("docs/README.md"), pull("docs/notes.md")
+	push := &models.SyncAction{Action: models.FileActionPush, LocalFile: &models.FileInfo{Path: "docs/readme.md"}}
+	composed, decomposed := pull("Caf\u00e9.txt"), pull("cafe\u0301.txt")
+
+	kept, collided := caseCollisions([]*models.SyncAction{readme, push, upper, other, composed, decomposed})
+	if len(kept) != 4 {
+		t.Errorf("Expected 4 actions kept, got %d", len(kept))
+	}
+	if collided[readme] != "docs/README.md" {
+		t.Errorf("Expected Readme.md to collide with README.md, got %q", collided[readme])
+	}
+	if collided[decomposed] != "Caf\u00e9.txt" {
+		t.Errorf("Expected names differing by case and form to collide, got %q", collided[decomposed])
+	}
+	if _, ok := collided[upper]; ok {
+		t.Error("Expected the first path in order to be kept")
+	}
+	if _, ok := collided[other]; ok {
+		t.Error("Expected a file with another name to be kept")
+	}
+
+	// On a case-sensitive volume both files exist side by side
+	root := t.TempDir()
+	for _, name := range []string{"Readme.md", "README.md"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	if !caseInsensitive(root) {
+		if existing := caseCollision(root, "README.md"); existing != "" {
+			t.Errorf("Expected no collision between distinct files, got %s", existing)
+		}
+	}
+}
+
+func TestRevertDecomposedAddition(t *testing.T) {
+	a := newTestPeer(t, "device-a", "device-b", models.SyncModeReceiveOnly)
+	connectRawPeer(t, a)
+	if err := a.engine.indexManager.SaveIndex(a.pair.ID, &models.FileIndex{Files: map[string]*models.FileInfo{}}); err != nil {
+		t.Fatalf("SaveIndex failed: %v", err)
+	}
+
+	// The addition is listed under its composed name
+	decomposed := a.path("cafe\u0301.txt")
+	if err := os.WriteFile(decomposed, []byte("added"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := a.engine.RevertLocalChanges(a.pair.ID); err != nil {
+		t.Fatalf("RevertLocalChanges failed: %v", err)
+	}
+	if _, err := os.Lstat(decomposed); !os.IsNotExist(err) {
+		t.Errorf("Expected the decomposed addition removed, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// PartialTransfer is the saved state of an interrupted download. The temp
+// file of the download holds the first Received bytes of the file with
+// the given hash and size.
+type PartialTransfer struct {
+	Hash       string `json:"hash"`
+	Size       int64  `json:"size"`
+	Received   int64  `json:"received"`
+	PrefixHash string `json:"prefixHash"` // SHA-256 of the first Received bytes
+}
+
+// PartialStore persists the state of interrupted downloads, keyed like the
+// engine's file receivers, so they can resume after a disconnect or restart
+type PartialStore struct {
+	path    string
+	entries map[string]*PartialTransfer
+	mu      sync.Mutex
+}
+
+// NewPartialStore loads the partial transfer state stored at path,
+// starting empty if the file doesn't exist or can't be parsed
+func NewPartialStore(path string) (*PartialStore, error) {
+	s := &PartialStore{
+		path:    path,
+		entries: make(map[string]*PartialTransfer),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partial transfers: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		// Losing the state only means starting those downloads over
+		s.entries = make(map[string]*PartialTransfer)
+	}
+	return s, nil
+}
+
+// Get returns the saved state of a download, or nil
+func (s *PartialStore) Get(key string) *PartialTransfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries[key]
+}
+
+// Put saves the state of a download
+func (s *PartialStore) Put(key string, partial *PartialTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = partial
+	return s.save()
+}
+
+// Remove forgets the state of a download
+func (s *PartialStore) Remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[key]; !ok {
+		return nil
+	}
+	delete(s.entries, key)
+	return s.save()
+}
+
+// save writes the state to disk; the caller holds s.mu
+func (s *PartialStore) save() error {
+	data, err := json.Marshal(s.entries)
+	if err != nil {
+		return fmt.Errorf("failed to marshal partial transfers: %w", err)
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write partial transfers: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to write partial transfers: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package sync
 
 import (
 	"SyncDev/internal/models"
+	"sort"
 	"sync"
 	"time"
 )
@@ -26,6 +27,7 @@ type ProgressAggregator struct {
 
 	// Sync state
 	status      string
+	syncs       int // Syncs in progress; concurrent syncs share the totals
 	totalFiles  int
 	totalBytes  int64
 	startTime   time.Time
@@ -34,6 +36,7 @@ type ProgressAggregator struct {
 	fileProgress   map[string]*fileState
 	completedFiles int
 	completedBytes int64
+	failedFiles    int
 
 	// Speed smoothing
 	smoothedSpeed   float64
@@ -50,7 +53,8 @@ type fileState struct {
 	path        string
 	size        int64
 	transferred int64
-	status      string // "active", "pending", "complete"
+	status      string  // "active", "pending", "complete", "failed"
+	ratio       float64 // Compression ratio of the transfer, 0 if unknown
 }
 
 // NewProgressAggregator creates a new progress aggregator
@@ -62,11 +66,20 @@ func NewProgressAggregator(callback func(*models.AggregateProgress)) *ProgressAg
 	}
 }
 
-// StartSync initializes a new sync session
+// StartSync initializes a new sync session. A sync that starts while
+// others are in progress adds its files to the same session.
 func (p *ProgressAggregator) StartSync(totalFiles int, totalBytes int64) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	p.syncs++
+	if p.syncs > 1 {
+		p.totalFiles += totalFiles
+		p.totalBytes += totalBytes
+		p.emit()
+		return
+	}
+
 	p.status = "syncing"
 	p.totalFiles = totalFiles
 	p.totalBytes = totalBytes
@@ -76,12 +89,27 @@ func (p *ProgressAggregator) StartSync(totalFiles int, totalBytes int64) {
 	p.fileProgress = make(map[string]*fileState)
 	p.completedFiles = 0
 	p.completedBytes = 0
+	p.failedFiles = 0
 	p.smoothedSpeed = 0
 	p.lastBytesUpdate = 0
 
 	p.emit()
 }
 
+// QueueFile records a file waiting for its transfer to start
+func (p *ProgressAggregator) QueueFile(path string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.fileProgress[path]; !exists {
+		p.fileProgress[path] = &fileState{
+			path:   path,
+			size:   size,
+			status: "pending",
+		}
+	}
+}
+
 // UpdateFile updates progress for a specific file
 func (p *ProgressAggregator) UpdateFile(path string, size int64, transferred int64) {
 	p.mu.Lock()
@@ -98,6 +126,11 @@ func (p *ProgressAggregator) UpdateFile(path string, size int64, transferred int
 		p.fileProgress[path] = fs
 	}
 
+	if fs.status == "complete" || fs.status == "failed" {
+		// Late progress of a file that already finished
+		return
+	}
+
 	// Update transferred bytes
 	oldTransferred := fs.transferred
 	fs.transferred = transferred
@@ -109,24 +142,38 @@ func (p *ProgressAggregator) UpdateFile(path string, size int64, transferred int
 		p.updateSpeed(byteDelta)
 	}
 
-	// Check if file is complete
-	if transferred >= size && size > 0 {
-		fs.status = "complete"
-	}
-
 	// Throttled emit
 	p.scheduleEmit()
 }
 
-// CompleteFile marks a file as complete and updates counters
+// SetCompressionRatio records how well the transfer of a file compresses
+func (p *ProgressAggregator) SetCompressionRatio(path string, ratio float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if fs, exists := p.fileProgress[path]; exists {
+		fs.ratio = ratio
+	}
+}
+
+// CompleteFile marks a file as complete and updates counters. Completing
+// a file again has no effect.
 func (p *ProgressAggregator) CompleteFile(path string, size int64) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	fs, exists := p.fileProgress[path]
+	if exists && fs.status == "complete" {
+		return
+	}
 	if exists {
+		if fs.status == "failed" {
+			p.failedFiles--
+			p.totalBytes += fs.size
+		}
 		fs.status = "complete"
 		fs.transferred = fs.size
+		size = fs.size
 	} else {
 		p.fileProgress[path] = &fileState{
 			path:        path,
@@ -143,11 +190,41 @@ func (p *ProgressAggregator) CompleteFile(path string, size int64) {
 	p.emit()
 }
 
-// EndSync finalizes the sync session
+// FailFile marks a file whose transfer failed. Its bytes no longer count
+// towards the total, so the session can still reach 100%.
+func (p *ProgressAggregator) FailFile(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fs, exists := p.fileProgress[path]
+	if !exists || fs.status == "failed" {
+		return
+	}
+	if fs.status == "complete" {
+		p.completedFiles--
+		p.completedBytes -= fs.size
+	}
+	fs.status = "failed"
+	fs.transferred = 0
+	p.failedFiles++
+	p.totalBytes -= fs.size
+
+	p.emit()
+}
+
+// EndSync finalizes the sync session once no other sync is in progress
 func (p *ProgressAggregator) EndSync() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	if p.syncs > 0 {
+		p.syncs--
+	}
+	if p.syncs > 0 {
+		p.emit()
+		return
+	}
+
 	p.status = "complete"
 	p.emit()
 }
@@ -166,11 +243,13 @@ func (p *ProgressAggregator) Reset() {
 	defer p.mu.Unlock()
 
 	p.status = "idle"
+	p.syncs = 0
 	p.totalFiles = 0
 	p.totalBytes = 0
 	p.fileProgress = make(map[string]*fileState)
 	p.completedFiles = 0
 	p.completedBytes = 0
+	p.failedFiles = 0
 	p.smoothedSpeed = 0
 	p.lastBytesUpdate = 0
 }
@@ -227,8 +306,19 @@ func (p *ProgressAggregator) buildProgress() *models.AggregateProgress {
 	activeFiles := make([]models.FileProgress, 0, maxActiveFiles)
 	activeCount := 0
 
-	for _, fs := range p.fileProgress {
-		totalTransferred += fs.transferred
+	paths := make([]string, 0, len(p.fileProgress))
+	for path := range p.fileProgress {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		fs := p.fileProgress[path]
+
+		// Completed files are counted in completedBytes
+		if fs.status == "active" || fs.status == "pending" {
+			totalTransferred += fs.transferred
+		}
 
 		// Add to active files list (up to max)
 		if activeCount < maxActiveFiles && fs.status == "active" {
@@ -237,11 +327,12 @@ func (p *ProgressAggregator) buildProgress() *models.AggregateProgress {
 				percentage = float64(fs.transferred) / float64(fs.size) * 100
 			}
 			activeFiles = append(activeFiles, models.FileProgress{
-				Path:        fs.path,
-				Size:        fs.size,
-				Transferred: fs.transferred,
-				Percentage:  percentage,
-				Status:      fs.status,
+				Path:             fs.path,
+				Size:             fs.size,
+				Transferred:      fs.transferred,
+				Percentage:       percentage,
+				Status:           fs.status,
+				CompressionRatio: fs.ratio,
 			})
 			activeCount++
 		}
@@ -271,6 +362,7 @@ func (p *ProgressAggregator) buildProgress() *models.AggregateProgress {
 		Status:           p.status,
 		TotalFiles:       p.totalFiles,
 		CompletedFiles:   p.completedFiles,
+		FailedFiles:      p.failedFiles,
 		TotalBytes:       p.totalBytes,
 		TransferredBytes: totalTransferred,
 		Percentage:       percentage,
@@ -2,49 +2,267 @@ package sync
 
 import (
 	"SyncDev/internal/models"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
-
-	"github.com/gobwas/glob"
 )
 
 // Scanner scans directories and builds file indices
 type Scanner struct {
-	exclusions []glob.Glob
+	patterns   []string
+	exclusions ignoreRules
+	git        *gitIgnores
+	hashCache  *HashCache
+	chunking   bool
+	symlinks   models.SymlinkPolicy
+	xattrs     *xattrFilter
+	workers    int
+	onProgress func(*models.ScanProgress)
 }
 
-// NewScanner creates a new Scanner with the given exclusion patterns
+// scanProgressInterval limits how often scan progress is reported
+const scanProgressInterval = 200 * time.Millisecond
+
+// NewScanner creates a new Scanner with the given exclusion patterns. The
+// patterns use .gitignore syntax and the last matching pattern wins, so a
+// "!pattern" re-includes paths excluded before it.
 func NewScanner(exclusionPatterns []string) *Scanner {
-	var globs []glob.Glob
-	for _, pattern := range exclusionPatterns {
-		if g, err := glob.Compile(pattern); err == nil {
-			globs = append(globs, g)
-		}
-	}
 	return &Scanner{
-		exclusions: globs,
+		patterns:   exclusionPatterns,
+		exclusions: parseIgnoreRules(exclusionPatterns, ""),
+		workers:    runtime.NumCPU(),
+	}
+}
+
+// NewFolderScanner creates a Scanner for a folder pair's directory. Global
+// patterns come first, then the pair's patterns, then the folder's
+// .syncdevignore, so later sources can override earlier ones.
+func NewFolderScanner(rootPath string, globalPatterns, pairPatterns []string) *Scanner {
+	patterns := make([]string, 0, len(globalPatterns)+len(pairPatterns))
+	patterns = append(patterns, globalPatterns...)
+	patterns = append(patterns, pairPatterns...)
+	if lines, err := readIgnoreFile(filepath.Join(rootPath, IgnoreFileName)); err == nil {
+		patterns = append(patterns, lines...)
 	}
+	return NewScanner(patterns)
+}
+
+// SetGitIgnore makes the scanner also honor the .gitignore files of the
+// working tree at rootPath and its .git/info/exclude
+func (s *Scanner) SetGitIgnore(rootPath string) {
+	s.git = newGitIgnores(rootPath)
+}
+
+// GitIgnore reports whether the scanner honors .gitignore files
+func (s *Scanner) GitIgnore() bool {
+	return s.git != nil
+}
+
+// Patterns returns the exclusion patterns of the scanner in order
+func (s *Scanner) Patterns() []string {
+	return s.patterns
+}
+
+// SetChunking makes the scanner split files into content-defined chunks
+// while hashing them
+func (s *Scanner) SetChunking(enabled bool) {
+	s.chunking = enabled
+}
+
+// SetSymlinks sets what the scanner does with symlinks: leave them out,
+// index them as links, or index what they point to as if it were there
+func (s *Scanner) SetSymlinks(policy models.SymlinkPolicy) {
+	s.symlinks = policy
+}
+
+// SetXattrs makes the scanner read the extended attributes the settings
+// select, so changes to them count as changes to the file
+func (s *Scanner) SetXattrs(settings models.XattrSettings) {
+	s.xattrs = newXattrFilter(settings)
+}
+
+// SetHashCache sets the cache used to skip hashing unchanged files
+func (s *Scanner) SetHashCache(cache *HashCache) {
+	s.hashCache = cache
 }
 
-// ScanDirectory scans a directory and returns a file index
-func (s *Scanner) ScanDirectory(rootPath string) (*models.FileIndex, error) {
+// SetProgressCallback sets the callback for scan progress
+func (s *Scanner) SetProgressCallback(cb func(*models.ScanProgress)) {
+	s.onProgress = cb
+}
+
+// ScanDirectory scans a directory and returns a file index. Files are
+// hashed in parallel; cancelling ctx aborts the scan.
+func (s *Scanner) ScanDirectory(ctx context.Context, rootPath string) (*models.FileIndex, error) {
 	index := &models.FileIndex{
 		FolderPath: rootPath,
 		Files:      make(map[string]*models.FileInfo),
 		UpdatedAt:  time.Now(),
 	}
 
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+	if err := s.scanInto(ctx, index, rootPath, []string{rootPath}); err != nil {
+		return nil, err
+	}
+
+	// Forget hashes of files that are gone
+	if s.hashCache != nil {
+		s.hashCache.Prune(rootPath, func(path string) bool {
+			relPath, err := filepath.Rel(rootPath, path)
+			return err == nil && index.Files[normalizePath(relPath)] != nil
+		})
+	}
+
+	return index, nil
+}
+
+// ScanPaths rescans only the given relative paths, and everything below
+// them, on top of a previous scan of rootPath. Paths that no longer exist
+// are dropped from the result.
+func (s *Scanner) ScanPaths(ctx context.Context, rootPath string, previous *models.FileIndex, paths []string) (*models.FileIndex, error) {
+	index := &models.FileIndex{
+		FolderPath: rootPath,
+		Files:      make(map[string]*models.FileInfo),
+		UpdatedAt:  time.Now(),
+	}
+	scope := make([]string, len(paths))
+	for i, path := range paths {
+		scope[i] = normalizePath(path)
+	}
+	for path, info := range previous.Files {
+		if !inScope(path, scope) {
+			index.Files[path] = info
+		}
+	}
+
+	starts := make([]string, 0, len(paths))
+	for _, path := range paths {
+		fullPath := filepath.Join(rootPath, path)
+		info, err := os.Lstat(fullPath)
+		if !s.isExcludedPath(path, err == nil && info.IsDir()) {
+			starts = append(starts, fullPath)
+		}
+	}
+	if err := s.scanInto(ctx, index, rootPath, starts); err != nil {
+		return nil, err
+	}
+
+	return index, nil
+}
+
+// hashJob is a file found by the walk that still needs its hash
+type hashJob struct {
+	path     string
+	info     os.FileInfo
+	fileInfo *models.FileInfo
+}
+
+// scanInto walks each start path, which is rootPath or a path below it,
+// and adds every entry that isn't excluded to index. The walk feeds files
+// to a pool of hashing workers.
+func (s *Scanner) scanInto(ctx context.Context, index *models.FileIndex, rootPath string, starts []string) error {
+	progress := &scanTracker{
+		progress: models.ScanProgress{RootPath: rootPath},
+		cb:       s.onProgress,
+	}
+
+	var mu sync.Mutex
+	add := func(fileInfo *models.FileInfo) {
+		mu.Lock()
+		index.Files[fileInfo.Path] = fileInfo
+		mu.Unlock()
+	}
+
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan *hashJob, workers*2)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				hash, chunks, err := s.cachedHash(ctx, job.path, job.info)
+				if err != nil {
+					// Skip files we can't hash
+					continue
+				}
+				job.fileInfo.Hash = hash
+				job.fileInfo.Chunks = chunks
+				add(job.fileInfo)
+				progress.add(job.info.Size())
+			}
+		}()
+	}
+
+	var walkErr error
+	for _, start := range starts {
+		walkErr = s.walk(ctx, rootPath, start, func(path string, info os.FileInfo, fileInfo *models.FileInfo) error {
+			if info.IsDir() || fileInfo.IsSymlink() {
+				add(fileInfo)
+				return nil
+			}
+			select {
+			case jobs <- &hashJob{path: path, info: info, fileInfo: fileInfo}:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if walkErr != nil {
+			break
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+	progress.finish()
+
+	if walkErr != nil {
+		return walkErr
+	}
+	return ctx.Err()
+}
+
+// walk visits every entry below start that isn't excluded, passing its
+// metadata without a hash to fn
+func (s *Scanner) walk(ctx context.Context, rootPath, start string, fn func(path string, info os.FileInfo, fileInfo *models.FileInfo) error) error {
+	return s.walkAs(ctx, rootPath, start, start, 0, fn)
+}
+
+// walkAs is walk for dir, which appears in the folder at path as: the
+// path of a followed directory link. links counts the directory links
+// followed to get there.
+func (s *Scanner) walkAs(ctx context.Context, rootPath, dir, as string, links int, fn func(path string, info os.FileInfo, fileInfo *models.FileInfo) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
 			// Skip files we can't access
 			return nil
 		}
 
+		if dir != as {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+			path = filepath.Join(as, rel)
+		}
+
 		// Get relative path
 		relPath, err := filepath.Rel(rootPath, path)
 		if err != nil {
@@ -55,6 +273,7 @@ func (s *Scanner) ScanDirectory(rootPath string) (*models.FileIndex, error) {
 		if relPath == "." {
 			return nil
 		}
+		relPath = normalizePath(relPath)
 
 		// Check exclusions
 		if s.isExcluded(relPath, info.IsDir()) {
@@ -64,9 +283,8 @@ func (s *Scanner) ScanDirectory(rootPath string) (*models.FileIndex, error) {
 			return nil
 		}
 
-		// Skip symlinks
 		if info.Mode()&os.ModeSymlink != 0 {
-			return nil
+			return s.walkLink(ctx, rootPath, path, relPath, info, links, fn)
 		}
 
 		fileInfo := &models.FileInfo{
@@ -76,26 +294,129 @@ func (s *Scanner) ScanDirectory(rootPath string) (*models.FileIndex, error) {
 			IsDir:      info.IsDir(),
 			Permission: uint32(info.Mode().Perm()),
 		}
-
-		// Calculate hash for files (not directories)
 		if !info.IsDir() {
-			hash, err := s.calculateHash(path)
-			if err != nil {
-				// Skip files we can't hash
-				return nil
-			}
-			fileInfo.Hash = hash
+			s.xattrs.apply(fileInfo, path)
 		}
 
-		index.Files[relPath] = fileInfo
-		return nil
+		return fn(path, info, fileInfo)
 	})
+}
 
-	if err != nil {
-		return nil, err
+// walkLink handles a symlink found by the walk as the symlink policy says.
+// Links that point outside the folder are left out.
+func (s *Scanner) walkLink(ctx context.Context, rootPath, path, relPath string, info os.FileInfo, links int, fn func(path string, info os.FileInfo, fileInfo *models.FileInfo) error) error {
+	switch s.symlinks {
+	case models.SymlinkPreserve:
+		fileInfo, err := symlinkInfo(rootPath, relPath, info)
+		if err != nil {
+			log.Printf("Skipping symlink %s: %v", relPath, err)
+			return nil
+		}
+		return fn(path, info, fileInfo)
+
+	case models.SymlinkFollow:
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			// Nothing to follow
+			return nil
+		}
+		if !insideRoot(rootPath, resolved) {
+			log.Printf("Skipping symlink %s: %v", relPath, errLinkOutsideRoot)
+			return nil
+		}
+		target, err := os.Stat(resolved)
+		if err != nil {
+			return nil
+		}
+		if !target.IsDir() {
+			fileInfo := &models.FileInfo{
+				Path:       relPath,
+				Size:       target.Size(),
+				ModTime:    target.ModTime(),
+				Permission: uint32(target.Mode().Perm()),
+			}
+			s.xattrs.apply(fileInfo, resolved)
+			return fn(path, target, fileInfo)
+		}
+		if links >= maxFollowedLinks || followsIntoAncestor(path, resolved) {
+			log.Printf("Skipping symlink %s: it leads round a cycle", relPath)
+			return nil
+		}
+		return s.walkAs(ctx, rootPath, resolved, path, links+1, fn)
 	}
 
-	return index, nil
+	// Skipped
+	return nil
+}
+
+// scanTracker counts the files hashed during a scan and reports progress
+// at most every scanProgressInterval
+type scanTracker struct {
+	progress   models.ScanProgress
+	cb         func(*models.ScanProgress)
+	lastReport time.Time
+	mu         sync.Mutex
+}
+
+func (t *scanTracker) add(size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.progress.Files++
+	t.progress.Bytes += size
+	if t.cb != nil && time.Since(t.lastReport) >= scanProgressInterval {
+		t.lastReport = time.Now()
+		p := t.progress
+		t.cb(&p)
+	}
+}
+
+func (t *scanTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.progress.Done = true
+	if t.cb != nil {
+		p := t.progress
+		t.cb(&p)
+	}
+}
+
+// ctxReader aborts reads once its context is cancelled
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// isExcludedPath checks a relative path and each of its parent directories
+// against the exclusion patterns
+func (s *Scanner) isExcludedPath(relPath string, isDir bool) bool {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	for i := range parts {
+		if s.isExcluded(strings.Join(parts[:i+1], "/"), isDir || i < len(parts)-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// inScope reports whether path is one of paths or lies below one of them
+func inScope(path string, paths []string) bool {
+	path = filepath.ToSlash(path)
+	for _, p := range paths {
+		p = filepath.ToSlash(p)
+		if p == "." || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // isExcluded checks if a path matches any exclusion pattern
@@ -104,11 +425,16 @@ func (s *Scanner) isExcluded(path string, isDir bool) bool {
 	path = filepath.ToSlash(path)
 	name := filepath.Base(path)
 
-	for _, g := range s.exclusions {
-		// Check both full path and basename
-		if g.Match(path) || g.Match(name) {
-			return true
-		}
+	// Downloads in progress, or kept to resume later
+	if strings.HasSuffix(name, tempFileSuffix) {
+		return true
+	}
+
+	// The scanner's own patterns take precedence, so a "!pattern" there
+	// re-includes a path that Git ignores
+	matched, ignored := s.exclusions.match(path, isDir)
+	if ignored || (!matched && s.git != nil && s.git.ignored(path, isDir)) {
+		return true
 	}
 
 	// Also check for hidden files on macOS (starting with .)
@@ -126,8 +452,49 @@ func (s *Scanner) isExcluded(path string, isDir bool) bool {
 	return false
 }
 
+// cachedHash returns the hash of a file, and its chunks if the scanner
+// chunks files, from the hash cache if its metadata is unchanged, and
+// calculates and caches them otherwise
+func (s *Scanner) cachedHash(ctx context.Context, path string, info os.FileInfo) (string, []models.FileChunk, error) {
+	chunking := s.chunking && info.Size() >= minChunkSize
+	if s.hashCache != nil {
+		if chunking {
+			if hash, chunks, ok := s.hashCache.LookupChunks(path, info); ok {
+				return hash, chunks, nil
+			}
+		} else if hash, ok := s.hashCache.Lookup(path, info); ok {
+			return hash, nil, nil
+		}
+	}
+
+	if !chunking {
+		hash, err := s.calculateHash(ctx, path)
+		if err == nil && s.hashCache != nil {
+			s.hashCache.Store(path, info, hash)
+		}
+		return hash, nil, err
+	}
+
+	chunker := newChunkWriter()
+	hash, err := s.hashInto(ctx, path, chunker)
+	if err != nil {
+		return "", nil, err
+	}
+	chunks := chunker.Chunks()
+	if s.hashCache != nil {
+		s.hashCache.StoreChunks(path, info, hash, chunks)
+	}
+	return hash, chunks, nil
+}
+
 // calculateHash calculates the SHA256 hash of a file
-func (s *Scanner) calculateHash(path string) (string, error) {
+func (s *Scanner) calculateHash(ctx context.Context, path string) (string, error) {
+	return s.hashInto(ctx, path, io.Discard)
+}
+
+// hashInto calculates the SHA256 hash of a file, also writing its content
+// to w
+func (s *Scanner) hashInto(ctx context.Context, path string, w io.Writer) (string, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return "", err
@@ -135,7 +502,7 @@ func (s *Scanner) calculateHash(path string) (string, error) {
 	defer file.Close()
 
 	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
+	if _, err := io.Copy(io.MultiWriter(hasher, w), &ctxReader{ctx: ctx, r: file}); err != nil {
 		return "", err
 	}
 
@@ -150,39 +517,8 @@ func (s *Scanner) QuickScan(rootPath string) (*models.FileIndex, error) {
 		UpdatedAt:  time.Now(),
 	}
 
-	err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-
-		relPath, err := filepath.Rel(rootPath, path)
-		if err != nil {
-			return nil
-		}
-
-		if relPath == "." {
-			return nil
-		}
-
-		if s.isExcluded(relPath, info.IsDir()) {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		if info.Mode()&os.ModeSymlink != 0 {
-			return nil
-		}
-
-		index.Files[relPath] = &models.FileInfo{
-			Path:       relPath,
-			Size:       info.Size(),
-			ModTime:    info.ModTime(),
-			IsDir:      info.IsDir(),
-			Permission: uint32(info.Mode().Perm()),
-		}
-
+	err := s.walk(context.Background(), rootPath, rootPath, func(_ string, _ os.FileInfo, fileInfo *models.FileInfo) error {
+		index.Files[fileInfo.Path] = fileInfo
 		return nil
 	})
 
@@ -193,14 +529,37 @@ func (s *Scanner) QuickScan(rootPath string) (*models.FileIndex, error) {
 	return index, nil
 }
 
+// UpdateVersions carries version vectors over from the previous scan and
+// bumps deviceID's counter for every entry that changed since then
+func (s *Scanner) UpdateVersions(index, previous *models.FileIndex, deviceID string) {
+	for path, info := range index.Files {
+		var prev *models.FileInfo
+		if previous != nil {
+			prev = previous.Files[path]
+		}
+		info.Version = nextVersion(info, prev, deviceID)
+	}
+}
+
+// nextVersion returns the version of info given its previous scan entry
+func nextVersion(info, prev *models.FileInfo, deviceID string) models.VersionVector {
+	if prev == nil {
+		return models.VersionVector{}.Bump(deviceID)
+	}
+	if len(prev.Version) > 0 && sameContent(info, prev) {
+		return prev.Version.Copy()
+	}
+	return prev.Version.Bump(deviceID)
+}
+
 // HashFile calculates the hash for a single file
 func (s *Scanner) HashFile(path string) (string, error) {
-	return s.calculateHash(path)
+	return s.calculateHash(context.Background(), path)
 }
 
 // GetFileInfo gets the FileInfo for a single file
 func (s *Scanner) GetFileInfo(rootPath, relPath string) (*models.FileInfo, error) {
-	fullPath := filepath.Join(rootPath, relPath)
+	fullPath := diskPath(rootPath, relPath)
 	info, err := os.Stat(fullPath)
 	if err != nil {
 		return nil, err
@@ -215,11 +574,12 @@ func (s *Scanner) GetFileInfo(rootPath, relPath string) (*models.FileInfo, error
 	}
 
 	if !info.IsDir() {
-		hash, err := s.calculateHash(fullPath)
+		hash, chunks, err := s.cachedHash(context.Background(), fullPath, info)
 		if err != nil {
 			return nil, err
 		}
 		fileInfo.Hash = hash
+		fileInfo.Chunks = chunks
 	}
 
 	return fileInfo, nil
@@ -0,0 +1,215 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+)
+
+func TestScanPaths(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.WriteFile(filepath.Join(root, "src", "a.txt"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(root, "keep.txt"), []byte("keep"), 0644)
+
+	scanner := NewScanner(nil)
+	previous, err := scanner.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	os.Remove(filepath.Join(root, "src", "a.txt"))
+	os.WriteFile(filepath.Join(root, "src", "b.txt"), []byte("b"), 0644)
+	os.WriteFile(filepath.Join(root, "keep.txt"), []byte("changed"), 0644)
+
+	index, err := scanner.ScanPaths(context.Background(), root, previous, []string{"src"})
+	if err != nil {
+		t.Fatalf("ScanPaths failed: %v", err)
+	}
+
+	if index.Files[filepath.Join("src", "a.txt")] != nil {
+		t.Error("Deleted file in scope should be dropped")
+	}
+	if index.Files[filepath.Join("src", "b.txt")] == nil {
+		t.Error("New file in scope should be added")
+	}
+	if f := index.Files["keep.txt"]; f == nil || f.Hash != previous.Files["keep.txt"].Hash {
+		t.Error("Files outside the scope should be kept from the previous scan")
+	}
+}
+
+func TestScanDirectoryParallel(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 50; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", i%5))
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.txt", i)), []byte(fmt.Sprintf("content %d", i)), 0644)
+	}
+
+	serial := NewScanner(nil)
+	serial.workers = 1
+	expected, err := serial.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	var last *models.ScanProgress
+	parallel := NewScanner(nil)
+	parallel.workers = 8
+	parallel.SetProgressCallback(func(p *models.ScanProgress) { last = p })
+	index, err := parallel.ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	if len(index.Files) != len(expected.Files) {
+		t.Fatalf("Expected %d entries, got %d", len(expected.Files), len(index.Files))
+	}
+	for path, f := range expected.Files {
+		if got := index.Files[path]; got == nil || got.Hash != f.Hash {
+			t.Errorf("Mismatch for %s", path)
+		}
+	}
+	if last == nil || !last.Done || last.Files != 50 {
+		t.Errorf("Expected final progress for 50 files, got %+v", last)
+	}
+}
+
+func TestScanDirectoryCancelled(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := NewScanner(nil).ScanDirectory(ctx, root); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestScanSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(root, "config"), 0755)
+	os.WriteFile(filepath.Join(root, "config", "app.json"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	links := map[string]string{
+		"linked-config":  "config",
+		"app.json":       filepath.Join(root, "config", "app.json"),
+		"loop":           ".",
+		"secret":         filepath.Join(outside, "secret"),
+		"escape":         filepath.Join("..", filepath.Base(outside)),
+		"config/dangles": "missing.json",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("Symlinks not supported: %v", err)
+		}
+	}
+
+	scan := func(policy models.SymlinkPolicy) *models.FileIndex {
+		scanner := NewScanner(nil)
+		scanner.SetSymlinks(policy)
+		index, err := scanner.ScanDirectory(context.Background(), root)
+		if err != nil {
+			t.Fatalf("ScanDirectory failed: %v", err)
+		}
+		return index
+	}
+
+	index := scan(models.SymlinkSkip)
+	for link := range links {
+		if index.Files[filepath.FromSlash(link)] != nil {
+			t.Errorf("Expected %s to be skipped", link)
+		}
+	}
+
+	// Preserved links keep their targets, relative to the link
+	index = scan(models.SymlinkPreserve)
+	expected := map[string]string{
+		"linked-config":  "config",
+		"app.json":       "config/app.json",
+		"loop":           ".",
+		"config/dangles": "missing.json",
+	}
+	for link, target := range expected {
+		f := index.Files[filepath.FromSlash(link)]
+		if f == nil || f.LinkTarget != target {
+			t.Errorf("Expected %s to link to %s, got %+v", link, target, f)
+			continue
+		}
+		if f.Hash != linkHash(target) {
+			t.Errorf("Expected %s to be hashed by its target", link)
+		}
+	}
+	for _, link := range []string{"secret", "escape"} {
+		if index.Files[link] != nil {
+			t.Errorf("Expected %s to be refused, its target is outside the folder", link)
+		}
+	}
+	if index.Files[filepath.Join("linked-config", "app.json")] != nil {
+		t.Error("Expected preserved links not to be walked")
+	}
+
+	// Followed links look like what they point to
+	index = scan(models.SymlinkFollow)
+	original := index.Files[filepath.Join("config", "app.json")]
+	if f := index.Files[filepath.Join("linked-config", "app.json")]; f == nil || f.Hash != original.Hash {
+		t.Errorf("Expected the linked folder's files to be scanned, got %+v", f)
+	}
+	if f := index.Files["linked-config"]; f == nil || !f.IsDir {
+		t.Errorf("Expected the linked folder to be a directory, got %+v", f)
+	}
+	if f := index.Files["app.json"]; f == nil || f.Hash != original.Hash || f.IsSymlink() {
+		t.Errorf("Expected the linked file to be scanned as a file, got %+v", f)
+	}
+	for _, link := range []string{"loop", "secret", "escape", filepath.Join("config", "dangles")} {
+		if index.Files[link] != nil {
+			t.Errorf("Expected %s not to be followed", link)
+		}
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "target.txt"), []byte("target"), 0644)
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	os.WriteFile(filepath.Join(root, "bin", "tool"), []byte("old copy"), 0644)
+
+	if err := CreateSymlink(root, filepath.Join("bin", "tool"), "../target.txt"); err != nil {
+		t.Fatalf("CreateSymlink failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "bin", "tool")); err != nil || string(data) != "target" {
+		t.Errorf("Expected the link to replace the file and reach its target, got %q, %v", data, err)
+	}
+
+	for _, target := range []string{"../../etc/passwd", "/etc/passwd", "../.."} {
+		if err := CreateSymlink(root, filepath.Join("bin", "evil"), target); err != errLinkOutsideRoot {
+			t.Errorf("Expected a link to %s to be refused, got %v", target, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "bin", "evil")); !os.IsNotExist(err) {
+		t.Error("Expected no link to be created outside the folder")
+	}
+
+	// A chain of links inside the folder can still lead out of it
+	os.MkdirAll(filepath.Join(root, "sub"), 0755)
+	if err := CreateSymlink(root, "here", "."); err != nil {
+		t.Fatalf("CreateSymlink failed: %v", err)
+	}
+	if err := CreateSymlink(root, "escape", "here/sub/../.."); err != errLinkOutsideRoot {
+		t.Errorf("Expected a link out through another link to be refused, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "escape")); !os.IsNotExist(err) {
+		t.Error("Expected the refused link to be removed")
+	}
+
+	// Targets may arrive after their links
+	if err := CreateSymlink(root, "pending", "later/file.txt"); err != nil {
+		t.Errorf("Expected a link to a missing target inside the folder, got %v", err)
+	}
+}
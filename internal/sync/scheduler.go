@@ -0,0 +1,636 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+	"container/heap"
+	"context"
+	"errors"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// transferIdleTimeout is how long a transfer in flight may go without any
+// activity before its slot is given to the next file, so a reply that
+// never comes can't stall a sync
+const transferIdleTimeout = 2 * time.Minute
+
+// queueEmitInterval is the shortest time between updates of the transfer
+// queue sent to the UI
+const queueEmitInterval = 250 * time.Millisecond
+
+var (
+	errTransfersClosed   = errors.New("connection closed")
+	errTransferStalled   = errors.New("transfer stalled")
+	errTransferCanceled  = errors.New("transfer canceled")
+	errTransferNotQueued = errors.New("transfer not found")
+	errTransferStarted   = errors.New("transfer already started")
+)
+
+// TransferScheduler runs file transfers concurrently while bounding the
+// work per peer connection: at most a number of files in flight, and a
+// window of chunks sent but not yet acknowledged by the receiver. Files
+// wait their turn in a queue ordered by priority: pinned paths first, then
+// small files before large ones and recently modified before older ones.
+type TransferScheduler struct {
+	filesInFlight int
+	chunkWindow   int
+	peers         map[*network.PeerConnection]*peerTransfers
+	pairs         map[string]*sync.Mutex
+	seq           uint64
+	onChange      func() // Called when the queue changes
+	mu            sync.Mutex
+}
+
+// peerTransfers is the transfer state of one peer connection
+type peerTransfers struct {
+	limit  int
+	queue  transferQueue
+	queued map[string]*queuedTransfer // The queue by ID
+	window *semaphore
+	active map[string]*activeTransfer
+	closed bool
+	stop   chan struct{}
+	mu     sync.Mutex
+}
+
+// push adds a transfer to the queue (must hold p.mu)
+func (p *peerTransfers) push(t *queuedTransfer) {
+	heap.Push(&p.queue, t)
+	p.queued[t.info.ID] = t
+}
+
+// pop takes the next transfer off the queue (must hold p.mu)
+func (p *peerTransfers) pop() *queuedTransfer {
+	t := heap.Pop(&p.queue).(*queuedTransfer)
+	delete(p.queued, t.info.ID)
+	return t
+}
+
+// remove takes a transfer out of the queue (must hold p.mu)
+func (p *peerTransfers) remove(t *queuedTransfer) {
+	heap.Remove(&p.queue, t.index)
+	delete(p.queued, t.info.ID)
+}
+
+// queuedTransfer is a file transfer in the queue
+type queuedTransfer struct {
+	info   models.QueuedTransfer
+	seq    uint64 // Order of arrival, which breaks ties
+	index  int    // Position in the heap
+	onDone func(error)
+	start  func() error
+}
+
+// activeTransfer is a file in flight. A file stays in flight from when it
+// is sent or requested until the transfer completes or fails.
+type activeTransfer struct {
+	*queuedTransfer
+	lastActive time.Time
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// NewTransferScheduler creates a TransferScheduler with the given files in
+// flight and chunk window per peer
+func NewTransferScheduler(filesInFlight, chunkWindow int) *TransferScheduler {
+	return &TransferScheduler{
+		filesInFlight: filesInFlight,
+		chunkWindow:   chunkWindow,
+		peers:         make(map[*network.PeerConnection]*peerTransfers),
+		pairs:         make(map[string]*sync.Mutex),
+	}
+}
+
+// SetChangeCallback sets the function called whenever transfers are
+// queued, start or finish
+func (s *TransferScheduler) SetChangeCallback(cb func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = cb
+}
+
+// changed reports a change of the queue
+func (s *TransferScheduler) changed() {
+	s.mu.Lock()
+	cb := s.onChange
+	s.mu.Unlock()
+	if cb != nil {
+		cb()
+	}
+}
+
+// SetLimits changes the files in flight and chunk window per peer,
+// including for connections already transferring
+func (s *TransferScheduler) SetLimits(filesInFlight, chunkWindow int) {
+	s.mu.Lock()
+	s.filesInFlight = filesInFlight
+	s.chunkWindow = chunkWindow
+	peers := make([]*peerTransfers, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	for _, p := range peers {
+		p.window.setLimit(chunkWindow)
+		p.mu.Lock()
+		p.limit = filesInFlight
+		s.dispatch(p)
+		p.mu.Unlock()
+	}
+	s.changed()
+}
+
+// peer returns the transfer state of a connection, creating it on first use
+func (s *TransferScheduler) peer(conn *network.PeerConnection) *peerTransfers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.peers[conn]
+	if p == nil {
+		p = &peerTransfers{
+			limit:  s.filesInFlight,
+			queued: make(map[string]*queuedTransfer),
+			window: newSemaphore(s.chunkWindow),
+			active: make(map[string]*activeTransfer),
+			stop:   make(chan struct{}),
+		}
+		s.peers[conn] = p
+		go s.expireIdle(conn, p)
+	}
+	return p
+}
+
+// lookup returns the transfer state of a connection if it has any
+func (s *TransferScheduler) lookup(conn *network.PeerConnection) *peerTransfers {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[conn]
+}
+
+// LockPair serializes the syncs of a folder pair; the returned function
+// unlocks it
+func (s *TransferScheduler) LockPair(folderPairID string) func() {
+	s.mu.Lock()
+	mu := s.pairs[folderPairID]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		s.pairs[folderPairID] = mu
+	}
+	s.mu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Schedule queues the transfer of the file described by info on conn. It
+// starts in the background once its turn comes and a slot is free. onDone
+// is called with the outcome once Done is called for the file, start
+// fails, the transfer stalls, is canceled or the connection closes. An
+// error is returned, after calling onDone, if the connection closed
+// before the transfer could be queued.
+func (s *TransferScheduler) Schedule(conn *network.PeerConnection, info models.QueuedTransfer, onDone func(error), start func() error) error {
+	p := s.peer(conn)
+
+	s.mu.Lock()
+	s.seq++
+	t := &queuedTransfer{info: info, seq: s.seq, onDone: onDone, start: start}
+	s.mu.Unlock()
+	t.info.Status = "queued"
+	t.info.QueuedAt = time.Now()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		onDone(errTransfersClosed)
+		return errTransfersClosed
+	}
+
+	var replaced *activeTransfer
+	if previous := p.queued[info.ID]; previous != nil {
+		// The same file was queued again; the new transfer replaces it
+		p.remove(previous)
+		defer previous.onDone(nil)
+	} else if active := p.active[info.ID]; active != nil {
+		delete(p.active, info.ID)
+		replaced = active
+	}
+	p.push(t)
+	s.dispatch(p)
+	p.mu.Unlock()
+
+	if replaced != nil {
+		replaced.cancel()
+		replaced.onDone(nil)
+	}
+	s.changed()
+	return nil
+}
+
+// dispatch starts queued transfers while there are free slots (must hold
+// p.mu)
+func (s *TransferScheduler) dispatch(p *peerTransfers) {
+	for len(p.active) < p.limit && p.queue.Len() > 0 {
+		t := p.pop()
+		t.info.Status = "active"
+		ctx, cancel := context.WithCancel(context.Background())
+		p.active[t.info.ID] = &activeTransfer{queuedTransfer: t, lastActive: time.Now(), ctx: ctx, cancel: cancel}
+		go s.run(p, t)
+	}
+}
+
+// run starts a transfer that got a slot
+func (s *TransferScheduler) run(p *peerTransfers, t *queuedTransfer) {
+	if err := t.start(); err != nil {
+		s.finish(p, t.info.ID, t, err)
+	}
+}
+
+// Done ends the transfer of the file identified by key on conn, freeing
+// its slot. It does nothing for transfers that weren't scheduled.
+func (s *TransferScheduler) Done(conn *network.PeerConnection, key string, err error) {
+	if p := s.lookup(conn); p != nil {
+		s.finish(p, key, nil, err)
+	}
+}
+
+// finish ends the active transfer of key, if it is still t when t is set
+func (s *TransferScheduler) finish(p *peerTransfers, key string, t *queuedTransfer, err error) {
+	p.mu.Lock()
+	transfer := p.active[key]
+	if transfer == nil || (t != nil && transfer.queuedTransfer != t) {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.active, key)
+	s.dispatch(p)
+	p.mu.Unlock()
+
+	transfer.cancel()
+	transfer.onDone(err)
+	s.changed()
+}
+
+// Context returns the context of the transfer of the file identified by
+// key on conn, which is canceled once the transfer ends. Transfers that
+// weren't scheduled get a context that is never canceled.
+func (s *TransferScheduler) Context(conn *network.PeerConnection, key string) context.Context {
+	if p := s.lookup(conn); p != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if transfer := p.active[key]; transfer != nil {
+			return transfer.ctx
+		}
+	}
+	return context.Background()
+}
+
+// Active reports whether the transfer of the file identified by key is in
+// flight on conn
+func (s *TransferScheduler) Active(conn *network.PeerConnection, key string) bool {
+	p := s.lookup(conn)
+	if p == nil {
+		return false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active[key] != nil
+}
+
+// Touch records activity on the transfer of the file identified by key
+func (s *TransferScheduler) Touch(conn *network.PeerConnection, key string) {
+	p := s.lookup(conn)
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	if transfer := p.active[key]; transfer != nil {
+		transfer.lastActive = time.Now()
+	}
+	p.mu.Unlock()
+}
+
+// window returns the chunk window of conn, which senders acquire before
+// each chunk they send
+func (s *TransferScheduler) window(conn *network.PeerConnection) *semaphore {
+	return s.peer(conn).window
+}
+
+// Ack frees the window slot of a chunk of the file identified by key that
+// the receiver acknowledged
+func (s *TransferScheduler) Ack(conn *network.PeerConnection, key string) {
+	p := s.lookup(conn)
+	if p == nil {
+		return
+	}
+	p.window.release()
+	s.Touch(conn, key)
+}
+
+// Queue returns the transfers under way followed by the queued ones, in
+// the order they will start
+func (s *TransferScheduler) Queue() []models.QueuedTransfer {
+	s.mu.Lock()
+	peers := make([]*peerTransfers, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	// Copies, as the transfers change once unlocked
+	var active, queued []*queuedTransfer
+	for _, p := range peers {
+		p.mu.Lock()
+		for _, transfer := range p.active {
+			t := *transfer.queuedTransfer
+			active = append(active, &t)
+		}
+		for _, transfer := range p.queue {
+			t := *transfer
+			queued = append(queued, &t)
+		}
+		p.mu.Unlock()
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].seq < active[j].seq })
+	sort.Slice(queued, func(i, j int) bool { return queued[i].before(queued[j]) })
+
+	items := make([]models.QueuedTransfer, 0, len(active)+len(queued))
+	for _, t := range append(active, queued...) {
+		items = append(items, t.info)
+	}
+	return items
+}
+
+// find returns the peer and queued or active transfer with the given ID
+// (must hold s.mu)
+func (s *TransferScheduler) find(id string) (*peerTransfers, *queuedTransfer, *activeTransfer) {
+	for _, p := range s.peers {
+		p.mu.Lock()
+		t, active := p.queued[id], p.active[id]
+		p.mu.Unlock()
+		if t != nil || active != nil {
+			return p, t, active
+		}
+	}
+	return nil, nil, nil
+}
+
+// Transfer returns the queued or active transfer with the given ID and
+// the connection it runs on
+func (s *TransferScheduler) Transfer(id string) (*network.PeerConnection, models.QueuedTransfer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, p := range s.peers {
+		p.mu.Lock()
+		t := p.queued[id]
+		if active := p.active[id]; active != nil {
+			t = active.queuedTransfer
+		}
+		p.mu.Unlock()
+		if t != nil {
+			return conn, t.info, true
+		}
+	}
+	return nil, models.QueuedTransfer{}, false
+}
+
+// update changes the queued transfer with the given ID and puts it back
+// in order
+func (s *TransferScheduler) update(id string, fn func(*models.QueuedTransfer)) error {
+	s.mu.Lock()
+	p, _, _ := s.find(id)
+	s.mu.Unlock()
+	if p == nil {
+		return errTransferNotQueued
+	}
+
+	p.mu.Lock()
+	t := p.queued[id]
+	if t == nil {
+		p.mu.Unlock()
+		return errTransferStarted
+	}
+	fn(&t.info)
+	heap.Fix(&p.queue, t.index)
+	p.mu.Unlock()
+
+	s.changed()
+	return nil
+}
+
+// Reprioritize changes the priority of a queued transfer
+func (s *TransferScheduler) Reprioritize(id string, priority models.TransferPriority) error {
+	return s.update(id, func(info *models.QueuedTransfer) {
+		info.Priority = priority
+		info.Skipped = false
+	})
+}
+
+// Skip passes over a queued transfer until the rest of the queue is done
+func (s *TransferScheduler) Skip(id string) error {
+	return s.update(id, func(info *models.QueuedTransfer) {
+		info.Skipped = true
+	})
+}
+
+// Cancel drops a queued transfer, or stops one under way; its onDone gets
+// errTransferCanceled. The file is transferred again by the next sync.
+func (s *TransferScheduler) Cancel(id string) error {
+	s.mu.Lock()
+	p, _, _ := s.find(id)
+	s.mu.Unlock()
+	if p == nil {
+		return errTransferNotQueued
+	}
+
+	p.mu.Lock()
+	if t := p.queued[id]; t != nil {
+		p.remove(t)
+		p.mu.Unlock()
+		t.onDone(errTransferCanceled)
+		s.changed()
+		return nil
+	}
+	p.mu.Unlock()
+	s.finish(p, id, nil, errTransferCanceled)
+	return nil
+}
+
+// Close ends every transfer on a connection that went away
+func (s *TransferScheduler) Close(conn *network.PeerConnection) {
+	s.mu.Lock()
+	p := s.peers[conn]
+	delete(s.peers, conn)
+	s.mu.Unlock()
+	if p == nil {
+		return
+	}
+
+	close(p.stop)
+	p.window.close()
+
+	p.mu.Lock()
+	p.closed = true
+	active := p.active
+	queued := p.queue
+	p.active = make(map[string]*activeTransfer)
+	p.queue = nil
+	p.queued = make(map[string]*queuedTransfer)
+	p.mu.Unlock()
+	for _, transfer := range active {
+		transfer.cancel()
+		transfer.onDone(errTransfersClosed)
+	}
+	for _, t := range queued {
+		t.onDone(errTransfersClosed)
+	}
+	s.changed()
+}
+
+// expireIdle ends the transfers of a connection that had no activity for
+// transferIdleTimeout, until the connection closes
+func (s *TransferScheduler) expireIdle(conn *network.PeerConnection, p *peerTransfers) {
+	ticker := time.NewTicker(transferIdleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var stalled []string
+		p.mu.Lock()
+		for key, transfer := range p.active {
+			if time.Since(transfer.lastActive) >= transferIdleTimeout {
+				stalled = append(stalled, key)
+			}
+		}
+		p.mu.Unlock()
+
+		for _, key := range stalled {
+			log.Printf("Transfer of %s stalled, moving on", key)
+			s.Done(conn, key, errTransferStalled)
+		}
+	}
+}
+
+// sizeClass groups file sizes by orders of magnitude: under 64 KiB, 1 MiB,
+// 16 MiB, 256 MiB and so on. Smaller classes transfer first, so many
+// small files aren't held up behind a large one.
+func sizeClass(size int64) int {
+	return (bits.Len64(uint64(size)>>16) + 3) / 4
+}
+
+// before reports whether t transfers before other
+func (t *queuedTransfer) before(other *queuedTransfer) bool {
+	a, b := &t.info, &other.info
+	if a.Skipped != b.Skipped {
+		return !a.Skipped
+	}
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if ca, cb := sizeClass(a.Size), sizeClass(b.Size); ca != cb {
+		return ca < cb
+	}
+	if !a.ModTime.Equal(b.ModTime) {
+		return a.ModTime.After(b.ModTime)
+	}
+	return t.seq < other.seq
+}
+
+// transferQueue is a heap of queued transfers, the next to start first
+type transferQueue []*queuedTransfer
+
+func (q transferQueue) Len() int           { return len(q) }
+func (q transferQueue) Less(i, j int) bool { return q[i].before(q[j]) }
+func (q transferQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *transferQueue) Push(x any) {
+	t := x.(*queuedTransfer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *transferQueue) Pop() any {
+	old := *q
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return t
+}
+
+// semaphore is a counting semaphore whose limit can change while in use.
+// A nil semaphore never blocks.
+type semaphore struct {
+	limit  int
+	used   int
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newSemaphore(limit int) *semaphore {
+	s := &semaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire takes a slot, waiting for one to be free. It fails once the
+// semaphore is closed.
+func (s *semaphore) acquire() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.used >= s.limit && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return errTransfersClosed
+	}
+	s.used++
+	return nil
+}
+
+// release frees a slot
+func (s *semaphore) release() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used > 0 {
+		s.used--
+	}
+	s.cond.Signal()
+}
+
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.cond.Broadcast()
+}
+
+func (s *semaphore) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,160 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+)
+
+func TestSchedulerLimitsFilesInFlight(t *testing.T) {
+	s := NewTransferScheduler(2, 4)
+	conn := &network.PeerConnection{}
+	defer s.Close(conn)
+
+	done := make(chan error, 3)
+	started := make(chan string, 3)
+	schedule := func(key string) {
+		s.Schedule(conn, models.QueuedTransfer{ID: key}, func(err error) { done <- err }, func() error {
+			started <- key
+			return nil
+		})
+	}
+	schedule("a")
+	schedule("b")
+	<-started
+	<-started
+
+	schedule("c")
+	select {
+	case key := <-started:
+		t.Fatalf("Expected a third file to wait for a free slot, %s started", key)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Done(conn, "a", nil)
+	select {
+	case key := <-started:
+		if key != "c" {
+			t.Errorf("Expected c to start, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected Done to free a slot")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a successful transfer, got %v", err)
+	}
+
+	// Closing the connection ends the transfers still in flight
+	s.Close(conn)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != errTransfersClosed {
+			t.Errorf("Expected closed transfers to fail, got %v", err)
+		}
+	}
+}
+
+func TestSchedulerChunkWindow(t *testing.T) {
+	s := NewTransferScheduler(1, 2)
+	conn := &network.PeerConnection{}
+	window := s.window(conn)
+
+	window.acquire()
+	window.acquire()
+	acquired := make(chan error, 1)
+	go func() { acquired <- window.acquire() }()
+	select {
+	case <-acquired:
+		t.Fatal("Expected a full window to block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Ack(conn, "a")
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected an ack to free the window")
+	}
+
+	// A larger window lets more chunks through right away
+	s.SetLimits(1, 4)
+	if err := window.acquire(); err != nil {
+		t.Fatalf("Expected the resized window to have room, got %v", err)
+	}
+
+	go func() { acquired <- window.acquire() }()
+	s.Close(conn)
+	if err := <-acquired; err != errTransfersClosed {
+		t.Errorf("Expected closing to unblock the sender, got %v", err)
+	}
+}
+
+func TestSchedulerQueueOrder(t *testing.T) {
+	s := NewTransferScheduler(1, 4)
+	conn := &network.PeerConnection{}
+	defer s.Close(conn)
+
+	started := make(chan string, 10)
+	canceled := make(chan string, 10)
+	schedule := func(info models.QueuedTransfer) {
+		s.Schedule(conn, info, func(err error) {
+			if err == errTransferCanceled {
+				canceled <- info.ID
+			}
+		}, func() error {
+			started <- info.ID
+			return nil
+		})
+	}
+
+	now := time.Now()
+	// The first file takes the only slot while the rest queue up
+	schedule(models.QueuedTransfer{ID: "first", Size: 1})
+	<-started
+	schedule(models.QueuedTransfer{ID: "video.mp4", Size: 700 << 20, ModTime: now})
+	schedule(models.QueuedTransfer{ID: "old.txt", Size: 100, ModTime: now.Add(-time.Hour)})
+	schedule(models.QueuedTransfer{ID: "new.txt", Size: 200, ModTime: now})
+	schedule(models.QueuedTransfer{ID: "pinned.iso", Size: 4 << 30, Priority: models.PriorityHigh})
+	schedule(models.QueuedTransfer{ID: "notes.md", Size: 10})
+	schedule(models.QueuedTransfer{ID: "unwanted.bin", Size: 10})
+
+	if err := s.Skip("new.txt"); err != nil {
+		t.Fatalf("Skip failed: %v", err)
+	}
+	if err := s.Reprioritize("video.mp4", models.PriorityHigh); err != nil {
+		t.Fatalf("Reprioritize failed: %v", err)
+	}
+	if err := s.Cancel("unwanted.bin"); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if id := <-canceled; id != "unwanted.bin" {
+		t.Errorf("Expected unwanted.bin to be canceled, got %s", id)
+	}
+	if err := s.Skip("first"); err != errTransferStarted {
+		t.Errorf("Expected a started transfer not to be skipped, got %v", err)
+	}
+
+	expected := []string{"first", "video.mp4", "pinned.iso", "old.txt", "notes.md", "new.txt"}
+	queue := s.Queue()
+	if len(queue) != len(expected) {
+		t.Fatalf("Expected %d transfers, got %d", len(expected), len(queue))
+	}
+	for i, item := range queue {
+		if item.ID != expected[i] {
+			t.Errorf("Expected %s at position %d, got %s", expected[i], i, item.ID)
+		}
+	}
+	if queue[0].Status != "active" || queue[1].Status != "queued" {
+		t.Errorf("Expected the first transfer active and the rest queued, got %s and %s", queue[0].Status, queue[1].Status)
+	}
+
+	// Transfers start in queue order as slots free up
+	for _, id := range expected[1:] {
+		s.Done(conn, queue[0].ID, nil)
+		if got := <-started; got != id {
+			t.Fatalf("Expected %s to start next, got %s", id, got)
+		}
+		queue = s.Queue()
+	}
+}
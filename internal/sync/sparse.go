@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"SyncDev/internal/network"
+	"fmt"
+	"hash"
+)
+
+const (
+	// minHoleSize is the smallest hole left out of a transfer; smaller
+	// ones cost more in messages than their zeros do on the wire
+	minHoleSize = 64 * 1024
+	// maxHoles caps the hole map sent with a file, which keeps the header
+	// small; holes past it are sent as zeros
+	maxHoles = 4096
+)
+
+// zeros is what holes read as
+var zeros = make([]byte, network.ChunkSize)
+
+// dataExtents returns the ranges of a file of size bytes, from offset on,
+// that aren't in holes
+func dataExtents(holes []network.ByteRange, offset, size int64) []network.ByteRange {
+	var extents []network.ByteRange
+	for i := 0; i <= len(holes); i++ {
+		next := network.ByteRange{Offset: size}
+		if i < len(holes) {
+			next = holes[i]
+		}
+		if next.Offset > offset {
+			extents = append(extents, network.ByteRange{Offset: offset, Size: min(next.Offset, size) - offset})
+		}
+		offset = max(offset, next.Offset+next.Size)
+	}
+	return extents
+}
+
+// validateHoles checks that holes are in order, apart and inside a file of
+// size bytes
+func validateHoles(holes []network.ByteRange, size int64) error {
+	var end int64
+	for _, hole := range holes {
+		if hole.Offset < end || hole.Size <= 0 || hole.Offset+hole.Size > size {
+			return fmt.Errorf("invalid hole %d+%d of %d bytes", hole.Offset, hole.Size, size)
+		}
+		end = hole.Offset + hole.Size
+	}
+	return nil
+}
+
+// hashZeros adds n zero bytes to h
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		chunk := min(n, int64(len(zeros)))
+		h.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
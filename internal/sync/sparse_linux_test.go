@@ -0,0 +1,224 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"SyncDev/internal/models"
+	"SyncDev/internal/network"
+)
+
+func TestSparseFileTransfer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("hashes a multi-GB sparse file")
+	}
+	remote, local := t.TempDir(), t.TempDir()
+	const size = 4 << 30
+	data := bytes.Repeat([]byte("disk image data "), network.ChunkSize/16)
+	source, err := os.Create(filepath.Join(remote, "disk.img"))
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer source.Close()
+	if err := source.Truncate(size); err != nil {
+		t.Fatalf("Failed to size file: %v", err)
+	}
+	// Data at the start and in the middle; the file ends in a hole
+	for _, offset := range []int64{0, 2 << 30} {
+		if _, err := source.WriteAt(data, offset); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+
+	holes := fileHoles(source, size)
+	if len(holes) == 0 {
+		t.Skip("filesystem doesn't report holes")
+	}
+	var holeBytes int64
+	for _, hole := range holes {
+		holeBytes += hole.Size
+	}
+	if holeBytes != size-2*int64(len(data)) {
+		t.Errorf("Expected everything but the data in holes, got %d of %d bytes", holeBytes, size)
+	}
+
+	hash, err := NewScanner(nil).HashFile(source.Name())
+	if err != nil {
+		t.Fatalf("HashFile failed: %v", err)
+	}
+	info := &models.FileInfo{Path: "disk.img", Size: size, Hash: hash}
+
+	// A request for ranges of the file gets the whole file, without its
+	// holes
+	sendEnd, receiveEnd := net.Pipe()
+	defer sendEnd.Close()
+	defer receiveEnd.Close()
+	tm := NewTransferManager(remote, NewScanner(nil))
+	sendErr := make(chan error, 1)
+	go func() {
+		req := &TransferRequest{Ranges: []network.ByteRange{{Offset: 0, Size: size}}, Hash: hash}
+		sendErr <- tm.Send(network.NewPeerConnection(sendEnd), "pair", info, req, nil)
+	}()
+
+	conn := network.NewPeerConnection(receiveEnd)
+	var receiver *FileReceiver
+	var sent int64
+	for done := false; !done; {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		switch msg.Type {
+		case network.MsgTypeFileResponse:
+			var header network.FileResponsePayload
+			if err := msg.ParsePayload(&header); err != nil {
+				t.Fatalf("Invalid file response: %v", err)
+			}
+			if header.Ranges || len(header.Holes) != len(holes) {
+				t.Fatalf("Expected the whole file with its holes, got ranges %v and %d holes", header.Ranges, len(header.Holes))
+			}
+			receiver, err = NewFileReceiver(local, &models.FileInfo{Path: header.FilePath, Size: header.Size, Hash: header.Hash}, nil)
+			if err != nil {
+				t.Fatalf("NewFileReceiver failed: %v", err)
+			}
+			if err := receiver.SetHoles(header.Holes); err != nil {
+				t.Fatalf("SetHoles failed: %v", err)
+			}
+		case network.MsgTypeFileChunk:
+			chunk, err := msg.ParseChunk()
+			if err != nil {
+				t.Fatalf("Invalid chunk: %v", err)
+			}
+			if err := receiver.WriteChunk(chunk.Data, chunk.Offset); err != nil {
+				t.Fatalf("WriteChunk failed: %v", err)
+			}
+			sent += int64(len(chunk.Data))
+			done = chunk.IsLast
+		default:
+			t.Fatalf("Unexpected %s message", msg.Type)
+		}
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if sent != 2*int64(len(data)) {
+		t.Errorf("Expected only the data to be sent, sent %d bytes", sent)
+	}
+	if err := receiver.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+
+	received, err := os.Open(filepath.Join(local, "disk.img"))
+	if err != nil {
+		t.Fatalf("Expected the file to be received: %v", err)
+	}
+	defer received.Close()
+	stat, err := received.Stat()
+	if err != nil {
+		t.Fatalf("Failed to stat received file: %v", err)
+	}
+	if stat.Size() != size {
+		t.Errorf("Expected %d bytes, got %d", size, stat.Size())
+	}
+	if allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512; allocated > 64<<20 {
+		t.Errorf("Expected the received file to stay sparse, %d bytes are allocated", allocated)
+	}
+	got := make([]byte, len(data))
+	if _, err := received.ReadAt(got, 2<<30); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Expected the data in the middle to arrive (%v)", err)
+	}
+}
+
+func TestChunkReceiverLeavesZeroChunksAsHoles(t *testing.T) {
+	root := t.TempDir()
+	data := bytes.Repeat([]byte("chunk data "), network.ChunkSize/11)
+	os.WriteFile(filepath.Join(root, "data.bin"), data, 0644)
+	local, err := NewScanner(nil).ScanDirectory(context.Background(), root)
+	if err != nil {
+		t.Fatalf("ScanDirectory failed: %v", err)
+	}
+
+	// The data, then a run of zeros as one chunk
+	const zeroSize = 16 << 20
+	hasher := sha256.New()
+	hashZeros(hasher, zeroSize)
+	zeroHash := hex.EncodeToString(hasher.Sum(nil))
+	hasher = sha256.New()
+	hasher.Write(data)
+	hashZeros(hasher, zeroSize)
+	info := &models.FileInfo{
+		Path: "image.img",
+		Size: int64(len(data)) + zeroSize,
+		Hash: hex.EncodeToString(hasher.Sum(nil)),
+		Chunks: []models.FileChunk{
+			{Hash: local.Files["data.bin"].Hash, Size: int64(len(data))},
+			{Hash: zeroHash, Size: zeroSize},
+		},
+	}
+
+	receiver, missing, err := NewChunkReceiver(root, info, newChunkIndex(local), nil)
+	if err != nil {
+		t.Fatalf("NewChunkReceiver failed: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("Expected nothing missing, got %v", missing)
+	}
+	if err := receiver.Verify(); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+
+	stat, err := os.Stat(filepath.Join(root, "image.img"))
+	if err != nil {
+		t.Fatalf("Expected the file to be built: %v", err)
+	}
+	if stat.Size() != info.Size {
+		t.Errorf("Expected %d bytes, got %d", info.Size, stat.Size())
+	}
+	if allocated := stat.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= zeroSize {
+		t.Errorf("Expected the zeros to stay a hole, %d bytes are allocated", allocated)
+	}
+}
+
+func TestDataExtents(t *testing.T) {
+	holes := []network.ByteRange{{Offset: 100, Size: 50}, {Offset: 200, Size: 100}}
+	tests := []struct {
+		offset   int64
+		expected []network.ByteRange
+	}{
+		{0, []network.ByteRange{{Offset: 0, Size: 100}, {Offset: 150, Size: 50}}},
+		{120, []network.ByteRange{{Offset: 150, Size: 50}}},
+		{250, nil},
+	}
+	for _, test := range tests {
+		extents := dataExtents(holes, test.offset, 300)
+		if len(extents) != len(test.expected) {
+			t.Errorf("Expected %v from %d, got %v", test.expected, test.offset, extents)
+			continue
+		}
+		for i := range extents {
+			if extents[i] != test.expected[i] {
+				t.Errorf("Expected %v from %d, got %v", test.expected, test.offset, extents)
+			}
+		}
+	}
+
+	if err := validateHoles([]network.ByteRange{{Offset: 200, Size: 10}, {Offset: 100, Size: 10}}, 300); err == nil {
+		t.Error("Expected holes out of order to be refused")
+	}
+	if err := validateHoles([]network.ByteRange{{Offset: 250, Size: 100}}, 300); err == nil {
+		t.Error("Expected a hole past the end to be refused")
+	}
+}
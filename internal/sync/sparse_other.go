@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package sync
+
+import (
+	"SyncDev/internal/network"
+	"os"
+)
+
+// fileHoles returns no holes: they aren't looked for on this platform, so
+// files are sent whole
+func fileHoles(file *os.File, size int64) []network.ByteRange {
+	return nil
+}
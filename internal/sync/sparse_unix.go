@@ -0,0 +1,41 @@
+//go:build linux || darwin
+
+package sync
+
+import (
+	"SyncDev/internal/network"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileHoles returns the holes in file, which is size bytes long, that are
+// worth leaving out of a transfer. Filesystems that don't track holes
+// report none.
+func fileHoles(file *os.File, size int64) []network.ByteRange {
+	var holes []network.ByteRange
+	for offset := int64(0); offset < size && len(holes) < maxHoles; {
+		start, err := file.Seek(offset, unix.SEEK_HOLE)
+		if err != nil || start >= size {
+			break
+		}
+		end, err := file.Seek(start, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// No data after the hole
+			end = size
+		} else if err != nil {
+			break
+		}
+		end = min(end, size)
+		if end <= start {
+			break
+		}
+
+		if end-start >= minHoleSize {
+			holes = append(holes, network.ByteRange{Offset: start, Size: end - start})
+		}
+		offset = end
+	}
+	return holes
+}
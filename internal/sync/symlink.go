@@ -0,0 +1,163 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxFollowedLinks is how many directory links deep a scan follows links,
+// which ends scans that go round a cycle of links
+const maxFollowedLinks = 8
+
+// errLinkOutsideRoot refuses links that point outside the folder
+var errLinkOutsideRoot = errors.New("link target is outside the folder")
+
+// symlinkInfo returns the entry of the symlink at relPath below rootPath,
+// which info describes. Its hash stands for the target, so links compare
+// like files.
+func symlinkInfo(rootPath, relPath string, info os.FileInfo) (*models.FileInfo, error) {
+	target, err := readLinkTarget(rootPath, relPath)
+	if err != nil {
+		return nil, err
+	}
+	return &models.FileInfo{
+		Path:       relPath,
+		ModTime:    info.ModTime(),
+		Hash:       linkHash(target),
+		LinkTarget: target,
+	}, nil
+}
+
+// linkHash returns the hash of a symlink to target
+func linkHash(target string) string {
+	sum := sha256.Sum256([]byte("symlink:" + target))
+	return hex.EncodeToString(sum[:])
+}
+
+// readLinkTarget returns the target of the symlink at relPath below
+// rootPath, relative to the link and with forward slashes. Absolute targets
+// inside the folder are made relative, so the link works on the peer.
+func readLinkTarget(rootPath, relPath string) (string, error) {
+	fullPath := diskPath(rootPath, relPath)
+	target, err := os.Readlink(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(target) {
+		target, err = filepath.Rel(filepath.Dir(fullPath), target)
+		if err != nil {
+			return "", errLinkOutsideRoot
+		}
+	}
+	if !linkInsideRoot(relPath, target) {
+		return "", errLinkOutsideRoot
+	}
+
+	// Links through other links may still end up outside
+	if resolved, err := filepath.EvalSymlinks(fullPath); err == nil && !insideRoot(rootPath, resolved) {
+		return "", errLinkOutsideRoot
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// linkInsideRoot reports whether a link at relPath to target points inside
+// the folder, going by the paths alone
+func linkInsideRoot(relPath, target string) bool {
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return false
+	}
+	return !escapesRoot(filepath.Join(filepath.Dir(relPath), target))
+}
+
+// insideRoot reports whether path, with its links resolved, lies inside
+// rootPath
+func insideRoot(rootPath, path string) bool {
+	root, err := filepath.EvalSymlinks(rootPath)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	return err == nil && !escapesRoot(rel)
+}
+
+// linkResolvesInside reports whether the link at path to target, with the
+// links along the way resolved, leads inside rootPath. A target that
+// doesn't exist yet is checked as far as it exists.
+func linkResolvesInside(rootPath, path, target string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return insideRoot(rootPath, resolved)
+	}
+
+	// Components are trimmed off the target as given, since cleaning it
+	// would skip the links a ".." steps out of
+	rest := filepath.Dir(path) + string(filepath.Separator) + target
+	for os.IsNotExist(err) {
+		i := strings.LastIndex(rest, string(filepath.Separator))
+		if i <= 0 {
+			break
+		}
+		rest = rest[:i]
+		if resolved, err = filepath.EvalSymlinks(rest); err == nil {
+			return insideRoot(rootPath, resolved)
+		}
+	}
+	return false
+}
+
+// escapesRoot reports whether a clean relative path leads above its root
+func escapesRoot(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// followsIntoAncestor reports whether following the directory link at
+// path to resolved would walk a directory that contains the link, and so
+// walk it forever
+func followsIntoAncestor(path, resolved string) bool {
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return true
+	}
+	rel, err := filepath.Rel(resolved, parent)
+	return err == nil && !escapesRoot(rel)
+}
+
+// CreateSymlink makes relPath below rootPath a symlink to target, given
+// with forward slashes, replacing a file or link already there. Targets
+// outside rootPath are refused.
+func CreateSymlink(rootPath, relPath, target string) error {
+	target = filepath.FromSlash(target)
+	if !linkInsideRoot(relPath, target) {
+		return errLinkOutsideRoot
+	}
+
+	fullPath := diskPath(rootPath, relPath)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	// The link is made beside the old entry and renamed over it, so the
+	// path never goes missing
+	tempPath := fullPath + tempFileSuffix
+	os.Remove(tempPath)
+	if err := os.Symlink(target, tempPath); err != nil {
+		return err
+	}
+	// Links along the way may lead out of the folder where the path alone
+	// doesn't
+	if !linkResolvesInside(rootPath, tempPath, target) {
+		os.Remove(tempPath)
+		return errLinkOutsideRoot
+	}
+	if err := os.Rename(tempPath, fullPath); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
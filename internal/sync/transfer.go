@@ -3,18 +3,50 @@ package sync
 import (
 	"SyncDev/internal/models"
 	"SyncDev/internal/network"
-	"encoding/base64"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
 	"time"
 )
 
+// tempFileSuffix marks files that are still being received
+const tempFileSuffix = ".syncdev.tmp"
+
+const (
+	// resumableSize is the smallest file whose interrupted download is kept
+	// to resume later; smaller files are cheap to send again
+	resumableSize = 4 * network.ChunkSize
+	// checkpointInterval is how much data is received between saves of a
+	// download's state
+	checkpointInterval = 16 * network.ChunkSize
+	// offerSize is the smallest file pushed with a file_offer, which lets the
+	// receiver resume an earlier download or ask for a delta
+	offerSize = deltaMinSize
+)
+
 // TransferManager handles file transfers between peers
 type TransferManager struct {
-	rootPath string
-	scanner  *Scanner
+	rootPath    string
+	scanner     *Scanner
+	window      *semaphore      // Chunks sent ahead of the receiver's acknowledgements, if limited
+	compression string          // Codec negotiated with the peer, if any
+	upload      throttle        // Limits the rate of the data sent, if any
+	xattrs      *xattrFilter    // Extended attributes sent with the data, if any
+	ctx         context.Context // Stops the send once done, if set
+}
+
+// canceled returns the reason the send must stop, if it must
+func (tm *TransferManager) canceled() error {
+	if tm.ctx == nil {
+		return nil
+	}
+	return tm.ctx.Err()
 }
 
 // NewTransferManager creates a new TransferManager
@@ -25,84 +57,349 @@ func NewTransferManager(rootPath string, scanner *Scanner) *TransferManager {
 	}
 }
 
-// SendFile sends a file to a peer in chunks
-func (tm *TransferManager) SendFile(conn *network.PeerConnection, folderPairID, relPath string, progressCb func(*models.TransferProgress)) error {
-	fullPath := filepath.Join(tm.rootPath, relPath)
+// TransferRequest is how the receiver asked for a file: from Offset to
+// resume a download, as a delta against Signatures, or only the Ranges it
+// can't build from its own chunks of the version with Hash
+type TransferRequest struct {
+	Offset     int64
+	Signatures *Signatures
+	Ranges     []network.ByteRange
+	Hash       string
+}
 
-	file, err := os.Open(fullPath)
+// Send sends a file to a peer the way req asks for it. A nil req sends the
+// whole file, as does a request for ranges of a version we don't have.
+func (tm *TransferManager) Send(conn *network.PeerConnection, folderPairID string, fileInfo *models.FileInfo, req *TransferRequest, progressCb func(*models.TransferProgress)) error {
+	switch {
+	case req == nil:
+		return tm.SendFile(conn, folderPairID, fileInfo, 0, progressCb)
+	case (req.Signatures != nil || len(req.Ranges) > 0) && tm.sparse(fileInfo.Path):
+		// Deltas and ranges would send the holes as zeros
+		return tm.SendFile(conn, folderPairID, fileInfo, 0, progressCb)
+	case req.Signatures != nil:
+		return tm.SendDelta(conn, folderPairID, fileInfo, req.Signatures, progressCb)
+	case len(req.Ranges) > 0 && req.Hash == fileInfo.Hash:
+		return tm.SendRanges(conn, folderPairID, fileInfo, req.Ranges, progressCb)
+	case len(req.Ranges) > 0:
+		return tm.SendFile(conn, folderPairID, fileInfo, 0, progressCb)
+	}
+	return tm.SendFile(conn, folderPairID, fileInfo, req.Offset, progressCb)
+}
+
+// sparse reports whether the file at relPath has holes
+func (tm *TransferManager) sparse(relPath string) bool {
+	file, err := os.Open(diskPath(tm.rootPath, relPath))
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return false
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	return err == nil && len(fileHoles(file, info.Size())) > 0
+}
+
+// fileSend is a file being sent to a peer after its file_response header:
+// the open file, the compressor of its data and the progress reported as
+// the data goes out
+type fileSend struct {
+	tm         *TransferManager
+	conn       *network.PeerConnection
+	file       *os.File
+	size       int64
+	relPath    string
+	comp       *compressor
+	startTime  time.Time
+	progressCb func(*models.TransferProgress)
+}
+
+// startSend opens the file described by fileInfo and sends its
+// file_response header, which describe completes with how the data
+// follows. An error from describe stops the send before the header.
+func (tm *TransferManager) startSend(conn *network.PeerConnection, folderPairID string, fileInfo *models.FileInfo, progressCb func(*models.TransferProgress), describe func(header *network.FileResponsePayload, file *os.File) error) (*fileSend, error) {
+	relPath := fileInfo.Path
+	file, err := os.Open(diskPath(tm.rootPath, relPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
 
 	info, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat file: %w", err)
+		file.Close()
+		return nil, fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	totalSize := info.Size()
-	var transferred int64
-	startTime := time.Now()
+	header := &network.FileResponsePayload{
+		FolderPairID: folderPairID,
+		FilePath:     relPath,
+		Size:         info.Size(),
+		Hash:         fileInfo.Hash,
+		Version:      fileInfo.Version,
+		ModTime:      info.ModTime(),
+		Permission:   uint32(info.Mode().Perm()),
+		Xattrs:       tm.xattrs.read(file.Name()),
+	}
+	err = describe(header, file)
+	var headerMsg *network.Message
+	if err == nil {
+		headerMsg, err = network.NewMessage(network.MsgTypeFileResponse, header)
+	}
+	if err == nil {
+		if err = conn.WriteMessage(headerMsg); err != nil {
+			err = fmt.Errorf("failed to send file header: %w", err)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	buffer := make([]byte, network.ChunkSize)
-	offset := int64(0)
+	return &fileSend{
+		tm:         tm,
+		conn:       conn,
+		file:       file,
+		size:       info.Size(),
+		relPath:    relPath,
+		comp:       newCompressor(tm.compression, relPath),
+		startTime:  time.Now(),
+		progressCb: progressCb,
+	}, nil
+}
 
-	for {
-		n, err := file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read file: %w", err)
-		}
+// write sends a chunk or delta message once the chunk window and upload
+// limit let it go
+func (s *fileSend) write(msg *network.Message) error {
+	if err := s.tm.canceled(); err != nil {
+		return err
+	}
+	if err := s.tm.window.acquire(); err != nil {
+		return err
+	}
+	s.tm.upload.wait(len(msg.Data))
+	if err := s.conn.WriteMessage(msg); err != nil {
+		return fmt.Errorf("failed to send %s: %w", msg.Type, err)
+	}
+	return nil
+}
+
+// report reports transferred of total bytes done, of which sent went out
+// since the send started
+func (s *fileSend) report(transferred, sent, total int64) {
+	if s.progressCb == nil {
+		return
+	}
+
+	elapsed := time.Since(s.startTime).Seconds()
+	var bytesPerSec int64
+	if elapsed > 0 {
+		bytesPerSec = int64(float64(sent) / elapsed)
+	}
+
+	var percentage float64 = 100
+	if total > 0 {
+		percentage = float64(transferred) / float64(total) * 100
+	}
+
+	s.progressCb(&models.TransferProgress{
+		FileName:         s.relPath,
+		TotalBytes:       total,
+		TransferBytes:    transferred,
+		Percentage:       percentage,
+		BytesPerSecond:   bytesPerSec,
+		CompressionRatio: s.comp.ratio(),
+	})
+}
+
+// close closes the file being sent
+func (s *fileSend) close() {
+	s.file.Close()
+}
 
-		if n == 0 {
-			break
+// SendFile sends a file to a peer: a file_response header with its
+// metadata followed by the data in chunks, starting at offset to resume an
+// interrupted download
+func (tm *TransferManager) SendFile(conn *network.PeerConnection, folderPairID string, fileInfo *models.FileInfo, offset int64, progressCb func(*models.TransferProgress)) error {
+	var holes []network.ByteRange
+	s, err := tm.startSend(conn, folderPairID, fileInfo, progressCb, func(header *network.FileResponsePayload, file *os.File) error {
+		if offset < 0 || offset > header.Size {
+			offset = 0
 		}
+		holes = fileHoles(file, header.Size)
+		header.Offset = offset
+		header.Holes = holes
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer s.close()
 
-		isLast := n < network.ChunkSize || err == io.EOF
+	totalSize := s.size
+	buffer := make([]byte, network.ChunkSize)
+	resumedAt := offset
 
+	sendChunk := func(data []byte, offset int64, isLast bool) error {
 		chunk := &network.FileChunkPayload{
 			FolderPairID: folderPairID,
-			FilePath:     relPath,
+			FilePath:     fileInfo.Path,
 			Offset:       offset,
-			Data:         base64Encode(buffer[:n]),
 			IsLast:       isLast,
 		}
+		chunk.Data, chunk.Compression = s.comp.compress(data)
 
-		msg, err := network.NewMessage(network.MsgTypeFileChunk, chunk)
+		msg, err := network.NewChunkMessage(chunk)
 		if err != nil {
 			return err
 		}
-
-		if err := conn.WriteMessage(msg); err != nil {
-			return fmt.Errorf("failed to send chunk: %w", err)
+		if err := s.write(msg); err != nil {
+			return err
 		}
 
-		transferred += int64(n)
-		offset += int64(n)
+		// Holes skipped on the way count as sent
+		transferred := offset + int64(len(data))
+		s.report(transferred, transferred-resumedAt, totalSize)
+		return nil
+	}
 
-		if progressCb != nil {
-			elapsed := time.Since(startTime).Seconds()
-			var bytesPerSec int64
-			if elapsed > 0 {
-				bytesPerSec = int64(float64(transferred) / elapsed)
+	// Only the data goes out; the receiver leaves the holes unwritten
+	extents := dataExtents(holes, offset, totalSize)
+	for i, extent := range extents {
+		end := extent.Offset + extent.Size
+		for offset := extent.Offset; offset < end; {
+			n, err := s.file.ReadAt(buffer[:min(end-offset, network.ChunkSize)], offset)
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("failed to read file: %w", err)
 			}
 
-			progressCb(&models.TransferProgress{
-				FileName:       relPath,
-				TotalBytes:     totalSize,
-				TransferBytes:  transferred,
-				Percentage:     float64(transferred) / float64(totalSize) * 100,
-				BytesPerSecond: bytesPerSec,
-			})
+			// A file that shrank since it was opened ends early
+			isLast := err == io.EOF || (i == len(extents)-1 && offset+int64(n) >= end)
+			if err := sendChunk(buffer[:n], offset, isLast); err != nil {
+				return err
+			}
+			if isLast {
+				return nil
+			}
+			offset += int64(n)
 		}
+	}
+
+	// Empty files, and files that are all hole, still send one (empty)
+	// last chunk
+	return sendChunk(nil, totalSize, true)
+}
+
+// SendDelta sends a file to a peer as instructions to rebuild it from the
+// receiver's copy, whose blocks are described by sigs: a file_response
+// header followed by file_delta messages
+func (tm *TransferManager) SendDelta(conn *network.PeerConnection, folderPairID string, fileInfo *models.FileInfo, sigs *Signatures, progressCb func(*models.TransferProgress)) error {
+	s, err := tm.startSend(conn, folderPairID, fileInfo, progressCb, func(header *network.FileResponsePayload, _ *os.File) error {
+		header.BlockSize = sigs.BlockSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer s.close()
 
-		if isLast {
-			break
+	source := &countingReader{r: s.file}
+	var ops []network.DeltaOp
+	opsSize := 0
+	flush := func(isLast bool) error {
+		data, codec := s.comp.compress(network.EncodeDeltaOps(ops))
+		msg, err := network.NewMessage(network.MsgTypeFileDelta, &network.FileDeltaPayload{
+			FolderPairID: folderPairID,
+			FilePath:     fileInfo.Path,
+			IsLast:       isLast,
+			Compression:  codec,
+		})
+		if err != nil {
+			return err
+		}
+		msg.Data = data
+		if err := s.write(msg); err != nil {
+			return err
+		}
+		ops = ops[:0]
+		opsSize = 0
+
+		s.report(source.n, source.n, s.size)
+		return nil
+	}
+
+	err = computeDelta(source, sigs, network.ChunkSize, func(op network.DeltaOp) error {
+		ops = append(ops, op)
+		opsSize += 9 + len(op.Data)
+		if opsSize >= network.ChunkSize {
+			return flush(false)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to compute delta: %w", err)
+	}
+	return flush(true)
+}
+
+// SendRanges sends parts of a file to a peer that has the rest: a
+// file_response header followed by the chunks of each range
+func (tm *TransferManager) SendRanges(conn *network.PeerConnection, folderPairID string, fileInfo *models.FileInfo, ranges []network.ByteRange, progressCb func(*models.TransferProgress)) error {
+	var wanted int64
+	s, err := tm.startSend(conn, folderPairID, fileInfo, progressCb, func(header *network.FileResponsePayload, _ *os.File) error {
+		for _, r := range ranges {
+			if r.Offset < 0 || r.Size <= 0 || r.Offset+r.Size > header.Size {
+				return fmt.Errorf("invalid range %d+%d of %d bytes", r.Offset, r.Size, header.Size)
+			}
+			wanted += r.Size
+		}
+		header.Ranges = true
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+	defer s.close()
 
+	buffer := make([]byte, network.ChunkSize)
+	var transferred int64
+	for i, r := range ranges {
+		for offset := r.Offset; offset < r.Offset+r.Size; {
+			n := int(min(r.Offset+r.Size-offset, network.ChunkSize))
+			if _, err := s.file.ReadAt(buffer[:n], offset); err != nil {
+				return fmt.Errorf("failed to read file: %w", err)
+			}
+
+			chunk := &network.FileChunkPayload{
+				FolderPairID: folderPairID,
+				FilePath:     fileInfo.Path,
+				Offset:       offset,
+				IsLast:       i == len(ranges)-1 && offset+int64(n) == r.Offset+r.Size,
+			}
+			chunk.Data, chunk.Compression = s.comp.compress(buffer[:n])
+			msg, err := network.NewChunkMessage(chunk)
+			if err != nil {
+				return err
+			}
+			if err := s.write(msg); err != nil {
+				return err
+			}
+			offset += int64(n)
+			transferred += int64(n)
+			s.report(transferred, transferred, wanted)
+		}
+	}
 	return nil
 }
 
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
 // ReceiveFile receives file chunks and writes them to disk
 type FileReceiver struct {
 	rootPath     string
@@ -113,12 +410,38 @@ type FileReceiver struct {
 	progressCb   func(*models.TransferProgress)
 	startTime    time.Time
 	filePath     string
+	info         *models.FileInfo
+	conn         *network.PeerConnection
+
+	// The receiver's current copy that a delta transfer copies blocks from
+	basis     *os.File
+	blockSize int
+
+	// Set when the file was built from local chunks and only the missing
+	// ranges are received
+	chunked bool
+
+	// Holes the sender leaves out, in order, that the data received hasn't
+	// reached yet
+	holes []network.ByteRange
+
+	// The data received from the peer and the bytes it took on the wire
+	wireData  int64
+	wireBytes int64
+
+	// The data written contiguously from the start of the file, which is
+	// what an interrupted download resumes from
+	contiguous     int64
+	prefix         hash.Hash
+	resumedAt      int64
+	lastCheckpoint int64
 }
 
-// NewFileReceiver creates a new FileReceiver
-func NewFileReceiver(rootPath, relPath string, expectedSize int64, progressCb func(*models.TransferProgress)) (*FileReceiver, error) {
-	fullPath := filepath.Join(rootPath, relPath)
-	tempPath := fullPath + ".syncdev.tmp"
+// NewFileReceiver creates a new FileReceiver for the file described by info,
+// as announced by the sender
+func NewFileReceiver(rootPath string, info *models.FileInfo, progressCb func(*models.TransferProgress)) (*FileReceiver, error) {
+	fullPath := diskPath(rootPath, info.Path)
+	tempPath := fullPath + tempFileSuffix
 
 	// Create parent directories if needed
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
@@ -134,47 +457,370 @@ func NewFileReceiver(rootPath, relPath string, expectedSize int64, progressCb fu
 		rootPath:     rootPath,
 		tempPath:     tempPath,
 		file:         file,
-		expectedSize: expectedSize,
+		expectedSize: info.Size,
 		progressCb:   progressCb,
 		startTime:    time.Now(),
-		filePath:     relPath,
+		filePath:     info.Path,
+		info:         info,
+		prefix:       sha256.New(),
 	}, nil
 }
 
-// WriteChunk writes a chunk of data to the file
-func (fr *FileReceiver) WriteChunk(data []byte, offset int64) error {
-	decoded, err := base64Decode(data)
+// ResumeFileReceiver reopens the temp file of an interrupted download of
+// the file described by info. The data already received is kept if the
+// file is still the one partial was saved for and the data on disk is
+// intact; otherwise the download starts over. It returns the offset the
+// rest of the file must be sent from.
+func ResumeFileReceiver(rootPath string, info *models.FileInfo, partial *PartialTransfer, progressCb func(*models.TransferProgress)) (*FileReceiver, int64, error) {
+	if partial == nil || partial.Hash != info.Hash || partial.Size != info.Size || partial.Received > info.Size {
+		fr, err := NewFileReceiver(rootPath, info, progressCb)
+		return fr, 0, err
+	}
+
+	tempPath := diskPath(rootPath, info.Path) + tempFileSuffix
+	file, err := os.OpenFile(tempPath, os.O_RDWR, 0)
+	if err != nil {
+		fr, err := NewFileReceiver(rootPath, info, progressCb)
+		return fr, 0, err
+	}
+
+	// Verify what was received before trusting it
+	prefix := sha256.New()
+	if _, err := io.CopyN(prefix, file, partial.Received); err != nil || hex.EncodeToString(prefix.Sum(nil)) != partial.PrefixHash {
+		file.Close()
+		fr, err := NewFileReceiver(rootPath, info, progressCb)
+		return fr, 0, err
+	}
+	if err := file.Truncate(partial.Received); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to truncate temp file: %w", err)
+	}
+
+	return &FileReceiver{
+		rootPath:       rootPath,
+		tempPath:       tempPath,
+		file:           file,
+		expectedSize:   info.Size,
+		received:       partial.Received,
+		progressCb:     progressCb,
+		startTime:      time.Now(),
+		filePath:       info.Path,
+		info:           info,
+		contiguous:     partial.Received,
+		prefix:         prefix,
+		resumedAt:      partial.Received,
+		lastCheckpoint: partial.Received,
+	}, partial.Received, nil
+}
+
+// NewDeltaReceiver creates a FileReceiver that rebuilds the file described
+// by info from delta instructions against the current copy, whose blocks
+// are blockSize long
+func NewDeltaReceiver(rootPath string, info *models.FileInfo, blockSize int, progressCb func(*models.TransferProgress)) (*FileReceiver, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+	basis, err := os.Open(diskPath(rootPath, info.Path))
 	if err != nil {
-		return fmt.Errorf("failed to decode chunk: %w", err)
+		return nil, fmt.Errorf("failed to open current copy: %w", err)
+	}
+
+	fr, err := NewFileReceiver(rootPath, info, progressCb)
+	if err != nil {
+		basis.Close()
+		return nil, err
+	}
+	fr.basis = basis
+	fr.blockSize = blockSize
+	return fr, nil
+}
+
+// NewChunkReceiver creates a FileReceiver for the file described by info
+// and fills in every chunk of it that a local file has, as located by
+// index. It returns the ranges still missing, which the sender is asked
+// for; without any, the file is complete.
+func NewChunkReceiver(rootPath string, info *models.FileInfo, index *chunkIndex, progressCb func(*models.TransferProgress)) (*FileReceiver, []network.ByteRange, error) {
+	fr, err := NewFileReceiver(rootPath, info, progressCb)
+	if err != nil {
+		return nil, nil, err
+	}
+	fr.chunked = true
+
+	sources := make(map[string]*os.File)
+	defer func() {
+		for _, file := range sources {
+			file.Close()
+		}
+	}()
+	// Chunks are copied through a buffer: a file without a chunk list is a
+	// single chunk that may be far too large to hold in memory
+	buffer := make([]byte, network.ChunkSize)
+	copyChunk := func(chunk models.FileChunk, offset int64) (bool, error) {
+		source, ok := index.lookup(chunk)
+		if !ok {
+			return false, nil
+		}
+		file, ok := sources[source.path]
+		if !ok {
+			file, _ = os.Open(diskPath(rootPath, source.path))
+			sources[source.path] = file
+		}
+		if file == nil {
+			return false, nil
+		}
+
+		// The file may have changed since it was indexed
+		section := io.NewSectionReader(file, source.offset, source.size)
+		hasher := sha256.New()
+		if n, err := io.CopyBuffer(hasher, section, buffer); err != nil || n != source.size || hex.EncodeToString(hasher.Sum(nil)) != chunk.Hash {
+			return false, nil
+		}
+		for copied := int64(0); copied < source.size; {
+			n, err := section.ReadAt(buffer[:min(source.size-copied, int64(len(buffer)))], copied)
+			if n == 0 && err != nil {
+				return false, fmt.Errorf("failed to read chunk: %w", err)
+			}
+			if err := fr.WriteChunk(buffer[:n], offset+copied); err != nil {
+				return false, err
+			}
+			copied += int64(n)
+		}
+		return true, nil
+	}
+
+	// Chunks of zeros are left as holes without looking for them locally
+	if err := fr.file.Truncate(info.Size); err != nil {
+		fr.Abort()
+		return nil, nil, fmt.Errorf("failed to size temp file: %w", err)
+	}
+	zeroHashes := make(map[int64]string)
+	zeroChunk := func(chunk models.FileChunk) bool {
+		if chunk.Size < minHoleSize {
+			return false
+		}
+		hash, ok := zeroHashes[chunk.Size]
+		if !ok {
+			hasher := sha256.New()
+			hashZeros(hasher, chunk.Size)
+			hash = hex.EncodeToString(hasher.Sum(nil))
+			zeroHashes[chunk.Size] = hash
+		}
+		return hash == chunk.Hash
+	}
+
+	var missing []network.ByteRange
+	var offset int64
+	for _, chunk := range fileChunks(info) {
+		if zeroChunk(chunk) {
+			if err := fr.WriteHole(offset, chunk.Size); err != nil {
+				fr.Abort()
+				return nil, nil, err
+			}
+			offset += chunk.Size
+			continue
+		}
+		copied, err := copyChunk(chunk, offset)
+		if err != nil {
+			fr.Abort()
+			return nil, nil, err
+		}
+		if !copied {
+			if n := len(missing); n > 0 && missing[n-1].Offset+missing[n-1].Size == offset {
+				missing[n-1].Size += chunk.Size
+			} else {
+				missing = append(missing, network.ByteRange{Offset: offset, Size: chunk.Size})
+			}
+		}
+		offset += chunk.Size
 	}
+	if offset != info.Size {
+		fr.Abort()
+		return nil, nil, fmt.Errorf("chunks cover %d of %d bytes", offset, info.Size)
+	}
+	return fr, missing, nil
+}
+
+// Info returns the sender's metadata for the file being received
+func (fr *FileReceiver) Info() *models.FileInfo {
+	return fr.info
+}
+
+// CountWire records that data bytes of the file arrived from the peer in
+// wire bytes, for the compression ratio of the transfer
+func (fr *FileReceiver) CountWire(data, wire int) {
+	fr.wireData += int64(data)
+	fr.wireBytes += int64(wire)
+}
+
+// SetHoles marks ranges of the file as holes the sender leaves out of the
+// chunks. They read as zeros and, where the filesystem allows, take no
+// space on disk.
+func (fr *FileReceiver) SetHoles(holes []network.ByteRange) error {
+	if err := validateHoles(holes, fr.expectedSize); err != nil {
+		return err
+	}
+	// Growing the file leaves what isn't written unallocated
+	if err := fr.file.Truncate(fr.expectedSize); err != nil {
+		return fmt.Errorf("failed to size temp file: %w", err)
+	}
+	fr.holes = holes
+	fr.skipHoles()
+	return nil
+}
+
+// skipHoles counts the holes the contiguous data has reached as received
+func (fr *FileReceiver) skipHoles() {
+	for len(fr.holes) > 0 && fr.holes[0].Offset <= fr.contiguous {
+		end := fr.holes[0].Offset + fr.holes[0].Size
+		fr.holes = fr.holes[1:]
+		if end > fr.contiguous {
+			hashZeros(fr.prefix, end-fr.contiguous)
+			fr.received += end - fr.contiguous
+			fr.contiguous = end
+		}
+	}
+}
 
-	if _, err := fr.file.WriteAt(decoded, offset); err != nil {
+// WriteHole records size bytes at offset as received without writing
+// them, which leaves them a hole reading as zeros. The file must have been
+// sized to include them.
+func (fr *FileReceiver) WriteHole(offset, size int64) error {
+	if err := fr.checkRange(offset, size); err != nil {
+		return err
+	}
+	fr.received += size
+	if offset == fr.contiguous {
+		hashZeros(fr.prefix, size)
+		fr.contiguous += size
+		fr.skipHoles()
+	}
+	return nil
+}
+
+// WriteChunk writes a chunk of data to the file
+func (fr *FileReceiver) WriteChunk(data []byte, offset int64) error {
+	if err := fr.checkRange(offset, int64(len(data))); err != nil {
+		return err
+	}
+	if _, err := fr.file.WriteAt(data, offset); err != nil {
 		return fmt.Errorf("failed to write chunk: %w", err)
 	}
 
-	fr.received += int64(len(decoded))
+	fr.received += int64(len(data))
+	if offset == fr.contiguous {
+		fr.prefix.Write(data)
+		fr.contiguous += int64(len(data))
+		fr.skipHoles()
+	}
 
 	if fr.progressCb != nil {
 		elapsed := time.Since(fr.startTime).Seconds()
 		var bytesPerSec int64
 		if elapsed > 0 {
-			bytesPerSec = int64(float64(fr.received) / elapsed)
+			bytesPerSec = int64(float64(fr.received-fr.resumedAt) / elapsed)
+		}
+
+		var percentage float64 = 100
+		if fr.expectedSize > 0 {
+			percentage = float64(fr.received) / float64(fr.expectedSize) * 100
 		}
 
 		fr.progressCb(&models.TransferProgress{
-			FileName:       fr.filePath,
-			TotalBytes:     fr.expectedSize,
-			TransferBytes:  fr.received,
-			Percentage:     float64(fr.received) / float64(fr.expectedSize) * 100,
-			BytesPerSecond: bytesPerSec,
+			FileName:         fr.filePath,
+			TotalBytes:       fr.expectedSize,
+			TransferBytes:    fr.received,
+			Percentage:       percentage,
+			BytesPerSecond:   bytesPerSec,
+			CompressionRatio: compressionRatio(fr.wireData, fr.wireBytes),
 		})
 	}
 
 	return nil
 }
 
-// Finalize completes the file transfer
+// checkRange refuses data at offset that doesn't fit in the announced
+// file. Peers that send chunks without announcing the file give no size.
+func (fr *FileReceiver) checkRange(offset, size int64) error {
+	if offset < 0 || (fr.info.Hash != "" && offset+size > fr.expectedSize) {
+		return fmt.Errorf("%d bytes at offset %d are outside the file's %d bytes", size, offset, fr.expectedSize)
+	}
+	return nil
+}
+
+// ApplyDelta appends the data described by delta ops to the file
+func (fr *FileReceiver) ApplyDelta(ops []network.DeltaOp) error {
+	if fr.basis == nil {
+		return fmt.Errorf("not a delta transfer")
+	}
+
+	for _, op := range ops {
+		if op.Data != nil {
+			if err := fr.WriteChunk(op.Data, fr.contiguous); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Copy the blocks in pieces; the last block may be short
+		remaining := int64(op.Count) * int64(fr.blockSize)
+		offset := int64(op.Block) * int64(fr.blockSize)
+		buf := make([]byte, min(remaining, network.ChunkSize))
+		for remaining > 0 {
+			n, err := fr.basis.ReadAt(buf[:min(remaining, int64(len(buf)))], offset)
+			if n > 0 {
+				if err := fr.WriteChunk(buf[:n], fr.contiguous); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read current copy: %w", err)
+			}
+			offset += int64(n)
+			remaining -= int64(n)
+		}
+	}
+	return nil
+}
+
+// Verify checks that the data received is the whole file with the hash
+// the sender announced. Data received in order was hashed as it streamed
+// in; anything else is hashed from disk.
+func (fr *FileReceiver) Verify() error {
+	var hash string
+	if fr.contiguous == fr.expectedSize {
+		hash = hex.EncodeToString(fr.prefix.Sum(nil))
+	} else if fr.received >= fr.expectedSize {
+		// Data that arrived out of order is hashed from disk
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, io.NewSectionReader(fr.file, 0, fr.expectedSize)); err != nil {
+			return fmt.Errorf("failed to read temp file: %w", err)
+		}
+		hash = hex.EncodeToString(hasher.Sum(nil))
+	} else {
+		return fmt.Errorf("received %d of %d bytes", fr.contiguous, fr.expectedSize)
+	}
+
+	if hash != fr.info.Hash {
+		return fmt.Errorf("hash mismatch: expected %s, got %s", fr.info.Hash, hash)
+	}
+	return nil
+}
+
+// Chunked reports whether the file is being built from local chunks
+func (fr *FileReceiver) Chunked() bool {
+	return fr.chunked
+}
+
+// Finalize completes the file transfer, giving the file the sender's
+// extended attributes, permissions and modification time
 func (fr *FileReceiver) Finalize() error {
+	if fr.basis != nil {
+		fr.basis.Close()
+	}
+
 	if err := fr.file.Sync(); err != nil {
 		return fmt.Errorf("failed to sync file: %w", err)
 	}
@@ -183,8 +829,27 @@ func (fr *FileReceiver) Finalize() error {
 		return fmt.Errorf("failed to close file: %w", err)
 	}
 
+	// Attributes go first: writing them needs the write permission the
+	// sender's permissions may take away
+	if err := writeXattrs(fr.tempPath, fr.info.Xattrs); err != nil {
+		return fmt.Errorf("failed to set extended attributes: %w", err)
+	}
+
+	// Keep the sender's permissions and modification time, so the copy
+	// doesn't look like a newer edit on the next scan
+	if fr.info.Permission != 0 {
+		if err := os.Chmod(fr.tempPath, os.FileMode(fr.info.Permission).Perm()); err != nil {
+			return fmt.Errorf("failed to set permissions: %w", err)
+		}
+	}
+	if !fr.info.ModTime.IsZero() {
+		if err := os.Chtimes(fr.tempPath, time.Now(), fr.info.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time: %w", err)
+		}
+	}
+
 	// Rename temp file to final path
-	finalPath := filepath.Join(fr.rootPath, fr.filePath)
+	finalPath := diskPath(fr.rootPath, fr.filePath)
 	if err := os.Rename(fr.tempPath, finalPath); err != nil {
 		return fmt.Errorf("failed to rename temp file: %w", err)
 	}
@@ -192,12 +857,84 @@ func (fr *FileReceiver) Finalize() error {
 	return nil
 }
 
+// Quarantine stops a transfer whose data didn't verify and moves what was
+// received to dest, where it can be inspected without being synced
+func (fr *FileReceiver) Quarantine(dest string) error {
+	if fr.basis != nil {
+		fr.basis.Close()
+	}
+	fr.file.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		os.Remove(fr.tempPath)
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := os.Rename(fr.tempPath, dest); err != nil {
+		// The quarantine may be on another filesystem
+		err = CopyFile(fr.tempPath, dest)
+		os.Remove(fr.tempPath)
+		if err != nil {
+			return fmt.Errorf("failed to quarantine file: %w", err)
+		}
+	}
+	return nil
+}
+
 // Abort cancels the file transfer and cleans up
 func (fr *FileReceiver) Abort() {
+	if fr.basis != nil {
+		fr.basis.Close()
+	}
 	fr.file.Close()
 	os.Remove(fr.tempPath)
 }
 
+// Resumable reports whether an interrupted download of this file is kept.
+// Delta and chunked transfers are not, as they depend on local files.
+func (fr *FileReceiver) Resumable() bool {
+	return fr.basis == nil && !fr.chunked && fr.expectedSize >= resumableSize
+}
+
+// CheckpointDue reports whether enough data arrived since the last
+// checkpoint to save the download's state again
+func (fr *FileReceiver) CheckpointDue() bool {
+	return fr.Resumable() && fr.contiguous-fr.lastCheckpoint >= checkpointInterval
+}
+
+// Checkpoint flushes the data received so far to disk and returns the
+// state to resume the download from
+func (fr *FileReceiver) Checkpoint() (*PartialTransfer, error) {
+	if err := fr.file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to sync file: %w", err)
+	}
+	fr.lastCheckpoint = fr.contiguous
+
+	return &PartialTransfer{
+		Hash:       fr.info.Hash,
+		Size:       fr.expectedSize,
+		Received:   fr.contiguous,
+		PrefixHash: hex.EncodeToString(fr.prefix.Sum(nil)),
+	}, nil
+}
+
+// Suspend stops an interrupted download, keeping its temp file to resume
+// later. It returns the state to resume from, or nil if the file is too
+// small to be worth resuming and was discarded.
+func (fr *FileReceiver) Suspend() (*PartialTransfer, error) {
+	if !fr.Resumable() || fr.info.Hash == "" {
+		fr.Abort()
+		return nil, nil
+	}
+
+	partial, err := fr.Checkpoint()
+	fr.file.Close()
+	if err != nil {
+		os.Remove(fr.tempPath)
+		return nil, err
+	}
+	return partial, nil
+}
+
 // CopyFile copies a file locally (for local sync operations)
 func CopyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
@@ -239,9 +976,10 @@ func CopyFile(src, dst string) error {
 	return nil
 }
 
-// DeleteFile deletes a file or directory
+// DeleteFile deletes a file or an empty directory. Directories that still
+// have content are left alone so files unknown to the peer are never lost.
 func DeleteFile(path string) error {
-	info, err := os.Stat(path)
+	_, err := os.Lstat(path)
 	if os.IsNotExist(err) {
 		return nil // Already deleted
 	}
@@ -249,29 +987,59 @@ func DeleteFile(path string) error {
 		return err
 	}
 
-	if info.IsDir() {
-		return os.RemoveAll(path)
-	}
 	return os.Remove(path)
 }
 
-// CreateDirectory creates a directory with the specified permissions
-func CreateDirectory(path string, perm os.FileMode) error {
-	return os.MkdirAll(path, perm)
-}
+// MoveFile renames fromPath to toPath within rootPath, creating missing
+// parent directories. An existing file at toPath is never replaced.
+func MoveFile(rootPath, fromPath, toPath string) error {
+	src := diskPath(rootPath, fromPath)
+	dst := diskPath(rootPath, toPath)
 
-// Helper functions for base64 encoding/decoding
-func base64Encode(data []byte) []byte {
-	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
-	base64.StdEncoding.Encode(encoded, data)
-	return encoded
+	// On a case-insensitive volume a rename that only changes case finds
+	// the file itself at toPath
+	if dstInfo, err := os.Lstat(dst); err == nil {
+		if srcInfo, err := os.Lstat(src); err != nil || !os.SameFile(srcInfo, dstInfo) {
+			return fmt.Errorf("destination already exists: %s", toPath)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	return os.Rename(src, dst)
 }
 
-func base64Decode(data []byte) ([]byte, error) {
-	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
-	n, err := base64.StdEncoding.Decode(decoded, data)
+// DeleteDirectory removes the directory at relPath below rootPath once
+// the scanner finds nothing left in it to sync. Excluded files inside go
+// with it.
+func DeleteDirectory(scanner *Scanner, rootPath, relPath string) error {
+	fullPath := diskPath(rootPath, relPath)
+	err := scanner.walk(context.Background(), rootPath, fullPath, func(path string, _ os.FileInfo, _ *models.FileInfo) error {
+		if path != fullPath {
+			return errDirNotEmpty
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	return os.RemoveAll(fullPath)
+}
+
+// errDirNotEmpty keeps a directory that still has files to sync
+var errDirNotEmpty = errors.New("directory still has files to sync")
+
+// CreateDirectory creates a directory with the specified permissions, or
+// gives an existing directory those permissions. Modification times of
+// directories aren't kept, since they change with every file added.
+func CreateDirectory(path string, perm os.FileMode) error {
+	if perm == 0 {
+		perm = 0755
+	}
+	if err := os.MkdirAll(path, perm); err != nil {
+		return err
 	}
-	return decoded[:n], nil
+	return os.Chmod(path, perm.Perm())
 }
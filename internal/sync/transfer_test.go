@@ -0,0 +1,217 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+)
+
+func TestMoveFile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("data"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := MoveFile(root, "a.txt", "sub/b.txt"); err != nil {
+		t.Fatalf("MoveFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "sub", "b.txt")); err != nil || string(data) != "data" {
+		t.Errorf("Expected moved content, got %q (%v)", data, err)
+	}
+
+	os.WriteFile(filepath.Join(root, "c.txt"), []byte("other"), 0644)
+	if err := MoveFile(root, "c.txt", "sub/b.txt"); err == nil {
+		t.Error("Expected MoveFile to refuse overwriting an existing file")
+	}
+}
+
+func TestDeleteDirectory(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "app", "node_modules", "pkg"), 0755)
+	os.WriteFile(filepath.Join(root, "app", "node_modules", "pkg", "index.js"), []byte("js"), 0644)
+	os.WriteFile(filepath.Join(root, "app", "main.go"), []byte("package main"), 0644)
+	scanner := NewScanner([]string{"node_modules/"})
+
+	if err := DeleteDirectory(scanner, root, "app"); err != errDirNotEmpty {
+		t.Fatalf("Expected a directory with files to sync to be kept, got %v", err)
+	}
+
+	// Excluded files don't keep the directory
+	os.Remove(filepath.Join(root, "app", "main.go"))
+	if err := DeleteDirectory(scanner, root, "app"); err != nil {
+		t.Fatalf("DeleteDirectory failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "app")); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to be deleted, got %v", err)
+	}
+}
+
+func TestCreateDirectoryPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "b")
+	if err := CreateDirectory(path, 0700); err != nil {
+		t.Fatalf("CreateDirectory failed: %v", err)
+	}
+	if err := CreateDirectory(path, 0750); err != nil {
+		t.Fatalf("CreateDirectory on an existing directory failed: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected permissions 0750, got %v", info.Mode().Perm())
+	}
+}
+
+func TestResumeFileReceiver(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), resumableSize/16+1000)
+	sum := sha256.Sum256(content)
+	info := &models.FileInfo{Path: "big.bin", Size: int64(len(content)), Hash: hex.EncodeToString(sum[:])}
+
+	receiver, err := NewFileReceiver(root, info, nil)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	half := int64(len(content) / 2)
+	if err := receiver.WriteChunk(content[:half], 0); err != nil {
+		t.Fatalf("WriteChunk failed: %v", err)
+	}
+	partial, err := receiver.Suspend()
+	if err != nil || partial == nil {
+		t.Fatalf("Expected a resumable partial, got %v (%v)", partial, err)
+	}
+	if partial.Received != half {
+		t.Errorf("Expected %d bytes received, got %d", half, partial.Received)
+	}
+
+	// A different source hash starts over
+	changed := *info
+	changed.Hash = "other"
+	receiver, offset, err := ResumeFileReceiver(root, &changed, partial, nil)
+	if err != nil || offset != 0 {
+		t.Fatalf("Expected a changed file to start over, got offset %d (%v)", offset, err)
+	}
+	receiver.Abort()
+
+	// Rebuild the partial and resume it
+	receiver, _ = NewFileReceiver(root, info, nil)
+	receiver.WriteChunk(content[:half], 0)
+	partial, _ = receiver.Suspend()
+
+	receiver, offset, err = ResumeFileReceiver(root, info, partial, nil)
+	if err != nil || offset != half {
+		t.Fatalf("Expected to resume at %d, got %d (%v)", half, offset, err)
+	}
+	if err := receiver.WriteChunk(content[half:], offset); err != nil {
+		t.Fatalf("WriteChunk failed: %v", err)
+	}
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "big.bin")); !bytes.Equal(data, content) {
+		t.Error("Expected the resumed file to match the source")
+	}
+}
+
+func TestResumeFileReceiverCorruptPartial(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte{7}, resumableSize)
+	info := &models.FileInfo{Path: "big.bin", Size: int64(len(content)), Hash: "hash"}
+
+	receiver, _ := NewFileReceiver(root, info, nil)
+	receiver.WriteChunk(content[:1024], 0)
+	partial, err := receiver.Suspend()
+	if err != nil || partial == nil {
+		t.Fatalf("Expected a resumable partial, got %v (%v)", partial, err)
+	}
+
+	// Damage the data on disk
+	tempPath := filepath.Join(root, "big.bin") + tempFileSuffix
+	os.WriteFile(tempPath, bytes.Repeat([]byte{8}, 1024), 0644)
+
+	receiver, offset, err := ResumeFileReceiver(root, info, partial, nil)
+	if err != nil || offset != 0 {
+		t.Fatalf("Expected a corrupt partial to start over, got offset %d (%v)", offset, err)
+	}
+	receiver.Abort()
+}
+
+func TestFileReceiverRefusesDataOutsideFile(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("hello, world")
+	sum := sha256.Sum256(content)
+	info := &models.FileInfo{Path: "a.txt", Size: int64(len(content)), Hash: hex.EncodeToString(sum[:])}
+
+	receiver, err := NewFileReceiver(root, info, nil)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	defer receiver.Abort()
+	if err := receiver.WriteChunk(content, 1); err == nil {
+		t.Error("Expected a chunk past the end of the file to be refused")
+	}
+	if err := receiver.WriteChunk(content[:1], -1); err == nil {
+		t.Error("Expected a chunk at a negative offset to be refused")
+	}
+	if err := receiver.WriteHole(8, 8); err == nil {
+		t.Error("Expected a hole past the end of the file to be refused")
+	}
+	if err := receiver.WriteChunk(content, 0); err != nil {
+		t.Errorf("Expected the whole file to be written, got %v", err)
+	}
+	if stat, err := os.Stat(receiver.tempPath); err != nil || stat.Size() != int64(len(content)) {
+		t.Errorf("Expected the temp file to hold the file alone, got %v", err)
+	}
+}
+
+func TestFileReceiverVerifyAndQuarantine(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("hello, world")
+	sum := sha256.Sum256(content)
+	info := &models.FileInfo{Path: "a.txt", Size: int64(len(content)), Hash: hex.EncodeToString(sum[:])}
+
+	// Chunks written out of order are verified from disk
+	receiver, err := NewFileReceiver(root, info, nil)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	receiver.WriteChunk(content[5:], 5)
+	if err := receiver.Verify(); err == nil {
+		t.Error("Expected an incomplete file to fail verification")
+	}
+	receiver.WriteChunk(content[:5], 0)
+	if err := receiver.Verify(); err != nil {
+		t.Errorf("Expected the complete file to verify, got %v", err)
+	}
+	receiver.Abort()
+
+	// Corrupted data is set aside instead of replacing the file
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("original"), 0644)
+	receiver, err = NewFileReceiver(root, info, nil)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	receiver.WriteChunk([]byte("hello, World"), 0)
+	if err := receiver.Verify(); err == nil {
+		t.Fatal("Expected corrupted data to fail verification")
+	}
+	dest := filepath.Join(t.TempDir(), "quarantine", "a.txt.1")
+	if err := receiver.Quarantine(dest); err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "hello, World" {
+		t.Errorf("Expected the received data in quarantine, got %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "original" {
+		t.Errorf("Expected the local file untouched, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt"+tempFileSuffix)); !os.IsNotExist(err) {
+		t.Error("Expected the temp file to be gone")
+	}
+}
@@ -0,0 +1,290 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// watchDebounce is how long a folder must stay quiet before a sync starts
+	watchDebounce = 2 * time.Second
+	// watchMaxDelay bounds how long a steady stream of changes can delay a sync
+	watchMaxDelay = 30 * time.Second
+)
+
+// fsWatcher is a platform file system notification source. It reports the
+// absolute paths of changed entries below the watched root.
+type fsWatcher interface {
+	Events() <-chan string
+	Errors() <-chan error
+	Close() error
+}
+
+// FolderWatcher watches a folder pair's local directory and reports the
+// changed relative paths once a burst of changes has settled
+type FolderWatcher struct {
+	folderPairID string
+	rootPath     string
+	newScanner   func() *Scanner
+	scanner      atomic.Pointer[Scanner]
+	source       fsWatcher
+	onChange     func(folderPairID string, paths []string)
+
+	debounce time.Duration
+	maxDelay time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewFolderWatcher starts watching a folder pair's local directory.
+// Changes excluded by the scanner from newScanner are ignored; a new
+// scanner is made whenever one of the folder's ignore files changes.
+func NewFolderWatcher(fp *models.FolderPair, newScanner func() *Scanner, onChange func(folderPairID string, paths []string)) (*FolderWatcher, error) {
+	rootPath, err := filepath.Abs(fp.LocalPath)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(rootPath); err == nil {
+		// Notifications report resolved paths
+		rootPath = resolved
+	}
+
+	w := &FolderWatcher{
+		folderPairID: fp.ID,
+		rootPath:     rootPath,
+		newScanner:   newScanner,
+		onChange:     onChange,
+		debounce:     watchDebounce,
+		maxDelay:     watchMaxDelay,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	w.scanner.Store(newScanner())
+
+	source, err := newFSWatcher(rootPath, func(path string) bool {
+		relPath, ok := w.relPath(path)
+		return ok && w.scanner.Load().isExcludedPath(relPath, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.source = source
+
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching and waits for the watcher to exit. A sync already
+// reported keeps running.
+func (w *FolderWatcher) Close() {
+	close(w.stop)
+	<-w.done
+	w.source.Close()
+}
+
+// run collects changes until the folder has been quiet for the debounce
+// interval, then reports them. Reports run on their own goroutine, one at a
+// time; changes settling while one runs are reported once it returns.
+func (w *FolderWatcher) run() {
+	defer close(w.done)
+
+	pending := make(map[string]bool)
+	var first time.Time
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	// syncing is closed when the running report returns; settled is set
+	// when pending changes wait for it
+	var syncing chan struct{}
+	settled := false
+	report := func() {
+		paths := make([]string, 0, len(pending))
+		for path := range pending {
+			paths = append(paths, path)
+		}
+		pending = make(map[string]bool)
+		settled = false
+
+		syncing = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			w.onChange(w.folderPairID, compactPaths(paths))
+		}(syncing)
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			timer.Stop()
+			return
+
+		case path, ok := <-w.source.Events():
+			if !ok {
+				return
+			}
+			relPath, ok := w.relPath(path)
+			if !ok {
+				continue
+			}
+			if dir, ok := w.scanner.Load().ignoreFileDir(relPath); ok {
+				// Exclusions changed, so anything below dir may have
+				// become included
+				w.scanner.Store(w.newScanner())
+				relPath = dir
+			} else if w.ignored(relPath) {
+				continue
+			}
+
+			now := time.Now()
+			if len(pending) == 0 {
+				first = now
+			}
+			pending[relPath] = true
+
+			wait := w.debounce
+			if deadline := first.Add(w.maxDelay); now.Add(wait).After(deadline) {
+				wait = deadline.Sub(now)
+			}
+			timer.Reset(wait)
+			settled = false
+
+		case err, ok := <-w.source.Errors():
+			if ok {
+				log.Printf("Watcher error for %s: %v", w.rootPath, err)
+			}
+
+		case <-timer.C:
+			if len(pending) == 0 {
+				continue
+			}
+			if syncing != nil {
+				settled = true
+				continue
+			}
+			report()
+
+		case <-syncing:
+			syncing = nil
+			if settled && len(pending) > 0 {
+				report()
+			}
+		}
+	}
+}
+
+// relPath returns path relative to the watched root
+func (w *FolderWatcher) relPath(path string) (string, bool) {
+	relPath, err := filepath.Rel(w.rootPath, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return relPath, true
+}
+
+// ignored reports whether a change should not trigger a sync
+func (w *FolderWatcher) ignored(relPath string) bool {
+	// Partial downloads are reported once they are renamed into place
+	if strings.HasSuffix(relPath, tempFileSuffix) {
+		return true
+	}
+	if relPath == "." {
+		return false
+	}
+	info, err := os.Lstat(filepath.Join(w.rootPath, relPath))
+	return w.scanner.Load().isExcludedPath(relPath, err == nil && info.IsDir())
+}
+
+// compactPaths sorts paths and drops those below another path in the list
+func compactPaths(paths []string) []string {
+	sort.Strings(paths)
+	for _, path := range paths {
+		if path == "." {
+			return []string{"."}
+		}
+	}
+
+	compacted := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if inScope(path, compacted) {
+			continue
+		}
+		compacted = append(compacted, path)
+	}
+	return compacted
+}
+
+// RefreshWatchers starts or stops folder watchers to match the enabled
+// folder pairs. Call it after folder pairs or exclusions change.
+func (e *Engine) RefreshWatchers() {
+	e.watchMu.Lock()
+	defer e.watchMu.Unlock()
+
+	cfg := e.config.Get()
+	wanted := make(map[string]string)
+	pairs := make(map[string]*models.FolderPair)
+	if e.watching {
+		for _, fp := range cfg.FolderPairs {
+			peer := cfg.GetPeer(fp.PeerID)
+			if !fp.Enabled || peer == nil || !peer.Paired {
+				continue
+			}
+			exclusions := append(append([]string{}, cfg.GlobalExclusions...), fp.Exclusions...)
+			wanted[fp.ID] = fmt.Sprintf("%s\x00%v\x00%s", fp.LocalPath, fp.GitIgnore, strings.Join(exclusions, "\x00"))
+			pairs[fp.ID] = fp
+		}
+	}
+
+	for id, w := range e.watchers {
+		if key, ok := wanted[id]; !ok || key != e.watcherKeys[id] {
+			w.Close()
+			delete(e.watchers, id)
+			delete(e.watcherKeys, id)
+		}
+	}
+
+	for id, key := range wanted {
+		if _, ok := e.watchers[id]; ok {
+			continue
+		}
+		fp := pairs[id]
+		newScanner := func() *Scanner {
+			return e.scannerFor(fp)
+		}
+		w, err := NewFolderWatcher(fp, newScanner, e.syncChangedPaths)
+		if err != nil {
+			log.Printf("Failed to watch %s: %v", fp.LocalPath, err)
+			continue
+		}
+		e.watchers[id] = w
+		e.watcherKeys[id] = key
+	}
+}
+
+// setWatching enables or disables real-time watching of all folder pairs
+func (e *Engine) setWatching(enabled bool) {
+	e.watchMu.Lock()
+	e.watching = enabled
+	e.watchMu.Unlock()
+	e.RefreshWatchers()
+}
+
+// syncChangedPaths syncs the paths reported by a folder watcher
+func (e *Engine) syncChangedPaths(folderPairID string, paths []string) {
+	if e.ctx.Err() != nil {
+		return
+	}
+
+	if err := e.SyncFolderPaths(folderPairID, paths); err != nil {
+		// The periodic full sync catches up once the peer is reachable
+		log.Printf("Failed to sync changes in folder pair %s: %v", folderPairID, err)
+	}
+}
@@ -0,0 +1,83 @@
+//go:build darwin && cgo
+
+package sync
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsevents"
+)
+
+// eventsWatcher watches a directory tree with FSEvents, which reports
+// changes below the root without per-directory watches
+type eventsWatcher struct {
+	stream *fsevents.EventStream
+	events chan string
+	done   chan struct{}
+}
+
+// newFSWatcher starts watching rootPath recursively. FSEvents can't skip
+// subtrees, so excluded paths are filtered by the caller.
+func newFSWatcher(rootPath string, excluded func(path string) bool) (fsWatcher, error) {
+	w := &eventsWatcher{
+		stream: &fsevents.EventStream{
+			Paths:   []string{rootPath},
+			Latency: 500 * time.Millisecond,
+			Flags:   fsevents.FileEvents | fsevents.NoDefer,
+		},
+		events: make(chan string, 64),
+		done:   make(chan struct{}),
+	}
+	if err := w.stream.Start(); err != nil {
+		return nil, err
+	}
+
+	go w.run(rootPath)
+	return w, nil
+}
+
+func (w *eventsWatcher) run(rootPath string) {
+	defer close(w.events)
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case batch, ok := <-w.stream.Events:
+			if !ok {
+				return
+			}
+			for _, event := range batch {
+				path := event.Path
+				if path == "" || path[0] != '/' {
+					path = "/" + path
+				}
+				if event.Flags&(fsevents.MustScanSubDirs|fsevents.RootChanged) != 0 {
+					// Events were coalesced or dropped; rescan the whole folder
+					path = rootPath
+				}
+				select {
+				case w.events <- path:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *eventsWatcher) Events() <-chan string {
+	return w.events
+}
+
+// Errors returns nil: FSEvents reports no errors, and dropped events arrive
+// as a rescan of the root
+func (w *eventsWatcher) Errors() <-chan error {
+	return nil
+}
+
+func (w *eventsWatcher) Close() error {
+	close(w.done)
+	w.stream.Stop()
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build !darwin || !cgo
+
+package sync
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// notifyWatcher watches a directory tree with fsnotify (inotify on Linux).
+// Watches are per directory, so new directories are added as they appear.
+type notifyWatcher struct {
+	watcher  *fsnotify.Watcher
+	excluded func(path string) bool
+	events   chan string
+	done     chan struct{}
+}
+
+// newFSWatcher starts watching rootPath recursively, skipping directories
+// for which excluded returns true
+func newFSWatcher(rootPath string, excluded func(path string) bool) (fsWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &notifyWatcher{
+		watcher:  watcher,
+		excluded: excluded,
+		events:   make(chan string, 64),
+		done:     make(chan struct{}),
+	}
+	if err := w.addTree(rootPath); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// addTree adds a watch for dir and every directory below it
+func (w *notifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if path != dir && w.excluded(path) {
+			return filepath.SkipDir
+		}
+		return w.watcher.Add(path)
+	})
+}
+
+func (w *notifyWatcher) run() {
+	defer close(w.events)
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() && !w.excluded(event.Name) {
+					w.addTree(event.Name)
+				}
+			}
+			select {
+			case w.events <- event.Name:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *notifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *notifyWatcher) Errors() <-chan error {
+	return w.watcher.Errors
+}
+
+func (w *notifyWatcher) Close() error {
+	close(w.done)
+	return w.watcher.Close()
+}
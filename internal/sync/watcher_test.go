@@ -0,0 +1,134 @@
+package sync
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeSource struct {
+	events chan string
+	errors chan error
+}
+
+func (f *fakeSource) Events() <-chan string { return f.events }
+func (f *fakeSource) Errors() <-chan error  { return f.errors }
+func (f *fakeSource) Close() error          { return nil }
+
+func newTestWatcher(root string, exclusions []string) (*FolderWatcher, *fakeSource, chan []string) {
+	source := &fakeSource{events: make(chan string), errors: make(chan error)}
+	changes := make(chan []string, 4)
+	w := &FolderWatcher{
+		folderPairID: "pair",
+		rootPath:     root,
+		newScanner:   func() *Scanner { return NewScanner(exclusions) },
+		source:       source,
+		onChange:     func(_ string, paths []string) { changes <- paths },
+		debounce:     20 * time.Millisecond,
+		maxDelay:     time.Second,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	w.scanner.Store(w.newScanner())
+	go w.run()
+	return w, source, changes
+}
+
+func TestFolderWatcherDebouncesChanges(t *testing.T) {
+	root := filepath.FromSlash("/data/project")
+	w, source, changes := newTestWatcher(root, []string{"node_modules", "*.swp"})
+	defer w.Close()
+
+	for _, path := range []string{
+		"src/main.go",
+		"src",
+		"src/util.go",
+		"node_modules/pkg/index.js",
+		"src/.main.go.swp",
+		"README.md" + tempFileSuffix,
+		"README.md",
+	} {
+		source.events <- filepath.Join(root, filepath.FromSlash(path))
+	}
+	source.events <- filepath.FromSlash("/elsewhere/file.txt")
+
+	select {
+	case paths := <-changes:
+		expected := []string{"README.md", "src"}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("Expected %v, got %v", expected, paths)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected changes to be reported")
+	}
+
+	select {
+	case paths := <-changes:
+		t.Errorf("Expected a single report for the burst, got another: %v", paths)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCompactPaths(t *testing.T) {
+	paths := compactPaths([]string{"a/b/c.txt", "a.txt", "a/b", "b"})
+	expected := []string{"a.txt", "a/b", "b"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Expected %v, got %v", expected, paths)
+	}
+
+	if paths := compactPaths([]string{"-x", ".", "a"}); !reflect.DeepEqual(paths, []string{"."}) {
+		t.Errorf("Expected the root to cover everything, got %v", paths)
+	}
+}
+
+func TestFolderWatcherReportsWhileSyncing(t *testing.T) {
+	root := filepath.FromSlash("/data/project")
+	w, source, changes := newTestWatcher(root, nil)
+	release := make(chan struct{})
+	defer close(release)
+	report := w.onChange
+	w.onChange = func(id string, paths []string) {
+		report(id, paths)
+		<-release
+	}
+
+	source.events <- filepath.Join(root, "a.txt")
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("Expected changes to be reported")
+	}
+
+	// Changes settling during the sync wait for it to finish
+	source.events <- filepath.Join(root, "b.txt")
+	select {
+	case paths := <-changes:
+		t.Fatalf("Expected no report while syncing, got %v", paths)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release <- struct{}{}
+	select {
+	case paths := <-changes:
+		if !reflect.DeepEqual(paths, []string{"b.txt"}) {
+			t.Errorf("Expected [b.txt], got %v", paths)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the changes to be reported after the sync")
+	}
+
+	// Closing doesn't wait for a running sync
+	release <- struct{}{}
+	source.events <- filepath.Join(root, "c.txt")
+	<-changes
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Close not to wait for the sync")
+	}
+}
@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"SyncDev/internal/models"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"path"
+	"sort"
+)
+
+// unsyncableXattrs are namespaces that hold filesystem internals or need
+// privileges to write, and are never synced
+var unsyncableXattrs = []string{"security.*", "system.*", "trusted.*"}
+
+// errXattrsUnsupported is returned when extended attributes can't be set
+// on this platform
+var errXattrsUnsupported = errors.New("extended attributes are not supported")
+
+// xattrFilter selects the extended attributes that are synced. A nil
+// filter syncs none.
+type xattrFilter struct {
+	allow []string
+	deny  []string
+	peer  *xattrFilter // The peer's filter, which must sync a name as well
+}
+
+// newXattrFilter returns the filter for a folder pair's settings, or nil
+// if the pair doesn't sync extended attributes
+func newXattrFilter(settings models.XattrSettings) *xattrFilter {
+	if !settings.Enabled {
+		return nil
+	}
+	return &xattrFilter{allow: settings.Allow, deny: settings.Deny}
+}
+
+// intersect returns the filter for the names both f and the peer's
+// settings sync, or nil if either side doesn't sync extended attributes
+func (f *xattrFilter) intersect(peer *models.XattrSettings) *xattrFilter {
+	if f == nil || peer == nil || !peer.Enabled {
+		return nil
+	}
+	return &xattrFilter{allow: f.allow, deny: f.deny, peer: newXattrFilter(*peer)}
+}
+
+// syncs reports whether the attribute called name is synced
+func (f *xattrFilter) syncs(name string) bool {
+	if f == nil || matchesAny(unsyncableXattrs, name) || matchesAny(f.deny, name) {
+		return false
+	}
+	if len(f.allow) > 0 && !matchesAny(f.allow, name) {
+		return false
+	}
+	return f.peer == nil || f.peer.syncs(name)
+}
+
+// only returns the attributes of attrs that are synced
+func (f *xattrFilter) only(attrs map[string][]byte) map[string][]byte {
+	var synced map[string][]byte
+	for name, value := range attrs {
+		if f.syncs(name) {
+			if synced == nil {
+				synced = make(map[string][]byte)
+			}
+			synced[name] = value
+		}
+	}
+	return synced
+}
+
+// read returns the synced attributes of the file at path. Attributes that
+// can't be read are left out.
+func (f *xattrFilter) read(path string) map[string][]byte {
+	if f == nil {
+		return nil
+	}
+	attrs, _ := readXattrs(path)
+	return f.only(attrs)
+}
+
+// apply gives fileInfo the synced attributes of the file at path and
+// their hash
+func (f *xattrFilter) apply(fileInfo *models.FileInfo, path string) {
+	if f == nil {
+		return
+	}
+	fileInfo.Xattrs = f.read(path)
+	fileInfo.XattrHash = xattrHash(fileInfo.Xattrs)
+}
+
+// xattrHash returns the hash of a set of attributes, which is set even for
+// none so files without attributes compare as such
+func xattrHash(attrs map[string][]byte) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hasher := sha256.New()
+	var size [8]byte
+	for _, name := range names {
+		hasher.Write([]byte(name))
+		hasher.Write([]byte{0})
+		binary.BigEndian.PutUint64(size[:], uint64(len(attrs[name])))
+		hasher.Write(size[:])
+		hasher.Write(attrs[name])
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// scopeXattrs returns index with the attributes of each entry narrowed to
+// those f syncs, and rehashed, so both sides are compared by the same
+// names. With a nil filter, attributes are dropped from the comparison.
+func scopeXattrs(index *models.FileIndex, f *xattrFilter) *models.FileIndex {
+	if index == nil {
+		return nil
+	}
+
+	scoped := &models.FileIndex{
+		FolderPath: index.FolderPath,
+		Files:      make(map[string]*models.FileInfo, len(index.Files)),
+		UpdatedAt:  index.UpdatedAt,
+	}
+	for p, info := range index.Files {
+		if info.XattrHash != "" || info.Xattrs != nil {
+			narrowed := *info
+			narrowed.Xattrs, narrowed.XattrHash = nil, ""
+			if f != nil && info.XattrHash != "" {
+				narrowed.Xattrs = f.only(info.Xattrs)
+				narrowed.XattrHash = xattrHash(narrowed.Xattrs)
+			}
+			info = &narrowed
+		}
+		scoped.Files[p] = info
+	}
+	return scoped
+}
+
+// matchesAny reports whether name matches one of patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"SyncDev/internal/models"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrSync(t *testing.T) {
+	remote, local := t.TempDir(), t.TempDir()
+	src := filepath.Join(remote, "tagged.txt")
+	os.WriteFile(src, []byte("tagged"), 0644)
+	if err := unix.Setxattr(src, "user.tags", []byte("red"), 0); err != nil {
+		t.Skipf("Extended attributes not supported: %v", err)
+	}
+	unix.Setxattr(src, "user.cache", []byte("stale"), 0)
+
+	settings := models.XattrSettings{Enabled: true, Allow: []string{"user.*"}, Deny: []string{"user.cache"}}
+	scanner := NewScanner(nil)
+	scanner.SetXattrs(settings)
+	scan := func(root string) *models.FileIndex {
+		index, err := scanner.ScanDirectory(context.Background(), root)
+		if err != nil {
+			t.Fatalf("ScanDirectory failed: %v", err)
+		}
+		return index
+	}
+
+	remoteIndex := scan(remote)
+	info := remoteIndex.Files["tagged.txt"]
+	if string(info.Xattrs["user.tags"]) != "red" || info.Xattrs["user.cache"] != nil {
+		t.Fatalf("Expected only the allowed attribute to be read, got %v", info.Xattrs)
+	}
+
+	// The receiver applies the attributes when it finalizes the file
+	receiver, err := NewFileReceiver(local, info, nil)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	receiver.WriteChunk([]byte("tagged"), 0)
+	if err := receiver.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+	value := make([]byte, 16)
+	n, err := unix.Getxattr(filepath.Join(local, "tagged.txt"), "user.tags", value)
+	if err != nil || string(value[:n]) != "red" {
+		t.Errorf("Expected the received file to be tagged red, got %q, %v", value[:n], err)
+	}
+	if _, err := unix.Getxattr(filepath.Join(local, "tagged.txt"), "user.cache", nil); err == nil {
+		t.Error("Expected the denied attribute not to be applied")
+	}
+
+	localIndex := scan(local)
+	if actions := CompareIndices(localIndex, remoteIndex, nil); len(actions) != 0 {
+		t.Errorf("Expected the copies to match, got %d actions", len(actions))
+	}
+
+	// A changed attribute is a change to the file
+	unix.Setxattr(src, "user.tags", []byte("blue"), 0)
+	base := BuildBaseIndex(localIndex, remoteIndex)
+	actions := CompareIndices(localIndex, scan(remote), base)
+	if len(actions) != 1 || actions[0].Action != models.FileActionPull {
+		t.Fatalf("Expected the retagged file to be pulled, got %d actions", len(actions))
+	}
+
+	// Unless attributes are left out of the comparison
+	if actions := CompareIndices(scopeXattrs(localIndex, nil), scopeXattrs(scan(remote), nil), nil); len(actions) != 0 {
+		t.Errorf("Expected attributes to be ignored when a side doesn't sync them, got %d actions", len(actions))
+	}
+}
+
+func TestXattrFilterIntersect(t *testing.T) {
+	local := newXattrFilter(models.XattrSettings{Enabled: true, Deny: []string{"user.private"}})
+	both := local.intersect(&models.XattrSettings{Enabled: true, Allow: []string{"user.*"}})
+
+	for name, expected := range map[string]bool{
+		"user.tags":            true,
+		"user.private":         false,
+		"com.apple.FinderInfo": false,
+		"security.selinux":     false,
+	} {
+		if both.syncs(name) != expected {
+			t.Errorf("Expected syncs(%s) to be %v", name, expected)
+		}
+	}
+	if local.intersect(&models.XattrSettings{}) != nil || local.intersect(nil) != nil {
+		t.Error("Expected no attributes to be synced when the peer doesn't sync them")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package sync
+
+// readXattrs returns no attributes: extended attributes aren't read on
+// this platform
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// writeXattrs fails for any attributes: extended attributes can't be set
+// on this platform
+func writeXattrs(path string, attrs map[string][]byte) error {
+	if len(attrs) > 0 {
+		return errXattrsUnsupported
+	}
+	return nil
+}
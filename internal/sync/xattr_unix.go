@@ -0,0 +1,68 @@
+//go:build linux || darwin
+
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of the file at path
+func readXattrs(path string) (map[string][]byte, error) {
+	list, err := xattrBuffer(func(dest []byte) (int, error) {
+		return unix.Listxattr(path, dest)
+	})
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(bytes.TrimRight(list, "\x00"), []byte{0}) {
+		value, err := xattrBuffer(func(dest []byte) (int, error) {
+			return unix.Getxattr(path, string(name), dest)
+		})
+		if err != nil {
+			// Removed since it was listed, or not readable
+			continue
+		}
+		attrs[string(name)] = value
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets the extended attributes attrs on the file at path
+func writeXattrs(path string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		if err := unix.Setxattr(path, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// xattrBuffer calls get, which fills dest like getxattr(2), with a buffer
+// of the size the attribute data has. Data that grows between the calls
+// is read again.
+func xattrBuffer(get func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := get(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := get(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}